@@ -0,0 +1,166 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sprintframework/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// permissions of the committed atomic file
+var AtomicFileMode os.FileMode = 0644
+
+// permissions of directories created by the OS file system
+var DirectoryMode os.FileMode = 0755
+
+/**
+Extension of the file service that creates crash-safe files.
+Content is written in to the sibling temp file, that on Close is synced and renamed over the target file.
+On file systems with AtomicCreateFileSystem capability the file is created on the path directly and committed by Close.
+ */
+type AtomicFileService interface {
+
+	/*
+	Creates new CSV file that appears on the file path only after successful Close.
+	 */
+	NewAtomicCsvFile(filePath string, valueProcessors ...fs.CsvValueProcessor) (AtomicCsvWriter, error)
+
+	/*
+	Creates new JSON file that appears on the file path only after successful Close.
+	 */
+	NewAtomicJsonFile(filePath string) (AtomicJsonWriter, error)
+
+	/*
+	Creates new protofile that appears on the file path only after successful Close.
+	 */
+	NewAtomicProtoFile(filePath string) (AtomicProtoWriter, error)
+}
+
+/**
+Writer that could discard the written content instead of commit.
+ */
+type Aborter interface {
+
+	/*
+	Closes stream and removes the partial output.
+	 */
+	Abort() error
+}
+
+/**
+CSV writer of the atomic file.
+ */
+type AtomicCsvWriter interface {
+	fs.CsvWriter
+	Aborter
+}
+
+/**
+JSON writer of the atomic file.
+ */
+type AtomicJsonWriter interface {
+	fs.JsonWriter
+	Aborter
+}
+
+/**
+Protofile writer of the atomic file.
+ */
+type AtomicProtoWriter interface {
+	fs.ProtoWriter
+	Aborter
+}
+
+func createAtomicFile(fsys FileSystem, filePath string) (WritableFile, error) {
+	if atomicCreate(fsys, filePath) {
+		fd, err := fsys.Create(filePath)
+		if err != nil {
+			return nil, errors.Errorf("file create error '%s', %v", filePath, err)
+		}
+		return fd, nil
+	}
+	dir, name := splitFilePath(filePath)
+	fd, err := fsys.CreateTemp(dir, "." + name + ".*.tmp")
+	if err != nil {
+		return nil, errors.Errorf("temp file create error '%s', %v", filePath, err)
+	}
+	return fd, nil
+}
+
+/**
+Closes the file, for atomic files commits it on success and discards on error.
+ */
+func closeFile(fsys FileSystem, fd WritableFile, atomicPath string, err error) error {
+
+	if atomicPath == "" {
+		if closeErr := fd.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+
+	if err != nil {
+		abortFile(fsys, fd)
+		return errors.Errorf("atomic file flush error '%s', %v", atomicPath, err)
+	}
+
+	return commitFile(fsys, fd, atomicPath)
+}
+
+func commitFile(fsys FileSystem, fd WritableFile, filePath string) error {
+
+	if err := fd.Sync(); err != nil {
+		abortFile(fsys, fd)
+		return errors.Errorf("atomic file sync error '%s', %v", filePath, err)
+	}
+
+	// file created on the path directly is committed by Close, failed Close keeps the previous content
+	direct := atomicCreate(fsys, filePath)
+
+	if err := fd.Close(); err != nil {
+		if !direct {
+			fsys.Remove(fd.Name())
+		}
+		return errors.Errorf("atomic file close error '%s', %v", filePath, err)
+	}
+
+	if direct {
+		return nil
+	}
+
+	if err := fsys.Rename(fd.Name(), filePath); err != nil {
+		fsys.Remove(fd.Name())
+		return errors.Errorf("atomic file rename error '%s', %v", filePath, err)
+	}
+
+	return nil
+}
+
+/**
+Splits file path by the last separator, keeps URL scheme of the directory like s3://bucket intact.
+ */
+func splitFilePath(filePath string) (string, string) {
+	i := strings.LastIndexAny(filePath, "/" + string(filepath.Separator))
+	switch {
+	case i < 0:
+		return ".", filePath
+	case i == 0:
+		return filePath[:1], filePath[1:]
+	default:
+		return filePath[:i], filePath[i+1:]
+	}
+}
+
+func abortFile(fsys FileSystem, fd WritableFile) error {
+	if aborter, ok := fd.(Aborter); ok {
+		return aborter.Abort()
+	}
+	fd.Close()
+	return fsys.Remove(fd.Name())
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod_test
+
+import (
+	"github.com/sprintframework/fsmod"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAtomicWriteAndAbort(t *testing.T) {
+
+	fs := fsmod.FileService()
+
+	dir, err := ioutil.TempDir(os.TempDir(), "atomic-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Test Commit
+	filePath := filepath.Join(dir, "test.csv.gz")
+	csv, err := fs.NewAtomicCsvFile(filePath)
+	require.NoError(t, err)
+
+	err = csv.Write("123", "", "", "", "")
+	require.NoError(t, err)
+
+	_, err = os.Stat(filePath)
+	require.True(t, os.IsNotExist(err))
+
+	err = csv.Close()
+	require.NoError(t, err)
+	readCsv(t, filePath)
+
+	// Test Abort
+	filePath = filepath.Join(dir, "test.pb")
+	pf, err := fs.NewAtomicProtoFile(filePath)
+	require.NoError(t, err)
+
+	_, err = pf.Write(&Domain{ Domain: "obj1" })
+	require.NoError(t, err)
+
+	err = pf.Abort()
+	require.NoError(t, err)
+
+	_, err = os.Stat(filePath)
+	require.True(t, os.IsNotExist(err))
+
+	// Test Replace
+	filePath = filepath.Join(dir, "test.json")
+	writeJson(t, fs, filePath)
+
+	js, err := fs.NewAtomicJsonFile(filePath)
+	require.NoError(t, err)
+	err = js.Abort()
+	require.NoError(t, err)
+	readJson(t, fs, filePath)
+
+	js, err = fs.NewAtomicJsonFile(filePath)
+	require.NoError(t, err)
+	writeJsonStream(t, js)
+	readJson(t, fs, filePath)
+
+	// no temp files left
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(files))
+}
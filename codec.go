@@ -0,0 +1,377 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"github.com/dsnet/compress/bzip2"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/sprintframework/fs"
+	"github.com/ulikunitz/xz"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+/**
+Compression codec that is used by file readers and writers. Codec is selected by file extension on files and passed explicitly on streams.
+ */
+type Codec interface {
+
+	/*
+	Gets the file extension with the leading dot, for example `.gz`.
+	 */
+	Extension() string
+
+	/*
+	Gets the magic bytes at the beginning of compressed stream, used to detect codec regardless of file name.
+	 */
+	Magic() []byte
+
+	/*
+	Wraps reader with decompression stream.
+	 */
+	NewReader(r io.Reader) (io.ReadCloser, error)
+
+	/*
+	Wraps writer with compression stream. Close flushes compressed data, but does not close underline writer.
+	 */
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+}
+
+/**
+Extension of the file service that is capable to work with the codec registry.
+ */
+type CodecFileService interface {
+
+	/*
+	Registers codec by the extension, replaces the existing one.
+	 */
+	RegisterCodec(codec Codec)
+
+	/*
+	Gets registered codec by the extension.
+	 */
+	Codec(extension string) (Codec, bool)
+
+	/*
+	Finds codec by the file path suffix, returns nil if file is not compressed.
+	 */
+	FileCodec(filePath string) Codec
+
+	/*
+	Gets current codec detection mode for opened files, default value is DetectAuto.
+	 */
+	CodecDetection() CodecDetection
+
+	/*
+	Sets codec detection mode for opened files.
+	 */
+	SetCodecDetection(mode CodecDetection)
+
+	/*
+	Creates new CSV stream compressed by codec, nil codec means plain stream.
+	 */
+	NewCsvCodecStream(fw io.Writer, codec Codec, valueProcessors ...fs.CsvValueProcessor) (fs.CsvWriter, error)
+
+	/*
+	Opens CSV stream compressed by codec, nil codec means plain stream.
+	 */
+	OpenCsvCodecStream(fr io.Reader, codec Codec, valueProcessors ...fs.CsvValueProcessor) (fs.CsvStream, error)
+
+	/*
+	Creates new JSON stream compressed by codec, nil codec means plain stream.
+	 */
+	NewJsonCodecStream(fd io.Writer, codec Codec) (fs.JsonWriter, error)
+
+	/*
+	Opens JSON stream compressed by codec, nil codec means plain stream.
+	 */
+	JsonCodecStream(fr io.Reader, codec Codec) (fs.JsonReader, error)
+
+	/*
+	Creates new protofile stream compressed by codec, nil codec means plain stream.
+	 */
+	NewProtoCodecStream(fd io.Writer, codec Codec) (fs.ProtoWriter, error)
+
+	/*
+	Creates new in-memory protofile stream compressed by codec, nil codec means plain stream.
+	 */
+	NewProtoCodecBuf(codec Codec) (fs.ProtoWriter, error)
+
+	/*
+	Opens protofile stream compressed by codec, nil codec means plain stream.
+	 */
+	ProtoCodecStream(fr io.Reader, codec Codec) (fs.ProtoReader, error)
+}
+
+/**
+Defines how readers of files choose the codec.
+ */
+type CodecDetection int
+
+const (
+	/*
+	Detects codec by magic bytes, falls back to the file extension if nothing matched or file is too short.
+	 */
+	DetectAuto CodecDetection = iota
+
+	/*
+	Detects codec only by magic bytes, file extension is ignored.
+	 */
+	DetectByMagic
+
+	/*
+	Detects codec only by file extension.
+	 */
+	DetectByExtension
+)
+
+var (
+	GzipCodec   Codec = gzipCodec{}
+	ZstdCodec   Codec = zstdCodec{}
+	Lz4Codec    Codec = lz4Codec{}
+	SnappyCodec Codec = snappyCodec{}
+	Bzip2Codec  Codec = bzip2Codec{}
+	XzCodec     Codec = xzCodec{}
+)
+
+// codecs registered in each new file service
+var DefaultCodecs = []Codec {
+	GzipCodec,
+	ZstdCodec,
+	Lz4Codec,
+	SnappyCodec,
+	Bzip2Codec,
+	XzCodec,
+}
+
+func (t *fileServiceImpl) RegisterCodec(codec Codec) {
+	t.codecs[codec.Extension()] = codec
+}
+
+func (t *fileServiceImpl) Codec(extension string) (Codec, bool) {
+	codec, ok := t.codecs[extension]
+	return codec, ok
+}
+
+func (t *fileServiceImpl) FileCodec(filePath string) Codec {
+	var found Codec
+	for ext, codec := range t.codecs {
+		if strings.HasSuffix(filePath, ext) && (found == nil || len(ext) > len(found.Extension())) {
+			found = codec
+		}
+	}
+	return found
+}
+
+func (t *fileServiceImpl) CodecDetection() CodecDetection {
+	return t.detection
+}
+
+func (t *fileServiceImpl) SetCodecDetection(mode CodecDetection) {
+	t.detection = mode
+}
+
+/**
+Peeks the first bytes of the file through the buffered reader, nothing is consumed.
+ */
+func (t *fileServiceImpl) detectCodec(fileName string, fr *bufio.Reader) Codec {
+
+	if t.detection == DetectByExtension {
+		return t.FileCodec(fileName)
+	}
+
+	var found []Codec
+	for _, codec := range t.codecs {
+		magic := codec.Magic()
+		if len(magic) == 0 {
+			continue
+		}
+		head, _ := fr.Peek(len(magic))
+		if bytes.Equal(head, magic) {
+			found = append(found, codec)
+		}
+	}
+
+	if len(found) == 1 {
+		return found[0]
+	}
+
+	if t.detection == DetectByMagic {
+		return nil
+	}
+
+	// nothing or several codecs matched, let the extension decide
+	return t.FileCodec(fileName)
+}
+
+func withGzipCodec(withGzip bool) Codec {
+	if withGzip {
+		return GzipCodec
+	}
+	return nil
+}
+
+type gzipCodec struct {
+}
+
+func (gzipCodec) Extension() string {
+	return ".gz"
+}
+
+func (gzipCodec) Magic() []byte {
+	return []byte{ 0x1f, 0x8b }
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+type zstdCodec struct {
+}
+
+func (zstdCodec) Extension() string {
+	return ".zst"
+}
+
+func (zstdCodec) Magic() []byte {
+	return []byte{ 0x28, 0xb5, 0x2f, 0xfd }
+}
+
+func (zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return zr.IOReadCloser(), nil
+}
+
+func (zstdCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w)
+}
+
+type lz4Codec struct {
+}
+
+func (lz4Codec) Extension() string {
+	return ".lz4"
+}
+
+func (lz4Codec) Magic() []byte {
+	return []byte{ 0x04, 0x22, 0x4d, 0x18 }
+}
+
+func (lz4Codec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return ioutil.NopCloser(&lz4FramesReader{ br: br, zr: lz4.NewReader(br) }), nil
+}
+
+func (lz4Codec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return lz4.NewWriter(w), nil
+}
+
+/**
+Reads concatenated LZ4 frames as a single stream.
+ */
+type lz4FramesReader struct {
+	br  *bufio.Reader
+	zr  *lz4.Reader
+	eof bool // end of the current frame
+}
+
+func (r *lz4FramesReader) Read(p []byte) (int, error) {
+	for {
+		if r.eof {
+			if _, err := r.br.Peek(1); err != nil {
+				return 0, io.EOF
+			}
+			r.zr.Reset(r.br)
+			r.eof = false
+		}
+		n, err := r.zr.Read(p)
+		if err == io.EOF {
+			r.eof = true
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+type snappyCodec struct {
+}
+
+func (snappyCodec) Extension() string {
+	return ".sz"
+}
+
+func (snappyCodec) Magic() []byte {
+	return []byte{ 0xff, 0x06, 0x00, 0x00, 's', 'N', 'a', 'P', 'p', 'Y' }
+}
+
+func (snappyCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(snappy.NewReader(r)), nil
+}
+
+func (snappyCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return snappy.NewBufferedWriter(w), nil
+}
+
+type bzip2Codec struct {
+}
+
+func (bzip2Codec) Extension() string {
+	return ".bz2"
+}
+
+func (bzip2Codec) Magic() []byte {
+	return []byte{ 'B', 'Z', 'h' }
+}
+
+func (bzip2Codec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return bzip2.NewReader(r, nil)
+}
+
+func (bzip2Codec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return bzip2.NewWriter(w, nil)
+}
+
+type xzCodec struct {
+}
+
+func (xzCodec) Extension() string {
+	return ".xz"
+}
+
+func (xzCodec) Magic() []byte {
+	return []byte{ 0xfd, '7', 'z', 'X', 'Z', 0x00 }
+}
+
+func (xzCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	xr, err := xz.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(xr), nil
+}
+
+func (xzCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return xz.NewWriter(w)
+}
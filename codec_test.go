@@ -0,0 +1,170 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod_test
+
+import (
+	"bytes"
+	"github.com/sprintframework/fsmod"
+	"github.com/stretchr/testify/require"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCodecWriteAndRead(t *testing.T) {
+
+	fs := fsmod.FileService()
+
+	fd, err := ioutil.TempFile(os.TempDir(), "codec-test")
+	require.NoError(t, err)
+	filePath := fd.Name()
+	fd.Close()
+	os.Remove(filePath)
+
+	for _, codec := range fsmod.DefaultCodecs {
+
+		found, ok := fs.Codec(codec.Extension())
+		require.True(t, ok)
+		require.Equal(t, codec, found)
+
+		// Test Files
+		codecFilePath := filePath + ".pb" + codec.Extension()
+		require.Equal(t, codec, fs.FileCodec(codecFilePath))
+		writeProto(t, fs, codecFilePath)
+		readProto(t, fs, codecFilePath)
+		os.Remove(codecFilePath)
+
+		codecFilePath = filePath + ".csv" + codec.Extension()
+		writeCsv(t, fs, codecFilePath)
+		readCsv(t, codecFilePath)
+		os.Remove(codecFilePath)
+
+		codecFilePath = filePath + ".json" + codec.Extension()
+		writeJson(t, fs, codecFilePath)
+		readJson(t, fs, codecFilePath)
+		os.Remove(codecFilePath)
+
+		// Test Streams
+		var buf bytes.Buffer
+		pw, err := fs.NewProtoCodecStream(&buf, codec)
+		require.NoError(t, err)
+		writeProtoStream(t, pw)
+
+		pr, err := fs.ProtoCodecStream(bytes.NewReader(buf.Bytes()), codec)
+		require.NoError(t, err)
+		readProtoStream(t, pr)
+
+		buf.Reset()
+		jw, err := fs.NewJsonCodecStream(&buf, codec)
+		require.NoError(t, err)
+		writeJsonStream(t, jw)
+
+		jr, err := fs.JsonCodecStream(bytes.NewReader(buf.Bytes()), codec)
+		require.NoError(t, err)
+		readJsonStream(t, jr)
+	}
+
+	require.Nil(t, fs.FileCodec(filePath + ".pb"))
+
+}
+
+func TestCodecDetection(t *testing.T) {
+
+	fs := fsmod.FileService()
+	require.Equal(t, fsmod.DetectAuto, fs.CodecDetection())
+
+	fd, err := ioutil.TempFile(os.TempDir(), "codec-test")
+	require.NoError(t, err)
+	filePath := fd.Name()
+	fd.Close()
+	os.Remove(filePath)
+
+	for _, codec := range fsmod.DefaultCodecs {
+
+		// compressed content without extension
+		codecFilePath := filePath + ".csv" + codec.Extension()
+		writeCsv(t, fs, codecFilePath)
+		err = os.Rename(codecFilePath, filePath + ".csv")
+		require.NoError(t, err)
+		readCsv(t, filePath + ".csv")
+
+		codecFilePath = filePath + ".pb" + codec.Extension()
+		writeProto(t, fs, codecFilePath)
+		err = os.Rename(codecFilePath, filePath + ".pb")
+		require.NoError(t, err)
+		readProto(t, fs, filePath + ".pb")
+
+		codecFilePath = filePath + ".json" + codec.Extension()
+		writeJson(t, fs, codecFilePath)
+		err = os.Rename(codecFilePath, filePath + ".json")
+		require.NoError(t, err)
+		readJson(t, fs, filePath + ".json")
+	}
+
+	// plain content with compression extension
+	fs.SetCodecDetection(fsmod.DetectByMagic)
+	writeCsv(t, fs, filePath + ".csv")
+	err = os.Rename(filePath + ".csv", filePath + ".csv.gz")
+	require.NoError(t, err)
+	csvReader, err := fs.OpenCsvFile(filePath + ".csv.gz")
+	require.NoError(t, err)
+	record, err := csvReader.Read()
+	require.NoError(t, err)
+	require.Equal(t, "123,#,#,#,#", strings.Join(record, ","))
+	csvReader.Close()
+	os.Remove(filePath + ".csv.gz")
+
+	// extension only
+	fs.SetCodecDetection(fsmod.DetectByExtension)
+	writeJson(t, fs, filePath + ".json.gz")
+	err = os.Rename(filePath + ".json.gz", filePath + ".json")
+	require.NoError(t, err)
+	reader, err := fs.OpenJsonFile(filePath + ".json")
+	require.NoError(t, err)
+	obj := make(map[string]interface{})
+	require.Error(t, reader.Read(&obj))
+	reader.Close()
+
+	os.Remove(filePath + ".csv")
+	os.Remove(filePath + ".pb")
+	os.Remove(filePath + ".json")
+
+}
+
+type failingCodec struct {
+	fsmod.Codec
+}
+
+func (failingCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nil, errors.New("broken codec")
+}
+
+func TestCodecStreamError(t *testing.T) {
+
+	gzip := fsmod.GzipCodec
+	fsmod.GzipCodec = failingCodec{ gzip }
+	defer func() { fsmod.GzipCodec = gzip }()
+
+	fs := fsmod.FileService()
+	var buf bytes.Buffer
+
+	// error of the codec is returned by the writer
+	csv := fs.NewCsvStream(&buf, true)
+	require.EqualError(t, csv.Write("a"), "codec '.gz' write error, broken codec")
+	require.Error(t, csv.Close())
+	jsonWriter := fs.NewJsonStream(&buf, true)
+	require.Error(t, jsonWriter.Write(map[string]int{ "a": 1 }))
+	require.Error(t, jsonWriter.Close())
+	protoWriter := fs.NewProtoStream(&buf, true)
+	_, err := protoWriter.Write(&Domain{ Domain: "a" })
+	require.Error(t, err)
+	require.Error(t, protoWriter.Close())
+	require.Equal(t, 0, buf.Len())
+	require.NoError(t, fs.NewCsvStream(&buf, false).Write("a"))
+}
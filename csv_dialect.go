@@ -0,0 +1,139 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod
+
+import (
+	"context"
+	"encoding/csv"
+	"github.com/sprintframework/fs"
+	"io"
+	"strings"
+)
+
+/**
+CSV format options passed to encoding/csv reader and writer.
+ */
+type CsvDialect struct {
+	Comma            rune // field delimiter, ',' if zero
+	Comment          rune // lines beginning with this character are skipped on reading, disabled if zero
+	LazyQuotes       bool // quote may appear in an unquoted field and non-doubled quote may appear in a quoted field
+	TrimLeadingSpace bool // leading white space in a field is ignored on reading
+	FieldsPerRecord  int  // 0 means the number of fields in the first record, negative means variable number of fields
+	UseCRLF          bool // writer uses \r\n as the line terminator
+	ReuseRecord      bool // reader returns the same slice on each Read
+}
+
+// dialect used by default for all CSV files and streams, possible to overwrite by service
+var DefaultCsvDialect = CsvDialect{
+	Comma: ',',
+}
+
+// dialect used for files with `.tsv` extension
+var TsvDialect = CsvDialect{
+	Comma: '\t',
+}
+
+/**
+Extension of the file service to read and write CSV files in the custom dialect.
+ */
+type CsvDialectFileService interface {
+
+	/*
+	Gets current CSV dialect of the service, default value is DefaultCsvDialect.
+	 */
+	CsvDialect() CsvDialect
+
+	/*
+	Sets current CSV dialect, that would be used on each CSV file or stream without explicit dialect.
+	 */
+	SetCsvDialect(dialect CsvDialect)
+
+	/*
+	Gets CSV dialect for the file path. Files with `.tsv` extension before the codec extension are tab separated.
+	 */
+	FileDialect(filePath string) CsvDialect
+
+	/*
+	Creates new CSV stream in dialect compressed by codec, nil codec means plain stream.
+	 */
+	NewCsvDialectStream(fw io.Writer, codec Codec, dialect CsvDialect, valueProcessors ...fs.CsvValueProcessor) (fs.CsvWriter, error)
+
+	/*
+	Opens CSV stream in dialect compressed by codec, nil codec means plain stream.
+	 */
+	OpenCsvDialectStream(fr io.Reader, codec Codec, dialect CsvDialect, valueProcessors ...fs.CsvValueProcessor) (fs.CsvStream, error)
+
+	/*
+	Creates new CSV file in dialect. If file path ends with codec extension it would be compressed.
+	 */
+	NewCsvDialectFile(filePath string, dialect CsvDialect, valueProcessors ...fs.CsvValueProcessor) (fs.CsvWriter, error)
+
+	/*
+	Opens CSV file in dialect. Compressed files are detected by codec detection mode.
+	 */
+	OpenCsvDialectFile(filePath string, dialect CsvDialect, valueProcessors ...fs.CsvValueProcessor) (fs.CsvReader, error)
+
+	/*
+	Splits one single CSV in dialect in to parts of the same dialect.
+	 */
+	SplitCsvDialectFile(ctx context.Context, inputFilePath string, dialect CsvDialect, limit int, partFn func (int) string) ([]string, error)
+
+	/*
+	Joins CSV files in dialect in to one of the same dialect.
+	 */
+	JoinCsvDialectFiles(ctx context.Context, outputFilePath string, dialect CsvDialect, parts []string) error
+}
+
+func (t *fileServiceImpl) CsvDialect() CsvDialect {
+	return t.csvDialect
+}
+
+func (t *fileServiceImpl) SetCsvDialect(dialect CsvDialect) {
+	t.csvDialect = dialect
+}
+
+func (t *fileServiceImpl) FileDialect(filePath string) CsvDialect {
+	if codec := t.FileCodec(filePath); codec != nil {
+		filePath = strings.TrimSuffix(filePath, codec.Extension())
+	}
+	dialect := t.csvDialect
+	if strings.HasSuffix(filePath, ".tsv") {
+		dialect.Comma = TsvDialect.Comma
+	}
+	return dialect
+}
+
+/**
+Gets explicit dialect if not nil, otherwise dialect of the file.
+ */
+func (t *fileServiceImpl) csvDialectOf(filePath string, dialect *CsvDialect) CsvDialect {
+	if dialect != nil {
+		return *dialect
+	}
+	return t.FileDialect(filePath)
+}
+
+func (d CsvDialect) newReader(r io.Reader) *csv.Reader {
+	csvr := csv.NewReader(r)
+	if d.Comma != 0 {
+		csvr.Comma = d.Comma
+	}
+	csvr.Comment = d.Comment
+	csvr.LazyQuotes = d.LazyQuotes
+	csvr.TrimLeadingSpace = d.TrimLeadingSpace
+	csvr.FieldsPerRecord = d.FieldsPerRecord
+	csvr.ReuseRecord = d.ReuseRecord
+	return csvr
+}
+
+func (d CsvDialect) newWriter(w io.Writer) *csv.Writer {
+	csvw := csv.NewWriter(w)
+	if d.Comma != 0 {
+		csvw.Comma = d.Comma
+	}
+	csvw.UseCRLF = d.UseCRLF
+	return csvw
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/sprintframework/fsmod"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCsvDialect(t *testing.T) {
+
+	fs := fsmod.FileService()
+
+	fd, err := ioutil.TempFile(os.TempDir(), "csv-test")
+	require.NoError(t, err)
+	filePath := fd.Name()
+	fd.Close()
+	os.Remove(filePath)
+
+	// Test TSV
+	tsvFilePath := filePath + ".tsv"
+	require.Equal(t, '\t', fs.FileDialect(tsvFilePath).Comma)
+	require.Equal(t, '\t', fs.FileDialect(tsvFilePath + ".gz").Comma)
+	require.Equal(t, ',', fs.FileDialect(filePath + ".csv").Comma)
+
+	writeCsvWithHeader(t, tsvFilePath)
+	content, err := ioutil.ReadFile(tsvFilePath)
+	require.NoError(t, err)
+	require.Equal(t, "name\tvalue\none\t1\n", string(content))
+	readCsvWithHeader(t, tsvFilePath)
+	os.Remove(tsvFilePath)
+
+	// Test European export with comments and ragged rows
+	dialect := fsmod.CsvDialect{
+		Comma: ';',
+		Comment: '#',
+		FieldsPerRecord: -1,
+		UseCRLF: true,
+	}
+
+	var buf bytes.Buffer
+	w, err := fs.NewCsvDialectStream(&buf, nil, dialect)
+	require.NoError(t, err)
+	require.NoError(t, w.Write("name", "value"))
+	require.NoError(t, w.Write("one", "1,5", "extra"))
+	require.NoError(t, w.Close())
+	require.Equal(t, "name;value\r\none;1,5;extra\r\n", buf.String())
+
+	europeanFilePath := filePath + ".csv"
+	err = ioutil.WriteFile(europeanFilePath, []byte("# exported\nname;value\none;1,5;extra\n"), 0644)
+	require.NoError(t, err)
+
+	reader, err := fs.OpenCsvDialectFile(europeanFilePath, dialect)
+	require.NoError(t, err)
+
+	file, err := reader.ReadHeader()
+	require.NoError(t, err)
+	require.Equal(t, "name,value", strings.Join(file.Header(), ","))
+
+	record, err := file.Next()
+	require.NoError(t, err)
+	require.Equal(t, "1,5", record.Field("value", ""))
+	require.Equal(t, 3, len(record.Record()))
+
+	_, err = file.Next()
+	require.Equal(t, io.EOF, err)
+	require.NoError(t, reader.Close())
+
+	os.Remove(europeanFilePath)
+}
+
+func TestCsvDialectSplit(t *testing.T) {
+
+	fs := fsmod.FileService()
+
+	fd, err := ioutil.TempFile(os.TempDir(), "csv-test")
+	require.NoError(t, err)
+	filePath := fd.Name()
+	fd.Close()
+	os.Remove(filePath)
+
+	dialect := fsmod.CsvDialect{
+		Comma: ';',
+		ReuseRecord: true,
+	}
+
+	csvfilePath := filePath + ".csv"
+
+	csv, err := fs.NewCsvDialectFile(csvfilePath, dialect)
+	require.NoError(t, err)
+
+	err = csv.Write("name", "count")
+	require.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		err = csv.Write(fmt.Sprintf("name%d", i), strconv.Itoa(i))
+		require.NoError(t, err)
+	}
+
+	err = csv.Close()
+	require.NoError(t, err)
+
+	parts, err := fs.SplitCsvDialectFile(context.Background(), csvfilePath, dialect, 10, func(i int) string {
+		return fmt.Sprintf("%s_part%d.csv", filePath, i)
+	})
+	require.NoError(t, err)
+	require.Equal(t, 10, len(parts))
+
+	part, err := ioutil.ReadFile(parts[9])
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(part), "name;count\nname90;90\n"))
+
+	all, err := ioutil.ReadFile(csvfilePath)
+	require.NoError(t, err)
+
+	err = fs.JoinCsvDialectFiles(context.Background(), csvfilePath, dialect, parts)
+	require.NoError(t, err)
+
+	joined, err := ioutil.ReadFile(csvfilePath)
+	require.NoError(t, err)
+
+	require.Equal(t, all, joined)
+
+	os.Remove(csvfilePath)
+	for _, part := range parts {
+		os.Remove(part)
+	}
+}
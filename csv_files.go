@@ -7,44 +7,74 @@ package fsmod
 
 import (
 	"bufio"
-	"compress/gzip"
+	"context"
 	"encoding/csv"
 	"github.com/sprintframework/fs"
 	"github.com/pkg/errors"
 	"io"
 	"os"
-	"strings"
 )
 
 type csvStreamWriter struct {
 	fw   io.Writer
-	gzw   *gzip.Writer
+	cw    io.WriteCloser
 	csvw  *csv.Writer
 	valueProcessors []fs.CsvValueProcessor
 }
 
 func (t *fileServiceImpl) NewCsvStream(fw io.Writer, withGzip bool, valueProcessors ...fs.CsvValueProcessor) fs.CsvWriter {
+	w, err := t.NewCsvCodecStream(fw, withGzipCodec(withGzip), valueProcessors...)
+	if err != nil {
+		// signature of the fs interface has no error, it is returned by the first call of the writer
+		return csvFailedStream{ err: err }
+	}
+	return w
+}
+
+/**
+Writer of the stream that could not be created.
+ */
+type csvFailedStream struct {
+	err error
+}
+
+func (w csvFailedStream) Write(values ...string) error {
+	return w.err
+}
+
+func (w csvFailedStream) Close() error {
+	return w.err
+}
 
+func (t *fileServiceImpl) NewCsvCodecStream(fw io.Writer, codec Codec, valueProcessors ...fs.CsvValueProcessor) (fs.CsvWriter, error) {
+	return t.NewCsvDialectStream(fw, codec, t.csvDialect, valueProcessors...)
+}
+
+func (t *fileServiceImpl) NewCsvDialectStream(fw io.Writer, codec Codec, dialect CsvDialect, valueProcessors ...fs.CsvValueProcessor) (fs.CsvWriter, error) {
+
+	var err error
 	w := &csvStreamWriter{
 		fw:              fw,
 		valueProcessors: valueProcessors,
 	}
 
-	if withGzip {
-		w.gzw = gzip.NewWriter(w.fw)
-		w.csvw = csv.NewWriter(w.gzw)
+	if codec != nil {
+		w.cw, err = codec.NewWriter(w.fw)
+		if err != nil {
+			return nil, errors.Errorf("codec '%s' write error, %v", codec.Extension(), err)
+		}
+		w.csvw = dialect.newWriter(w.cw)
 	} else {
-		w.csvw = csv.NewWriter(w.fw)
+		w.csvw = dialect.newWriter(w.fw)
 	}
 
-	return w
+	return w, nil
 }
 
 func (w *csvStreamWriter) Close() (err error) {
 	w.csvw.Flush()
-	if w.gzw != nil {
-		w.gzw.Flush()
-		err = w.gzw.Close()
+	if w.cw != nil {
+		err = w.cw.Close()
 	}
 	return err
 }
@@ -58,31 +88,65 @@ func (w *csvStreamWriter) Write(values ...string) error {
 }
 
 type csvFileWriter struct {
-	fd   *os.File
+	fsys FileSystem
+	fd   WritableFile
 	fw   *bufio.Writer
-	gzw   *gzip.Writer
+	cw    io.WriteCloser
 	csvw  *csv.Writer
 	valueProcessors []fs.CsvValueProcessor
+	atomicPath string
 }
 
 func (t *fileServiceImpl) NewCsvFile(filePath string, valueProcessors ...fs.CsvValueProcessor) (fs.CsvWriter, error) {
+	w, err := t.newCsvFile(filePath, false, t.FileDialect(filePath), valueProcessors)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (t *fileServiceImpl) NewAtomicCsvFile(filePath string, valueProcessors ...fs.CsvValueProcessor) (AtomicCsvWriter, error) {
+	w, err := t.newCsvFile(filePath, true, t.FileDialect(filePath), valueProcessors)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (t *fileServiceImpl) NewCsvDialectFile(filePath string, dialect CsvDialect, valueProcessors ...fs.CsvValueProcessor) (fs.CsvWriter, error) {
+	w, err := t.newCsvFile(filePath, false, dialect, valueProcessors)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (t *fileServiceImpl) newCsvFile(filePath string, atomic bool, dialect CsvDialect, valueProcessors []fs.CsvValueProcessor) (*csvFileWriter, error) {
 
 	var err error
 	w := new(csvFileWriter)
+	w.fsys = t.fsys
 	w.valueProcessors = valueProcessors
 
-	w.fd, err = os.Create(filePath)
+	w.fd, err = t.createFile(filePath, atomic)
 	if err != nil {
-		return nil, errors.Errorf("file create error '%s', %v", filePath, err)
+		return nil, err
+	}
+	if atomic {
+		w.atomicPath = filePath
 	}
 
 	w.fw = bufio.NewWriterSize(w.fd, t.bufferSize)
 
-	if strings.HasSuffix(filePath, ".gz") {
-		w.gzw = gzip.NewWriter(w.fw)
-		w.csvw = csv.NewWriter(w.gzw)
+	if codec := t.FileCodec(filePath); codec != nil {
+		w.cw, err = codec.NewWriter(w.fw)
+		if err != nil {
+			abortFile(w.fsys, w.fd)
+			return nil, errors.Errorf("codec '%s' write error in '%s', %v", codec.Extension(), filePath, err)
+		}
+		w.csvw = dialect.newWriter(w.cw)
 	} else {
-		w.csvw = csv.NewWriter(w.fw)
+		w.csvw = dialect.newWriter(w.fw)
 	}
 
 	return w, nil
@@ -90,12 +154,23 @@ func (t *fileServiceImpl) NewCsvFile(filePath string, valueProcessors ...fs.CsvV
 
 func (w *csvFileWriter) Close() error {
 	w.csvw.Flush()
-	if w.gzw != nil {
-		w.gzw.Flush()
-		w.gzw.Close()
+	err := w.csvw.Error()
+	if w.cw != nil {
+		if closeErr := w.cw.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if flushErr := w.fw.Flush(); err == nil {
+		err = flushErr
+	}
+	return closeFile(w.fsys, w.fd, w.atomicPath, err)
+}
+
+func (w *csvFileWriter) Abort() error {
+	if w.cw != nil {
+		w.cw.Close()
 	}
-	w.fw.Flush()
-	return w.fd.Close()
+	return abortFile(w.fsys, w.fd)
 }
 
 func (w *csvFileWriter) Write(values ...string) error {
@@ -119,12 +194,20 @@ func zipValues(processors []fs.CsvValueProcessor, list []string) []string {
 
 type csvStreamReader struct {
 	fr   io.Reader
-	gzr   *gzip.Reader
+	cr    io.ReadCloser
 	csvr  *csv.Reader
 	valueProcessors []fs.CsvValueProcessor
 }
 
 func (t *fileServiceImpl) OpenCsvStream(fr io.Reader, withGzip bool, valueProcessors ...fs.CsvValueProcessor) (fs.CsvStream, error) {
+	return t.OpenCsvCodecStream(fr, withGzipCodec(withGzip), valueProcessors...)
+}
+
+func (t *fileServiceImpl) OpenCsvCodecStream(fr io.Reader, codec Codec, valueProcessors ...fs.CsvValueProcessor) (fs.CsvStream, error) {
+	return t.OpenCsvDialectStream(fr, codec, t.csvDialect, valueProcessors...)
+}
+
+func (t *fileServiceImpl) OpenCsvDialectStream(fr io.Reader, codec Codec, dialect CsvDialect, valueProcessors ...fs.CsvValueProcessor) (fs.CsvStream, error) {
 
 	var err error
 	r := &csvStreamReader{
@@ -132,14 +215,14 @@ func (t *fileServiceImpl) OpenCsvStream(fr io.Reader, withGzip bool, valueProces
 		valueProcessors: valueProcessors,
 	}
 
-	if withGzip {
-		r.gzr, err = gzip.NewReader(r.fr)
+	if codec != nil {
+		r.cr, err = codec.NewReader(r.fr)
 		if err != nil {
-			return nil, errors.Errorf("gzip read error, %v", err)
+			return nil, errors.Errorf("codec '%s' read error, %v", codec.Extension(), err)
 		}
-		r.csvr = csv.NewReader(r.gzr)
+		r.csvr = dialect.newReader(r.cr)
 	} else {
-		r.csvr = csv.NewReader(r.fr)
+		r.csvr = dialect.newReader(r.fr)
 	}
 
 	return r, nil
@@ -147,8 +230,8 @@ func (t *fileServiceImpl) OpenCsvStream(fr io.Reader, withGzip bool, valueProces
 }
 
 func (r *csvStreamReader) Close() (err error) {
-	if r.gzr != nil {
-		err = r.gzr.Close()
+	if r.cr != nil {
+		err = r.cr.Close()
 	}
 	return err
 }
@@ -165,24 +248,32 @@ func (r *csvStreamReader) Read() ([]string, error) {
 }
 
 type csvFileReader struct {
-	fd   *os.File
+	fd   io.ReadCloser
 	fr   *bufio.Reader
-	gzr   *gzip.Reader
+	cr    io.ReadCloser
 	csvr  *csv.Reader
 	valueProcessors []fs.CsvValueProcessor
 }
 
 func (t *fileServiceImpl) OpenCsvFile(filePath string, valueProcessors ...fs.CsvValueProcessor) (fs.CsvReader, error) {
+	return t.OpenCsvDialectFile(filePath, t.FileDialect(filePath), valueProcessors...)
+}
 
-	fd, err := os.Open(filePath)
+func (t *fileServiceImpl) OpenCsvDialectFile(filePath string, dialect CsvDialect, valueProcessors ...fs.CsvValueProcessor) (fs.CsvReader, error) {
+
+	fd, err := t.fsys.Open(filePath)
 	if err != nil {
 		return nil, errors.Errorf("file open error '%s', %v", filePath, err)
 	}
 
-	return t.CsvFileReader(fd, valueProcessors...)
+	return t.newCsvFileReader(filePath, fd, dialect, valueProcessors)
 }
 
 func (t *fileServiceImpl) CsvFileReader(fd *os.File, valueProcessors ...fs.CsvValueProcessor) (fs.CsvReader, error) {
+	return t.newCsvFileReader(fd.Name(), fd, t.FileDialect(fd.Name()), valueProcessors)
+}
+
+func (t *fileServiceImpl) newCsvFileReader(filePath string, fd io.ReadCloser, dialect CsvDialect, valueProcessors []fs.CsvValueProcessor) (fs.CsvReader, error) {
 
 	var err error
 	r := &csvFileReader{
@@ -192,14 +283,14 @@ func (t *fileServiceImpl) CsvFileReader(fd *os.File, valueProcessors ...fs.CsvVa
 
 	r.fr = bufio.NewReaderSize(r.fd, t.bufferSize)
 
-	if strings.HasSuffix(fd.Name(), ".gz") {
-		r.gzr, err = gzip.NewReader(r.fr)
+	if codec := t.detectCodec(filePath, r.fr); codec != nil {
+		r.cr, err = codec.NewReader(r.fr)
 		if err != nil {
-			return nil, errors.Errorf("gzip read error in '%s', %v", fd.Name(), err)
+			return nil, errors.Errorf("codec '%s' read error in '%s', %v", codec.Extension(), filePath, err)
 		}
-		r.csvr = csv.NewReader(r.gzr)
+		r.csvr = dialect.newReader(r.cr)
 	} else {
-		r.csvr = csv.NewReader(r.fr)
+		r.csvr = dialect.newReader(r.fr)
 	}
 
 	return r, nil
@@ -207,8 +298,8 @@ func (t *fileServiceImpl) CsvFileReader(fd *os.File, valueProcessors ...fs.CsvVa
 }
 
 func (r *csvFileReader) Close() error {
-	if r.gzr != nil {
-		r.gzr.Close()
+	if r.cr != nil {
+		r.cr.Close()
 	}
 	return r.fd.Close()
 }
@@ -218,6 +309,8 @@ func (r *csvFileReader) ReadHeader() (fs.CsvFile, error) {
 	if err != nil {
 		return nil, err
 	}
+	// record could be reused by reader
+	header = append([]string(nil), header...)
 	return newCsvFile(header, r), nil
 }
 
@@ -354,8 +447,27 @@ func (r *csvSchemaRecord) Fields() map[string]string {
 }
 
 func (t *fileServiceImpl) SplitCsvFile(inputFilePath string, limit int, partFn func (int) string) ([]string, error) {
+	return splitParts(t.splitCsvFile(context.Background(), inputFilePath, nil, limit, partFn))
+}
+
+func (t *fileServiceImpl) SplitCsvFileContext(ctx context.Context, inputFilePath string, limit int, partFn func (int) string) ([]string, error) {
+	return splitParts(t.splitCsvFile(ctx, inputFilePath, nil, limit, partFn))
+}
+
+func (t *fileServiceImpl) SplitCsvDialectFile(ctx context.Context, inputFilePath string, dialect CsvDialect, limit int, partFn func (int) string) ([]string, error) {
+	return splitParts(t.splitCsvFile(ctx, inputFilePath, &dialect, limit, partFn))
+}
+
+/**
+Splits CSV file, nil dialect means that each file has dialect by extension.
+ */
+func (t *fileServiceImpl) splitCsvFile(ctx context.Context, inputFilePath string, dialect *CsvDialect, limit int, partFn func (int) string) (*splitResult, error) {
 
-	reader, err := t.OpenCsvFile(inputFilePath)
+	if t.parallelism > 1 {
+		return t.parallelSplitCsvFile(ctx, inputFilePath, dialect, limit, partFn)
+	}
+
+	reader, err := t.OpenCsvDialectFile(inputFilePath, t.csvDialectOf(inputFilePath, dialect))
 	if err != nil {
 		return nil, err
 	}
@@ -365,25 +477,36 @@ func (t *fileServiceImpl) SplitCsvFile(inputFilePath string, limit int, partFn f
 	if err != nil {
 		return nil, err
 	}
+	// record could be reused by reader
+	header = append([]string(nil), header...)
 
 	var parts []string
-	var writer fs.CsvWriter
+	var records int64
+	var writer *csvFileWriter
 
 	partNum := 1
 	for cnt := limit; err == nil; cnt++ {
 
-		row, err := reader.Read()
+		if err = ctx.Err(); err != nil {
+			break
+		}
+
+		var row []string
+		row, err = reader.Read()
 		if err != nil {
 			break
 		}
 
 		if cnt == limit {
 			if writer != nil {
-				writer.Close()
+				err = writer.Close()
 				writer = nil
+				if err != nil {
+					break
+				}
 			}
 			partFilePath := partFn(partNum)
-			writer, err = t.NewCsvFile(partFilePath)
+			writer, err = t.newCsvFile(partFilePath, true, t.csvDialectOf(partFilePath, dialect), nil)
 			if err != nil {
 				break
 			}
@@ -397,6 +520,7 @@ func (t *fileServiceImpl) SplitCsvFile(inputFilePath string, limit int, partFn f
 		}
 
 		err = writer.Write(row...)
+		records++
 	}
 
 	if err == io.EOF {
@@ -404,30 +528,53 @@ func (t *fileServiceImpl) SplitCsvFile(inputFilePath string, limit int, partFn f
 	}
 
 	if writer != nil {
-		writer.Close()
+		if err != nil {
+			writer.Abort()
+		} else {
+			err = writer.Close()
+		}
 	}
 
 	if err != nil {
 		for _, part := range parts {
-			os.Remove(part)
+			t.fsys.Remove(part)
 		}
-		parts = nil
+		return nil, err
 	}
 
-	return parts, err
+	return &splitResult{ parts: parts, records: records, header: header }, nil
 }
 
 func (t *fileServiceImpl) JoinCsvFiles(outputFilePath string, parts []string) error {
+	return t.joinCsvFiles(context.Background(), outputFilePath, nil, parts)
+}
+
+func (t *fileServiceImpl) JoinCsvFilesContext(ctx context.Context, outputFilePath string, parts []string) error {
+	return t.joinCsvFiles(ctx, outputFilePath, nil, parts)
+}
+
+func (t *fileServiceImpl) JoinCsvDialectFiles(ctx context.Context, outputFilePath string, dialect CsvDialect, parts []string) error {
+	return t.joinCsvFiles(ctx, outputFilePath, &dialect, parts)
+}
+
+/**
+Joins CSV files, nil dialect means that each file has dialect by extension.
+ */
+func (t *fileServiceImpl) joinCsvFiles(ctx context.Context, outputFilePath string, dialect *CsvDialect, parts []string) error {
 
-	writer, err := t.NewCsvFile(outputFilePath)
+	writer, err := t.NewCsvDialectFile(outputFilePath, t.csvDialectOf(outputFilePath, dialect))
 	if err != nil {
 		return err
 	}
 	defer writer.Close()
 
+	if t.parallelism > 1 {
+		return t.parallelJoinCsvFiles(ctx, writer, outputFilePath, dialect, parts)
+	}
+
 	for i, part := range parts {
 
-		reader, err := t.OpenCsvFile(part)
+		reader, err := t.OpenCsvDialectFile(part, t.csvDialectOf(part, dialect))
 		if err != nil {
 			return errors.Errorf("can not open file '%s', %v", part, err)
 		}
@@ -448,7 +595,13 @@ func (t *fileServiceImpl) JoinCsvFiles(outputFilePath string, parts []string) er
 
 		for {
 
-			row, err := reader.Read()
+			if err = ctx.Err(); err != nil {
+				reader.Close()
+				return err
+			}
+
+			var row []string
+			row, err = reader.Read()
 			if err != nil {
 				break
 			}
@@ -7,6 +7,7 @@ package fsmod_test
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/sprintframework/fsmod"
 	"github.com/stretchr/testify/require"
@@ -211,3 +212,54 @@ func TestCsvSplit(t *testing.T) {
 		os.Remove(part)
 	}
 }
+
+func TestCsvSplitContext(t *testing.T) {
+
+	fs := fsmod.FileService()
+
+	fd, err := ioutil.TempFile(os.TempDir(), "csv-test")
+	require.NoError(t, err)
+	filePath := fd.Name()
+	fd.Close()
+	os.Remove(filePath)
+
+	csvfilePath := filePath + ".csv"
+	defer os.Remove(csvfilePath)
+
+	csv, err := fs.NewCsvFile(csvfilePath)
+	require.NoError(t, err)
+
+	err = csv.Write("name", "count")
+	require.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		err = csv.Write(fmt.Sprintf("name%d", i), strconv.Itoa(i))
+		require.NoError(t, err)
+	}
+
+	err = csv.Close()
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var created []string
+	parts, err := fs.SplitCsvFileContext(ctx, csvfilePath, 10, func(i int) string {
+		if i == 3 {
+			cancel()
+		}
+		part := fmt.Sprintf("%s_part%d.csv", filePath, i)
+		created = append(created, part)
+		return part
+	})
+	require.Equal(t, context.Canceled, err)
+	require.Nil(t, parts)
+
+	for _, part := range created {
+		_, err = os.Stat(part)
+		require.True(t, os.IsNotExist(err))
+	}
+
+	err = fs.JoinCsvFilesContext(ctx, filePath + "_joined.csv", []string{ csvfilePath })
+	require.Equal(t, context.Canceled, err)
+	os.Remove(filePath + "_joined.csv")
+}
@@ -0,0 +1,170 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sprintframework/fs"
+)
+
+/**
+Extension of the file service that writes CSV files with the header, symmetric to fs.CsvFile on the read side.
+ */
+type CsvHeaderFileService interface {
+
+	/*
+	Creates new CSV file and writes the header row, required columns must be present in every row written by name.
+	 */
+	NewCsvHeaderFile(filePath string, header []string, required ...string) (CsvHeaderWriter, error)
+
+	/*
+	Creates new CSV file with the header of the schema created by NewCsvSchema.
+	 */
+	NewCsvSchemaFile(filePath string, schema fs.CsvSchema, required ...string) (CsvHeaderWriter, error)
+}
+
+/**
+CSV writer that places values by column names of the header.
+ */
+type CsvHeaderWriter interface {
+	Aborter
+
+	/*
+	Gets CSV file header.
+	 */
+	Header() []string
+
+	/*
+	Gets index of columns.
+	 */
+	Index() map[string]int
+
+	/*
+	Writes positional values, the number of values must be the same as in the header.
+	 */
+	Write(values ...string) error
+
+	/*
+	Writes values by column names, unknown column is an error and missing optional column is empty.
+	 */
+	WriteMap(values map[string]string) error
+
+	/*
+	Writes fields of the record by column names, the record could have other order of columns.
+	 */
+	WriteRecord(record fs.CsvRecord) error
+
+	/*
+	Closes stream and flashes underline buffers.
+	 */
+	Close() error
+}
+
+/**
+Schema that knows its header.
+ */
+type csvHeaderSchema interface {
+	schemaHeader() []string
+}
+
+func (s *csvSchema) schemaHeader() []string {
+	return s.header
+}
+
+type csvHeaderWriter struct {
+	w        *csvFileWriter
+	header   []string
+	index    map[string]int
+	required []string
+}
+
+func (t *fileServiceImpl) NewCsvHeaderFile(filePath string, header []string, required ...string) (CsvHeaderWriter, error) {
+
+	if len(header) == 0 {
+		return nil, errors.Errorf("empty header of file '%s'", filePath)
+	}
+
+	index := make(map[string]int)
+	for i, name := range header {
+		if _, ok := index[name]; ok {
+			return nil, errors.Errorf("duplicate column '%s' in header of file '%s'", name, filePath)
+		}
+		index[name] = i
+	}
+	for _, name := range required {
+		if _, ok := index[name]; !ok {
+			return nil, errors.Errorf("required column '%s' not found in header %v of file '%s'", name, header, filePath)
+		}
+	}
+
+	w, err := t.newCsvFile(filePath, false, t.FileDialect(filePath), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.Write(header...); err != nil {
+		w.Abort()
+		return nil, errors.Errorf("write header in file '%s', %v", filePath, err)
+	}
+
+	return &csvHeaderWriter{
+		w:        w,
+		header:   append([]string(nil), header...),
+		index:    index,
+		required: required,
+	}, nil
+}
+
+func (t *fileServiceImpl) NewCsvSchemaFile(filePath string, schema fs.CsvSchema, required ...string) (CsvHeaderWriter, error) {
+	s, ok := schema.(csvHeaderSchema)
+	if !ok {
+		return nil, errors.Errorf("schema %T has no header", schema)
+	}
+	return t.NewCsvHeaderFile(filePath, s.schemaHeader(), required...)
+}
+
+func (w *csvHeaderWriter) Header() []string {
+	return w.header
+}
+
+func (w *csvHeaderWriter) Index() map[string]int {
+	return w.index
+}
+
+func (w *csvHeaderWriter) Write(values ...string) error {
+	if len(values) != len(w.header) {
+		return errors.Errorf("expected %d values by header %v, got %d", len(w.header), w.header, len(values))
+	}
+	return w.w.Write(values...)
+}
+
+func (w *csvHeaderWriter) WriteMap(values map[string]string) error {
+	row := make([]string, len(w.header))
+	for name, value := range values {
+		i, ok := w.index[name]
+		if !ok {
+			return errors.Errorf("unknown column '%s', header %v", name, w.header)
+		}
+		row[i] = value
+	}
+	for _, name := range w.required {
+		if _, ok := values[name]; !ok {
+			return errors.Errorf("missing required column '%s'", name)
+		}
+	}
+	return w.w.Write(row...)
+}
+
+func (w *csvHeaderWriter) WriteRecord(record fs.CsvRecord) error {
+	return w.WriteMap(record.Fields())
+}
+
+func (w *csvHeaderWriter) Close() error {
+	return w.w.Close()
+}
+
+func (w *csvHeaderWriter) Abort() error {
+	return w.w.Abort()
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod_test
+
+import (
+	"github.com/sprintframework/fsmod"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestCsvHeaderFile(t *testing.T) {
+
+	fs := fsmod.FileSystemService(fsmod.MemFileSystem())
+
+	writer, err := fs.NewCsvHeaderFile("items.csv", []string{ "id", "name", "price" }, "id")
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{ "id": 0, "name": 1, "price": 2 }, writer.Index())
+
+	require.NoError(t, writer.Write("1", "apple", "2"))
+	require.Error(t, writer.Write("2", "banana"))
+	require.NoError(t, writer.WriteMap(map[string]string{ "price": "1", "id": "2" }))
+	require.Error(t, writer.WriteMap(map[string]string{ "id": "3", "color": "red" }))
+	require.Error(t, writer.WriteMap(map[string]string{ "name": "plum" }))
+
+	// record of other schema is placed by names
+	schema := fs.NewCsvSchema([]string{ "name", "id" })
+	require.NoError(t, writer.WriteRecord(schema.Record([]string{ "kiwi", "4" })))
+	require.NoError(t, writer.Close())
+
+	require.Equal(t, [][]string{ { "id", "name", "price" }, { "1", "apple", "2" }, { "2", "", "1" }, { "4", "kiwi", "" } },
+		readCsvRows(t, fs, "items.csv"))
+
+	_, err = fs.NewCsvHeaderFile("broken.csv", []string{ "id", "id" })
+	require.Error(t, err)
+	_, err = fs.NewCsvHeaderFile("broken.csv", []string{ "id" }, "name")
+	require.Error(t, err)
+}
+
+func TestCsvSchemaFile(t *testing.T) {
+
+	fs := fsmod.FileSystemService(fsmod.MemFileSystem())
+
+	schema := fs.NewCsvSchema([]string{ "word", "count" })
+	writer, err := fs.NewCsvSchemaFile("words.tsv", schema)
+	require.NoError(t, err)
+	require.Equal(t, []string{ "word", "count" }, writer.Header())
+	require.NoError(t, writer.WriteRecord(schema.Record([]string{ "apple", "1" })))
+	require.NoError(t, writer.Close())
+
+	require.Equal(t, [][]string{ { "word", "count" }, { "apple", "1" } }, readCsvRows(t, fs, "words.tsv"))
+}
@@ -0,0 +1,291 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod
+
+import (
+	"encoding"
+	"github.com/pkg/errors"
+	"github.com/sprintframework/fs"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default layout of time.Time fields without `layout` tag
+var DefaultTimeLayout = time.RFC3339
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+var timeType = reflect.TypeOf(time.Time{})
+
+// cache of struct fields by type
+var csvStructCache sync.Map
+
+type csvStructField struct {
+	column string
+	index  []int
+	layout string
+}
+
+/**
+Record that has index of columns built from the header.
+ */
+type csvIndexed interface {
+	columnIndex() map[string]int
+}
+
+func (r *csvRecord) columnIndex() map[string]int {
+	return r.file.index
+}
+
+func (r *csvSchemaRecord) columnIndex() map[string]int {
+	return r.schema.index
+}
+
+/**
+Decodes CSV record in to the struct pointer by `csv:"name"` tags, fields without tag use field name, `csv:"-"` is skipped.
+Values from EmptyValues table set pointers to nil and other fields to zero value. Time fields use `layout:"..."` tag.
+ */
+func DecodeCsvRecord(record fs.CsvRecord, dst interface{}) error {
+
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return errors.Errorf("decode destination must be a non-nil struct pointer, got %T", dst)
+	}
+	v = v.Elem()
+
+	values := record.Record()
+	var index map[string]int
+	if indexed, ok := record.(csvIndexed); ok {
+		index = indexed.columnIndex()
+	} else {
+		index = make(map[string]int)
+		values = values[:0:0]
+		for name, value := range record.Fields() {
+			index[name] = len(values)
+			values = append(values, value)
+		}
+	}
+
+	for _, field := range csvStructFields(v.Type()) {
+
+		idx, ok := index[field.column]
+		if !ok || idx < 0 || idx >= len(values) {
+			continue
+		}
+		value := values[idx]
+
+		if err := decodeCsvValue(v.FieldByIndex(field.index), value, field.layout); err != nil {
+			return errors.Errorf("decode column '%s' error, %v", field.column, err)
+		}
+	}
+
+	return nil
+}
+
+/**
+Encodes struct or struct pointer in to the record placing values by header columns. Columns without field are empty.
+ */
+func EncodeCsvRecord(header []string, src interface{}) ([]string, error) {
+
+	v := reflect.Indirect(reflect.ValueOf(src))
+	if v.Kind() != reflect.Struct {
+		return nil, errors.Errorf("encode source must be a struct, got %T", src)
+	}
+
+	fields := make(map[string]csvStructField)
+	for _, field := range csvStructFields(v.Type()) {
+		fields[field.column] = field
+	}
+
+	record := make([]string, len(header))
+	for i, column := range header {
+		if field, ok := fields[column]; ok {
+			value, err := encodeCsvValue(v.FieldByIndex(field.index), field.layout)
+			if err != nil {
+				return nil, errors.Errorf("encode column '%s' error, %v", column, err)
+			}
+			record[i] = value
+		}
+	}
+
+	return record, nil
+}
+
+/**
+Gets header of the struct or struct pointer in the order of fields.
+ */
+func CsvStructHeader(src interface{}) ([]string, error) {
+
+	t := reflect.TypeOf(src)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, errors.Errorf("header source must be a struct, got %T", src)
+	}
+
+	var header []string
+	for _, field := range csvStructFields(t) {
+		header = append(header, field.column)
+	}
+	return header, nil
+}
+
+func csvStructFields(t reflect.Type) []csvStructField {
+
+	if cached, ok := csvStructCache.Load(t); ok {
+		return cached.([]csvStructField)
+	}
+
+	var list []csvStructField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			// unexported
+			continue
+		}
+		column := f.Name
+		if tag, ok := f.Tag.Lookup("csv"); ok {
+			if tag == "-" {
+				continue
+			}
+			if tag != "" {
+				column = tag
+			}
+		}
+		list = append(list, csvStructField{
+			column: column,
+			index:  f.Index,
+			layout: f.Tag.Get("layout"),
+		})
+	}
+
+	csvStructCache.Store(t, list)
+	return list
+}
+
+func decodeCsvValue(v reflect.Value, value, layout string) error {
+
+	if v.Kind() == reflect.Ptr {
+		if EmptyValues[value] {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		ptr := reflect.New(v.Type().Elem())
+		if err := decodeCsvValue(ptr.Elem(), value, layout); err != nil {
+			return err
+		}
+		v.Set(ptr)
+		return nil
+	}
+
+	if v.Type() == timeType {
+		if EmptyValues[value] {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		if layout == "" {
+			layout = DefaultTimeLayout
+		}
+		tm, err := time.Parse(layout, value)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(tm))
+		return nil
+	}
+
+	if v.CanAddr() && v.Addr().Type().Implements(textUnmarshalerType) {
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(value))
+	}
+
+	if v.Kind() == reflect.String {
+		v.SetString(value)
+		return nil
+	}
+
+	if EmptyValues[value] {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+
+	value = strings.TrimSpace(value)
+
+	switch v.Kind() {
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return errors.Errorf("unsupported field type %s", v.Type())
+	}
+
+	return nil
+}
+
+func encodeCsvValue(v reflect.Value, layout string) (string, error) {
+
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return "", nil
+		}
+		return encodeCsvValue(v.Elem(), layout)
+	}
+
+	if v.Type() == timeType {
+		tm := v.Interface().(time.Time)
+		if tm.IsZero() {
+			return "", nil
+		}
+		if layout == "" {
+			layout = DefaultTimeLayout
+		}
+		return tm.Format(layout), nil
+	}
+
+	if v.Type().Implements(textMarshalerType) {
+		text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		return string(text), err
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, v.Type().Bits()), nil
+	}
+
+	return "", errors.Errorf("unsupported field type %s", v.Type())
+}
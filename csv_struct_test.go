@@ -0,0 +1,67 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod_test
+
+import (
+	"github.com/sprintframework/fsmod"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+type csvItem struct {
+	Name     string     `csv:"name"`
+	Count    int        `csv:"count"`
+	Price    float64    `csv:"price"`
+	Active   bool       `csv:"active"`
+	Created  time.Time  `csv:"created" layout:"2006-01-02"`
+	Discount *float64   `csv:"discount"`
+	Comment  string     `csv:"-"`
+	internal string
+}
+
+func TestCsvStruct(t *testing.T) {
+
+	fs := fsmod.FileService()
+
+	header, err := fsmod.CsvStructHeader(&csvItem{})
+	require.NoError(t, err)
+	require.Equal(t, "name,count,price,active,created,discount", strings.Join(header, ","))
+
+	schema := fs.NewCsvSchema([]string{ "created", "name", "price", "count", "discount", "active", "unknown" })
+
+	var item csvItem
+	err = fsmod.DecodeCsvRecord(schema.Record([]string{ "2023-03-01", "one", "1.5", "10", "N/A", "true", "x" }), &item)
+	require.NoError(t, err)
+
+	require.Equal(t, "one", item.Name)
+	require.Equal(t, 10, item.Count)
+	require.Equal(t, 1.5, item.Price)
+	require.True(t, item.Active)
+	require.Equal(t, time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC), item.Created)
+	require.Nil(t, item.Discount)
+
+	err = fsmod.DecodeCsvRecord(schema.Record([]string{ "2023-03-01", "one", "1.5", "10", "0.25", "true" }), &item)
+	require.NoError(t, err)
+	require.NotNil(t, item.Discount)
+	require.Equal(t, 0.25, *item.Discount)
+
+	err = fsmod.DecodeCsvRecord(schema.Record([]string{ "2023-03-01", "one", "1.5", "ten" }), &item)
+	require.Error(t, err)
+
+	err = fsmod.DecodeCsvRecord(schema.Record(nil), item)
+	require.Error(t, err)
+
+	record, err := fsmod.EncodeCsvRecord([]string{ "name", "created", "discount", "count", "price", "active", "unknown" }, item)
+	require.NoError(t, err)
+	require.Equal(t, "one,2023-03-01,0.25,10,1.5,true,", strings.Join(record, ","))
+
+	item.Discount = nil
+	record, err = fsmod.EncodeCsvRecord(header, item)
+	require.NoError(t, err)
+	require.Equal(t, "one,10,1.5,true,2023-03-01,", strings.Join(record, ","))
+}
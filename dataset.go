@@ -0,0 +1,442 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/sprintframework/fs"
+	"google.golang.org/protobuf/proto"
+	"io"
+	iofs "io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+/**
+Extension of the file service that reads a directory or a glob of part files as one logical file.
+Parts are ordered by name with numbers compared by value, so part2 goes before part10.
+Hidden files, like temp files of atomic writers, and sidecar files of this module are skipped.
+ */
+type DatasetFileService interface {
+
+	/*
+	Gets ordered list of part files of the dataset. Pattern is a directory, a file or a glob in the last path element.
+	 */
+	DatasetParts(pattern string) ([]string, error)
+
+	/*
+	Opens CSV parts as one file. Header of the first part is the first row, headers of other parts must be equal to it and are skipped.
+	 */
+	OpenCsvDataset(pattern string, valueProcessors ...fs.CsvValueProcessor) (CsvDataset, error)
+
+	/*
+	Opens JSON parts as one file.
+	 */
+	OpenJsonDataset(pattern string) (JsonDataset, error)
+
+	/*
+	Opens protofile parts as one file.
+	 */
+	OpenProtoDataset(pattern string) (ProtoDataset, error)
+}
+
+/**
+Position of the last read record in the dataset.
+ */
+type Dataset interface {
+
+	/*
+	Gets ordered list of part files.
+	 */
+	Parts() []string
+
+	/*
+	Gets index of the part of the last read record.
+	 */
+	Part() int
+
+	/*
+	Gets number of the last read record in its part starting from 0, CSV header is not counted.
+	 */
+	Record() int64
+}
+
+type CsvDataset interface {
+	fs.CsvReader
+	Dataset
+}
+
+type JsonDataset interface {
+	fs.JsonReader
+	Dataset
+}
+
+type ProtoDataset interface {
+	fs.ProtoReader
+	Dataset
+}
+
+// sidecar extensions of part files skipped in directory datasets
+var DatasetSkipExtensions = []string{ ProtoIndexExtension, SplitManifestExtension }
+
+func (t *fileServiceImpl) DatasetParts(pattern string) ([]string, error) {
+
+	dir, name := splitFilePath(pattern)
+	var matches []string
+
+	if strings.ContainsAny(name, "*?[") {
+		entries, err := iofs.ReadDir(t.fsys, dir)
+		if err != nil {
+			return nil, errors.Errorf("dataset read dir error '%s', %v", dir, err)
+		}
+		for _, entry := range entries {
+			ok, err := path.Match(name, entry.Name())
+			if err != nil {
+				return nil, errors.Errorf("invalid dataset pattern '%s', %v", pattern, err)
+			}
+			if ok && isDatasetPart(entry) {
+				matches = append(matches, joinFilePath(dir, entry.Name()))
+			}
+		}
+	} else {
+		info, err := iofs.Stat(t.fsys, pattern)
+		if err == nil && !info.IsDir() {
+			return []string{ pattern }, nil
+		}
+		// object storages have no directory objects, so prefix is listed when stat fails
+		entries, dirErr := iofs.ReadDir(t.fsys, pattern)
+		if dirErr != nil {
+			if err == nil {
+				err = dirErr
+			}
+			return nil, errors.Errorf("dataset open error '%s', %v", pattern, err)
+		}
+		for _, entry := range entries {
+			if isDatasetPart(entry) {
+				matches = append(matches, joinFilePath(pattern, entry.Name()))
+			}
+		}
+	}
+
+	if len(matches) == 0 {
+		return nil, errors.Errorf("no dataset parts found by '%s'", pattern)
+	}
+
+	sort.Slice(matches, func(i, j int) bool { return naturalLess(matches[i], matches[j]) })
+	return matches, nil
+}
+
+func isDatasetPart(entry iofs.DirEntry) bool {
+	if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+		return false
+	}
+	for _, ext := range DatasetSkipExtensions {
+		if strings.HasSuffix(entry.Name(), ext) {
+			return false
+		}
+	}
+	return true
+}
+
+func joinFilePath(dir, name string) string {
+	switch {
+	case dir == ".":
+		return name
+	case strings.HasSuffix(dir, "/"):
+		return dir + name
+	default:
+		return dir + "/" + name
+	}
+}
+
+/**
+Compares strings with runs of digits compared by numeric value.
+ */
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		da, db := digitPrefix(a), digitPrefix(b)
+		if da > 0 && db > 0 {
+			na, nb := strings.TrimLeft(a[:da], "0"), strings.TrimLeft(b[:db], "0")
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+			a, b = a[da:], b[db:]
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+func digitPrefix(s string) int {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return i
+}
+
+/**
+Position in the list of parts, the current part is opened by the open function of the concrete dataset.
+ */
+type datasetParts struct {
+	parts    []string
+	part     int
+	nextPart int
+	record   int64
+	opened   bool
+}
+
+func (d *datasetParts) Parts() []string {
+	return d.parts
+}
+
+func (d *datasetParts) Part() int {
+	return d.part
+}
+
+func (d *datasetParts) Record() int64 {
+	return d.record
+}
+
+/**
+Opens the next part if current one is finished, returns EOF after the last part.
+ */
+func (d *datasetParts) next(open func(filePath string) error) error {
+	if d.opened {
+		return nil
+	}
+	if d.nextPart >= len(d.parts) {
+		return io.EOF
+	}
+	d.part = d.nextPart
+	d.nextPart++
+	d.record = -1
+	if err := open(d.parts[d.part]); err != nil {
+		return err
+	}
+	d.opened = true
+	return nil
+}
+
+type csvDataset struct {
+	datasetParts
+	t       *fileServiceImpl
+	reader  fs.CsvReader
+	header  []string
+	headerRead bool // header of the current part
+	valueProcessors []fs.CsvValueProcessor
+}
+
+func (t *fileServiceImpl) OpenCsvDataset(pattern string, valueProcessors ...fs.CsvValueProcessor) (CsvDataset, error) {
+	parts, err := t.DatasetParts(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &csvDataset{
+		datasetParts: datasetParts{ parts: parts, record: -1 },
+		t: t,
+		valueProcessors: valueProcessors,
+	}, nil
+}
+
+func (r *csvDataset) open(filePath string) (err error) {
+	r.reader, err = r.t.OpenCsvFile(filePath, r.valueProcessors...)
+	r.headerRead = false
+	return err
+}
+
+func (r *csvDataset) ReadHeader() (fs.CsvFile, error) {
+	header, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+	return newCsvFile(header, r), nil
+}
+
+func (r *csvDataset) Read() ([]string, error) {
+	for {
+		if err := r.next(r.open); err != nil {
+			return nil, err
+		}
+
+		row, err := r.reader.Read()
+		if err == io.EOF {
+			r.closePart()
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if !r.headerRead {
+			r.headerRead = true
+			if r.header == nil {
+				// record could be reused by reader
+				r.header = append([]string(nil), row...)
+				return row, nil
+			}
+			if !equalStrings(r.header, row) {
+				return nil, errors.Errorf("dataset part '%s' header %v differs from %v", r.parts[r.part], row, r.header)
+			}
+			continue
+		}
+
+		r.record++
+		return row, nil
+	}
+}
+
+func (r *csvDataset) closePart() {
+	r.reader.Close()
+	r.reader = nil
+	r.opened = false
+}
+
+func (r *csvDataset) Close() error {
+	if r.reader != nil {
+		r.closePart()
+	}
+	return nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type jsonDataset struct {
+	datasetParts
+	t      *fileServiceImpl
+	reader fs.JsonReader
+}
+
+func (t *fileServiceImpl) OpenJsonDataset(pattern string) (JsonDataset, error) {
+	parts, err := t.DatasetParts(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonDataset{ datasetParts: datasetParts{ parts: parts, record: -1 }, t: t }, nil
+}
+
+func (r *jsonDataset) open(filePath string) (err error) {
+	r.reader, err = r.t.OpenJsonFile(filePath)
+	return err
+}
+
+func (r *jsonDataset) ReadRaw() (json.RawMessage, error) {
+	for {
+		if err := r.next(r.open); err != nil {
+			return nil, err
+		}
+		raw, err := r.reader.ReadRaw()
+		if err == io.EOF {
+			r.closePart()
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		r.record++
+		return raw, nil
+	}
+}
+
+func (r *jsonDataset) Read(holder interface{}) error {
+	for {
+		if err := r.next(r.open); err != nil {
+			return err
+		}
+		err := r.reader.Read(holder)
+		if err == io.EOF {
+			r.closePart()
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		r.record++
+		return nil
+	}
+}
+
+func (r *jsonDataset) closePart() {
+	r.reader.Close()
+	r.reader = nil
+	r.opened = false
+}
+
+func (r *jsonDataset) Close() error {
+	if r.reader != nil {
+		r.closePart()
+	}
+	return nil
+}
+
+type protoDataset struct {
+	datasetParts
+	t      *fileServiceImpl
+	reader fs.ProtoReader
+}
+
+func (t *fileServiceImpl) OpenProtoDataset(pattern string) (ProtoDataset, error) {
+	parts, err := t.DatasetParts(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &protoDataset{ datasetParts: datasetParts{ parts: parts, record: -1 }, t: t }, nil
+}
+
+func (r *protoDataset) open(filePath string) (err error) {
+	r.reader, err = r.t.OpenProtoFile(filePath)
+	return err
+}
+
+func (r *protoDataset) ReadTo(message proto.Message) error {
+	for {
+		if err := r.next(r.open); err != nil {
+			return err
+		}
+		err := r.reader.ReadTo(message)
+		if err == io.EOF {
+			r.closePart()
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		r.record++
+		return nil
+	}
+}
+
+func (r *protoDataset) closePart() {
+	r.reader.Close()
+	r.reader = nil
+	r.opened = false
+}
+
+func (r *protoDataset) Close() error {
+	if r.reader != nil {
+		r.closePart()
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod_test
+
+import (
+	"fmt"
+	"github.com/sprintframework/fsmod"
+	"github.com/stretchr/testify/require"
+	"io"
+	"strconv"
+	"testing"
+)
+
+func TestCsvDataset(t *testing.T) {
+
+	fs := fsmod.FileSystemService(fsmod.MemFileSystem())
+
+	csv, err := fs.NewCsvFile("table.csv")
+	require.NoError(t, err)
+	require.NoError(t, csv.Write("name", "count"))
+	for i := 0; i < 23; i++ {
+		require.NoError(t, csv.Write(fmt.Sprintf("name%d", i), strconv.Itoa(i)))
+	}
+	require.NoError(t, csv.Close())
+
+	parts, err := fs.SplitCsvFile("table.csv", 2, func(i int) string {
+		return fmt.Sprintf("parts/part%d.csv", i)
+	})
+	require.NoError(t, err)
+	require.Equal(t, 12, len(parts))
+
+	// part10 goes after part9
+	list, err := fs.DatasetParts("parts")
+	require.NoError(t, err)
+	require.Equal(t, parts, list)
+
+	dataset, err := fs.OpenCsvDataset("parts/*.csv")
+	require.NoError(t, err)
+
+	file, err := dataset.ReadHeader()
+	require.NoError(t, err)
+	require.Equal(t, []string{ "name", "count" }, file.Header())
+
+	for i := 0; i < 23; i++ {
+		record, err := file.Next()
+		require.NoError(t, err)
+		require.Equal(t, strconv.Itoa(i), record.Field("count", ""))
+		require.Equal(t, i / 2, dataset.Part())
+		require.Equal(t, int64(i % 2), dataset.Record())
+	}
+	_, err = file.Next()
+	require.Equal(t, io.EOF, err)
+	require.NoError(t, dataset.Close())
+
+	// header of every part must be the same
+	other, err := fs.NewCsvFile("parts/part13.csv")
+	require.NoError(t, err)
+	require.NoError(t, other.Write("name", "total"))
+	require.NoError(t, other.Close())
+
+	dataset, err = fs.OpenCsvDataset("parts")
+	require.NoError(t, err)
+	defer dataset.Close()
+	for err == nil {
+		_, err = dataset.Read()
+	}
+	require.NotEqual(t, io.EOF, err)
+	require.Equal(t, 12, dataset.Part())
+
+	_, err = fs.OpenCsvDataset("missing/*.csv")
+	require.Error(t, err)
+}
+
+func TestProtoDataset(t *testing.T) {
+
+	fs := fsmod.FileSystemService(fsmod.MemFileSystem())
+	fs.SetProtoIndexInterval(2)
+
+	for part := 0; part < 3; part++ {
+		writer, err := fs.NewProtoFile(fmt.Sprintf("data/part-%d.pb", part))
+		require.NoError(t, err)
+		for i := 0; i < part; i++ {
+			_, err = writer.Write(&Domain{ Domain: fmt.Sprintf("obj%d.%d", part, i) })
+			require.NoError(t, err)
+		}
+		require.NoError(t, writer.Close())
+	}
+
+	dataset, err := fs.OpenProtoDataset("data")
+	require.NoError(t, err)
+	defer dataset.Close()
+	require.Equal(t, []string{ "data/part-0.pb", "data/part-1.pb", "data/part-2.pb" }, dataset.Parts())
+
+	var names []string
+	for msg, err := range fsmod.ProtoRecords[*Domain](dataset, false) {
+		require.NoError(t, err)
+		names = append(names, fmt.Sprintf("%s@%d:%d", msg.Domain, dataset.Part(), dataset.Record()))
+	}
+	require.Equal(t, []string{ "obj1.0@1:0", "obj2.0@2:0", "obj2.1@2:1" }, names)
+}
+
+func TestJsonDataset(t *testing.T) {
+
+	fs := fsmod.FileSystemService(fsmod.MemFileSystem())
+
+	for part := 1; part <= 2; part++ {
+		writer, err := fs.NewJsonFile(fmt.Sprintf("part%d.json.gz", part))
+		require.NoError(t, err)
+		require.NoError(t, writer.Write(map[string]int{ "part": part }))
+		require.NoError(t, writer.Close())
+	}
+
+	dataset, err := fs.OpenJsonDataset("part*.json.gz")
+	require.NoError(t, err)
+	defer dataset.Close()
+
+	for part := 1; part <= 2; part++ {
+		holder := make(map[string]int)
+		require.NoError(t, dataset.Read(&holder))
+		require.Equal(t, part, holder["part"])
+		require.Equal(t, part - 1, dataset.Part())
+	}
+	_, err = dataset.ReadRaw()
+	require.Equal(t, io.EOF, err)
+}
@@ -0,0 +1,566 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"sort"
+	"strconv"
+)
+
+/**
+Occurrence of the duplicate record that stays in the output.
+ */
+type DedupKeep int
+
+const (
+	DedupKeepFirst DedupKeep = iota
+	DedupKeepLast
+)
+
+// number of temp partitions of the key index when it does not fit in memory
+var DedupPartitions = 64
+
+// estimated memory of one key in the in-memory index
+const dedupEntrySize = 96
+
+type dedupDigest [sha256.Size]byte
+
+/**
+Extension of the file service that removes duplicate records by the whole record or by the key.
+
+Input is read twice: the first pass builds index of SHA-256 digests of keys and the second pass writes kept records
+in the input order. If the index exceeds the sort memory budget, digests are hash partitioned in to temp files
+in the sort temp directory and deduplicated per partition. Output file is written atomically.
+ */
+type DedupFileService interface {
+
+	/*
+	Removes duplicate rows by columns or by the whole row if columns are empty, header stays the first row.
+	 */
+	DedupCsvFile(ctx context.Context, inputFilePath, outputFilePath string, keep DedupKeep, columns ...string) error
+
+	/*
+	Removes duplicate records by values of JSON paths or by the whole encoded record if paths are empty.
+	 */
+	DedupJsonFile(ctx context.Context, inputFilePath, outputFilePath string, keep DedupKeep, jsonPaths ...string) error
+
+	/*
+	Removes duplicate messages by fields or by the whole message if fields are empty, holder could be nil for files with descriptor header.
+	 */
+	DedupProtoFile(ctx context.Context, inputFilePath, outputFilePath string, holder proto.Message, keep DedupKeep, fields ...string) error
+}
+
+/**
+Digest of the list of values, each value is prefixed by its length.
+ */
+func digestValues(values ...[]byte) dedupDigest {
+	h := sha256.New()
+	var buf [binary.MaxVarintLen64]byte
+	for _, value := range values {
+		h.Write(buf[:binary.PutUvarint(buf[:], uint64(len(value)))])
+		h.Write(value)
+	}
+	var d dedupDigest
+	h.Sum(d[:0])
+	return d
+}
+
+func digestStrings(values []string) dedupDigest {
+	list := make([][]byte, len(values))
+	for i, value := range values {
+		list[i] = []byte(value)
+	}
+	return digestValues(list...)
+}
+
+/**
+Input that could be read several times and the digest of the record key.
+ */
+type dedupSource[R any] struct {
+	open   func() (read func() (R, error), close func() error, err error)
+	digest func(record R) (dedupDigest, error)
+}
+
+func dedupRecords[R any](ctx context.Context, t *fileServiceImpl, outputFilePath string, src *dedupSource[R], keep DedupKeep, write func(R) error) error {
+
+	runs := t.dedupRuns(outputFilePath)
+	defer runs.removeAll()
+
+	read, closeFn, err := src.open()
+	if err != nil {
+		return err
+	}
+
+	index := make(map[dedupDigest]int64)
+	var parts *dedupPartitions
+
+	err = func() error {
+		for seq := int64(0); ; seq++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			record, err := read()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			d, err := src.digest(record)
+			if err != nil {
+				return err
+			}
+			if parts != nil {
+				if err := parts.add(d, seq); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, ok := index[d]; !ok || keep == DedupKeepLast {
+				index[d] = seq
+			}
+			if int64(len(index)) * dedupEntrySize > t.sortMemory {
+				parts = newDedupPartitions(runs, 0)
+				for d, seq := range index {
+					if err := parts.add(d, seq); err != nil {
+						return err
+					}
+				}
+				index = nil
+			}
+		}
+	}()
+	closeFn()
+	if err != nil {
+		if parts != nil {
+			parts.close()
+		}
+		return err
+	}
+
+	// the second pass writes records with kept numbers
+	read, closeFn, err = src.open()
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+
+	var next int64
+	emit := func(seq int64) error {
+		for {
+			record, err := read()
+			if err == io.EOF {
+				return errors.New("input file was changed during deduplication")
+			}
+			if err != nil {
+				return err
+			}
+			next++
+			if next - 1 == seq {
+				return write(record)
+			}
+		}
+	}
+
+	if parts == nil {
+		kept := make([]int64, 0, len(index))
+		for _, seq := range index {
+			kept = append(kept, seq)
+		}
+		index = nil
+		sort.Slice(kept, func(i, j int) bool { return kept[i] < kept[j] })
+		for _, seq := range kept {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := emit(seq); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	keptRuns, err := parts.keep(ctx, keep)
+	if err != nil {
+		return err
+	}
+
+	// kept numbers of all partitions are merged back in to the input order
+	return runs.mergeAll(ctx, keptRuns, emit)
+}
+
+/**
+Temp runs of sorted numbers of kept records.
+ */
+func (t *fileServiceImpl) dedupRuns(outputFilePath string) *sortRuns[int64] {
+	return &sortRuns[int64]{
+		t:              t,
+		outputFilePath: outputFilePath,
+		ext:            ".csv",
+		compare: func(a, b int64) int {
+			switch {
+			case a < b:
+				return -1
+			case a > b:
+				return 1
+			}
+			return 0
+		},
+		create: func(runPath string) (func(int64) error, func() error, error) {
+			w, err := t.newCsvFile(runPath, false, sortCsvDialect, nil)
+			if err != nil {
+				return nil, nil, err
+			}
+			return func(seq int64) error {
+				return w.Write(strconv.FormatInt(seq, 10))
+			}, w.Close, nil
+		},
+		open: func(runPath string) (func() (int64, error), func() error, error) {
+			r, err := t.OpenCsvDialectFile(runPath, sortCsvDialect)
+			if err != nil {
+				return nil, nil, err
+			}
+			return func() (int64, error) {
+				row, err := r.Read()
+				if err != nil {
+					return 0, err
+				}
+				return strconv.ParseInt(row[0], 10, 64)
+			}, r.Close, nil
+		},
+	}
+}
+
+/**
+Temp files with digests and record numbers partitioned by the byte of the digest at level.
+ */
+type dedupPartitions struct {
+	runs    *sortRuns[int64]
+	level   int
+	writers []*csvFileWriter
+	paths   []string
+}
+
+func newDedupPartitions(runs *sortRuns[int64], level int) *dedupPartitions {
+	return &dedupPartitions{
+		runs:    runs,
+		level:   level,
+		writers: make([]*csvFileWriter, DedupPartitions),
+		paths:   make([]string, DedupPartitions),
+	}
+}
+
+func (p *dedupPartitions) add(d dedupDigest, seq int64) error {
+	i := int(d[p.level]) % len(p.writers)
+	if p.writers[i] == nil {
+		runPath, err := p.runs.newRunPath()
+		if err != nil {
+			return err
+		}
+		if p.writers[i], err = p.runs.t.newCsvFile(runPath, false, sortCsvDialect, nil); err != nil {
+			return err
+		}
+		p.paths[i] = runPath
+	}
+	return p.writers[i].Write(hex.EncodeToString(d[:]), strconv.FormatInt(seq, 10))
+}
+
+func (p *dedupPartitions) close() error {
+	var err error
+	for i, w := range p.writers {
+		if w != nil {
+			if closeErr := w.Close(); err == nil {
+				err = closeErr
+			}
+			p.writers[i] = nil
+		}
+	}
+	return err
+}
+
+/**
+Deduplicates each partition and writes sorted numbers of kept records to runs.
+Partition with more distinct keys than fit in memory is partitioned again by the next byte of the digest,
+only the index of already deduplicated keys and the rest of the partition are written, so duplicates of the hot key
+do not make the partition any larger.
+ */
+func (p *dedupPartitions) keep(ctx context.Context, keep DedupKeep) ([]string, error) {
+
+	if err := p.close(); err != nil {
+		return nil, err
+	}
+
+	t := p.runs.t
+	var kept []string
+
+	for _, partPath := range p.paths {
+		if partPath == "" {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		reader, err := t.OpenCsvDialectFile(partPath, sortCsvDialect)
+		if err != nil {
+			return nil, err
+		}
+
+		index := make(map[dedupDigest]int64)
+		var sub *dedupPartitions
+		err = readDedupPartition(reader, func(d dedupDigest, seq int64) error {
+			if sub != nil {
+				return sub.add(d, seq)
+			}
+			if prev, ok := index[d]; !ok || (keep == DedupKeepFirst && seq < prev) || (keep == DedupKeepLast && seq > prev) {
+				index[d] = seq
+			}
+			if int64(len(index)) * dedupEntrySize > t.sortMemory && p.level + 1 < sha256.Size {
+				sub = newDedupPartitions(p.runs, p.level + 1)
+				for d, seq := range index {
+					if err := sub.add(d, seq); err != nil {
+						return err
+					}
+				}
+				index = nil
+			}
+			return nil
+		})
+		reader.Close()
+		if err != nil {
+			if sub != nil {
+				sub.close()
+			}
+			return nil, err
+		}
+
+		if sub != nil {
+			runs, err := sub.keep(ctx, keep)
+			if err != nil {
+				return nil, err
+			}
+			kept = append(kept, runs...)
+			t.fsys.Remove(partPath)
+			continue
+		}
+
+		seqs := make([]int64, 0, len(index))
+		for _, seq := range index {
+			seqs = append(seqs, seq)
+		}
+		index = nil
+		sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+		runPath, err := p.runs.writeRun(seqs)
+		if err != nil {
+			return nil, err
+		}
+		kept = append(kept, runPath)
+		t.fsys.Remove(partPath)
+	}
+
+	return kept, nil
+}
+
+func readDedupPartition(reader interface{ Read() ([]string, error) }, fn func(d dedupDigest, seq int64) error) error {
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var d dedupDigest
+		if len(row) != 2 || hex.DecodedLen(len(row[0])) != len(d) {
+			return errors.Errorf("invalid dedup partition row %v", row)
+		}
+		if _, err := hex.Decode(d[:], []byte(row[0])); err != nil {
+			return err
+		}
+		seq, err := strconv.ParseInt(row[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		if err := fn(d, seq); err != nil {
+			return err
+		}
+	}
+}
+
+func (t *fileServiceImpl) DedupCsvFile(ctx context.Context, inputFilePath, outputFilePath string, keep DedupKeep, columns ...string) error {
+
+	reader, err := t.OpenCsvFile(inputFilePath)
+	if err != nil {
+		return err
+	}
+	header, err := reader.Read()
+	reader.Close()
+	if err != nil {
+		return errors.Errorf("can not read header in file '%s', %v", inputFilePath, err)
+	}
+	header = append([]string(nil), header...)
+
+	keys := make([]SortKey, len(columns))
+	for i, column := range columns {
+		keys[i].Name = column
+	}
+	indexes, err := csvSortColumns(header, keys)
+	if err != nil {
+		return errors.Errorf("dedup file '%s', %v", inputFilePath, err)
+	}
+
+	src := &dedupSource[[]string]{
+		open: func() (func() ([]string, error), func() error, error) {
+			r, err := t.OpenCsvFile(inputFilePath)
+			if err != nil {
+				return nil, nil, err
+			}
+			if _, err := r.Read(); err != nil {
+				r.Close()
+				return nil, nil, err
+			}
+			return r.Read, r.Close, nil
+		},
+		digest: func(row []string) (dedupDigest, error) {
+			if len(indexes) == 0 {
+				return digestStrings(row), nil
+			}
+			return digestStrings(csvRowKeys(row, indexes)), nil
+		},
+	}
+
+	writer, err := t.newCsvFile(outputFilePath, true, t.FileDialect(outputFilePath), nil)
+	if err != nil {
+		return err
+	}
+	if err = writer.Write(header...); err == nil {
+		err = dedupRecords(ctx, t, outputFilePath, src, keep, func(row []string) error {
+			return writer.Write(row...)
+		})
+	}
+	if err != nil {
+		writer.Abort()
+		return errors.Errorf("dedup file '%s', %v", inputFilePath, err)
+	}
+	return writer.Close()
+}
+
+func (t *fileServiceImpl) DedupJsonFile(ctx context.Context, inputFilePath, outputFilePath string, keep DedupKeep, jsonPaths ...string) error {
+
+	keys := make([]SortKey, len(jsonPaths))
+	for i, jsonPath := range jsonPaths {
+		keys[i].Name = jsonPath
+	}
+	paths := jsonSortPaths(keys)
+
+	src := &dedupSource[json.RawMessage]{
+		open: func() (func() (json.RawMessage, error), func() error, error) {
+			r, err := t.OpenJsonFile(inputFilePath)
+			if err != nil {
+				return nil, nil, err
+			}
+			return r.ReadRaw, r.Close, nil
+		},
+		digest: func(raw json.RawMessage) (dedupDigest, error) {
+			if len(paths) == 0 {
+				return digestValues(raw), nil
+			}
+			record, err := jsonSortKeys(raw, paths)
+			if err != nil {
+				return dedupDigest{}, err
+			}
+			return digestStrings(record.keys), nil
+		},
+	}
+
+	writer, err := t.newJsonFile(outputFilePath, true)
+	if err != nil {
+		return err
+	}
+	err = dedupRecords(ctx, t, outputFilePath, src, keep, func(raw json.RawMessage) error {
+		return writer.WriteRaw(raw)
+	})
+	if err != nil {
+		writer.Abort()
+		return errors.Errorf("dedup file '%s', %v", inputFilePath, err)
+	}
+	return writer.Close()
+}
+
+func (t *fileServiceImpl) DedupProtoFile(ctx context.Context, inputFilePath, outputFilePath string, holder proto.Message, keep DedupKeep, fields ...string) error {
+
+	messageType, err := t.protoFileType(inputFilePath)
+	if err != nil {
+		return err
+	}
+	if holder == nil {
+		if messageType == nil {
+			return errors.Errorf("holder is required for file '%s' without descriptor header", inputFilePath)
+		}
+		holder = messageType.New().Interface()
+	}
+
+	keys := make([]func(proto.Message) (string, error), len(fields))
+	for i, field := range fields {
+		if keys[i], err = protoFieldKey(holder.ProtoReflect().Descriptor(), field); err != nil {
+			return errors.Errorf("dedup file '%s', %v", inputFilePath, err)
+		}
+	}
+
+	marshal := proto.MarshalOptions{ Deterministic: true }
+	src := &dedupSource[proto.Message]{
+		open: func() (func() (proto.Message, error), func() error, error) {
+			r, err := t.OpenProtoFile(inputFilePath)
+			if err != nil {
+				return nil, nil, err
+			}
+			return func() (proto.Message, error) {
+				return holder, r.ReadTo(holder)
+			}, r.Close, nil
+		},
+		digest: func(message proto.Message) (dedupDigest, error) {
+			if len(keys) == 0 {
+				bin, err := marshal.Marshal(message)
+				if err != nil {
+					return dedupDigest{}, err
+				}
+				return digestValues(bin), nil
+			}
+			values := make([]string, len(keys))
+			for i, key := range keys {
+				value, err := key(message)
+				if err != nil {
+					return dedupDigest{}, err
+				}
+				values[i] = value
+			}
+			return digestStrings(values), nil
+		},
+	}
+
+	writer, err := t.newProtoFile(outputFilePath, true, describe(messageType))
+	if err != nil {
+		return err
+	}
+	err = dedupRecords(ctx, t, outputFilePath, src, keep, func(message proto.Message) error {
+		_, err := writer.Write(message)
+		return err
+	})
+	if err != nil {
+		writer.Abort()
+		return errors.Errorf("dedup file '%s', %v", inputFilePath, err)
+	}
+	return writer.Close()
+}
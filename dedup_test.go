@@ -0,0 +1,212 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/sprintframework/fsmod"
+	"github.com/stretchr/testify/require"
+	"io"
+	iofs "io/fs"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDedupCsvFile(t *testing.T) {
+
+	fs := fsmod.FileSystemService(fsmod.MemFileSystem())
+	ctx := context.Background()
+
+	writeCsvRows(t, fs, "events.csv", [][]string{
+		{ "user", "event" },
+		{ "alice", "login" },
+		{ "bob", "login" },
+		{ "alice", "login" },
+		{ "alice", "logout" },
+		{ "bob", "logout" },
+	})
+
+	require.NoError(t, fs.DedupCsvFile(ctx, "events.csv", "unique.csv", fsmod.DedupKeepFirst))
+	require.Equal(t, [][]string{ { "user", "event" }, { "alice", "login" }, { "bob", "login" }, { "alice", "logout" }, { "bob", "logout" } },
+		readCsvRows(t, fs, "unique.csv"))
+
+	require.NoError(t, fs.DedupCsvFile(ctx, "events.csv", "first.csv", fsmod.DedupKeepFirst, "user"))
+	require.Equal(t, [][]string{ { "user", "event" }, { "alice", "login" }, { "bob", "login" } },
+		readCsvRows(t, fs, "first.csv"))
+
+	require.NoError(t, fs.DedupCsvFile(ctx, "events.csv", "last.csv", fsmod.DedupKeepLast, "user"))
+	require.Equal(t, [][]string{ { "user", "event" }, { "alice", "logout" }, { "bob", "logout" } },
+		readCsvRows(t, fs, "last.csv"))
+
+	require.Error(t, fs.DedupCsvFile(ctx, "events.csv", "broken.csv", fsmod.DedupKeepFirst, "missing"))
+	_, err := fs.OpenCsvFile("broken.csv")
+	require.Error(t, err)
+}
+
+func TestDedupCsvFilePartitioned(t *testing.T) {
+
+	mem := fsmod.MemFileSystem()
+	fs := fsmod.FileSystemService(mem)
+	// index of few keys spills to temp partitions
+	fs.SetSortMemory(300)
+	fs.SetSortTempDir("tmp")
+
+	writeGroups(t, fs, "groups.csv", 1000)
+
+	for _, keep := range []fsmod.DedupKeep{ fsmod.DedupKeepFirst, fsmod.DedupKeepLast } {
+		require.NoError(t, fs.DedupCsvFile(context.Background(), "groups.csv", "unique.csv", keep, "group"))
+		rows := readCsvRows(t, fs, "unique.csv")
+		require.Equal(t, 6, len(rows))
+		for i, row := range rows[1:] {
+			id := i
+			if keep == fsmod.DedupKeepLast {
+				id = 995 + i
+			}
+			require.Equal(t, strconv.Itoa(id), row[0])
+		}
+
+		require.NoError(t, fs.DedupCsvFile(context.Background(), "groups.csv", "unique.csv", keep))
+		require.Equal(t, 1001, len(readCsvRows(t, fs, "unique.csv")))
+	}
+
+	// temp partitions are removed
+	entries, err := iofs.ReadDir(mem, "tmp")
+	if err == nil {
+		require.Equal(t, 0, len(entries))
+	}
+}
+
+func TestDedupCsvFileSkewed(t *testing.T) {
+
+	fsys := &writeCounter{ FileSystem: fsmod.MemFileSystem(), prefix: "tmp/" }
+	fs := fsmod.FileSystemService(fsys)
+	// index of ten keys spills, the hot key fills one partition
+	fs.SetSortMemory(960)
+	fs.SetSortTempDir("tmp")
+
+	const hotRows = 5000
+	rows := [][]string{ { "key", "seq" } }
+	want := [][]string{ { "key", "seq" } }
+	for i := 0; i < hotRows; i++ {
+		key := "hot"
+		if i % 100 == 1 {
+			key = fmt.Sprintf("key%d", i)
+		}
+		rows = append(rows, []string{ key, strconv.Itoa(i) })
+		if key != "hot" || i == 0 {
+			want = append(want, rows[len(rows) - 1])
+		}
+	}
+	writeCsvRows(t, fs, "skewed.csv", rows)
+
+	require.NoError(t, fs.DedupCsvFile(context.Background(), "skewed.csv", "unique.csv", fsmod.DedupKeepFirst, "key"))
+	require.Equal(t, want, readCsvRows(t, fs, "unique.csv"))
+
+	// duplicates of the hot key are written to temp partitions once, not again on every byte of the digest
+	require.True(t, fsys.written < 2 * hotRows * 72, "temp bytes written %d", fsys.written)
+}
+
+/**
+File system that counts bytes written to created files with the prefix.
+ */
+type writeCounter struct {
+	fsmod.FileSystem
+	prefix  string
+	written int64
+}
+
+func (w *writeCounter) Create(name string) (fsmod.WritableFile, error) {
+	fd, err := w.FileSystem.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return w.count(fd), nil
+}
+
+func (w *writeCounter) CreateTemp(dir, pattern string) (fsmod.WritableFile, error) {
+	fd, err := w.FileSystem.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return w.count(fd), nil
+}
+
+func (w *writeCounter) count(fd fsmod.WritableFile) fsmod.WritableFile {
+	if !strings.HasPrefix(fd.Name(), w.prefix) {
+		return fd
+	}
+	return &countedWritableFile{ WritableFile: fd, counter: w }
+}
+
+type countedWritableFile struct {
+	fsmod.WritableFile
+	counter *writeCounter
+}
+
+func (f *countedWritableFile) Write(p []byte) (int, error) {
+	n, err := f.WritableFile.Write(p)
+	atomic.AddInt64(&f.counter.written, int64(n))
+	return n, err
+}
+
+func TestDedupJsonFile(t *testing.T) {
+
+	fs := fsmod.FileSystemService(fsmod.MemFileSystem())
+	fs.SetSortMemory(1000)
+
+	writer, err := fs.NewJsonFile("users.json")
+	require.NoError(t, err)
+	for i := 0; i < 200; i++ {
+		require.NoError(t, writer.Write(map[string]interface{}{ "user": map[string]interface{}{ "id": i % 40, "seen": i } }))
+	}
+	require.NoError(t, writer.Close())
+
+	require.NoError(t, fs.DedupJsonFile(context.Background(), "users.json", "unique.json", fsmod.DedupKeepLast, "$.user.id"))
+
+	reader, err := fs.OpenJsonFile("unique.json")
+	require.NoError(t, err)
+	defer reader.Close()
+	for i := 0; i < 40; i++ {
+		var holder struct {
+			User struct {
+				Id   int `json:"id"`
+				Seen int `json:"seen"`
+			} `json:"user"`
+		}
+		require.NoError(t, reader.Read(&holder))
+		require.Equal(t, i, holder.User.Id)
+		require.Equal(t, 160 + i, holder.User.Seen)
+	}
+	_, err = reader.ReadRaw()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestDedupProtoFile(t *testing.T) {
+
+	fs := fsmod.FileSystemService(fsmod.MemFileSystem())
+
+	writer, err := fs.NewProtoFile("domains.pb")
+	require.NoError(t, err)
+	for i := 0; i < 30; i++ {
+		_, err = writer.Write(&Domain{ Domain: fmt.Sprintf("obj%02d", i % 10), Zone: fmt.Sprintf("zone%d", i % 20) })
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Close())
+
+	require.NoError(t, fs.DedupProtoFile(context.Background(), "domains.pb", "unique.pb", &Domain{}, fsmod.DedupKeepFirst, "domain"))
+	domains := readDomains(t, fs, "unique.pb")
+	require.Equal(t, 10, len(domains))
+	for i, domain := range domains {
+		require.Equal(t, fmt.Sprintf("obj%02d", i), domain)
+	}
+
+	// whole messages differ by zone
+	require.NoError(t, fs.DedupProtoFile(context.Background(), "domains.pb", "unique.pb", &Domain{}, fsmod.DedupKeepFirst))
+	require.Equal(t, 20, len(readDomains(t, fs, "unique.pb")))
+}
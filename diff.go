@@ -0,0 +1,641 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+/**
+Kind of the difference of the record.
+ */
+type DiffKind string
+
+const (
+	DiffAdded    DiffKind = "added"
+	DiffRemoved  DiffKind = "removed"
+	DiffModified DiffKind = "modified"
+)
+
+/**
+Difference of the record with the key between old and new files, records are encoded as JSON objects.
+ */
+type DiffRecord struct {
+	Kind   DiffKind        `json:"kind"`
+	Key    []string        `json:"key"`
+	Fields []string        `json:"fields,omitempty"` // changed fields of the modified record
+	Old    json.RawMessage `json:"old,omitempty"`
+	New    json.RawMessage `json:"new,omitempty"`
+}
+
+/**
+Counts of records by the kind of difference.
+ */
+type DiffStats struct {
+	Added     int64
+	Removed   int64
+	Modified  int64
+	Unchanged int64
+}
+
+/**
+Receives differences in order of keys.
+ */
+type DiffReport func(record *DiffRecord) error
+
+/**
+Writer of the diff file.
+ */
+type DiffWriter interface {
+	Aborter
+
+	/*
+	Writes the difference of the record.
+	 */
+	Write(record *DiffRecord) error
+
+	/*
+	Commits the diff file.
+	 */
+	Close() error
+}
+
+/**
+Extension of the file service that compares old and new files by keys and reports added, removed and modified records.
+
+Sorted inputs are merged in one pass with constant memory, keys must be unique and ascending by the keys.
+Unsorted inputs are sorted first in to temp files by the external sort of this module.
+Report could be nil if only stats are needed.
+ */
+type DiffFileService interface {
+
+	/*
+	Compares CSV files by key columns, changed fields are columns by name.
+	 */
+	DiffCsvFiles(ctx context.Context, oldFilePath, newFilePath string, keys []SortKey, sorted bool, report DiffReport) (*DiffStats, error)
+
+	/*
+	Compares JSON files by values of JSON paths, changed fields are top level fields of objects.
+	 */
+	DiffJsonFiles(ctx context.Context, oldFilePath, newFilePath string, keys []SortKey, sorted bool, report DiffReport) (*DiffStats, error)
+
+	/*
+	Compares protofiles by key fields, changed fields are message fields. Holder could be nil for files with descriptor header.
+	 */
+	DiffProtoFiles(ctx context.Context, oldFilePath, newFilePath string, holder proto.Message, keys []SortKey, sorted bool, report DiffReport) (*DiffStats, error)
+
+	/*
+	Creates CSV diff file with columns kind, key columns, fields, old and new.
+	 */
+	NewCsvDiffFile(filePath string, keys ...string) (DiffWriter, error)
+
+	/*
+	Creates JSON Lines diff file with one difference per line.
+	 */
+	NewJsonDiffFile(filePath string) (DiffWriter, error)
+}
+
+/**
+One of the sorted inputs of the diff with the current record.
+ */
+type diffSide[R any] struct {
+	name   string
+	read   func() (R, error)
+	keys   func(R) ([]string, error)
+	encode func(R) (json.RawMessage, error)
+	head   R
+	key    []string
+	eof    bool
+}
+
+func (s *diffSide[R]) next(keys []SortKey) error {
+	record, err := s.read()
+	if err == io.EOF {
+		s.eof = true
+		return nil
+	}
+	if err != nil {
+		return errors.Errorf("read file '%s', %v", s.name, err)
+	}
+	key, err := s.keys(record)
+	if err != nil {
+		return errors.Errorf("key in file '%s', %v", s.name, err)
+	}
+	if s.key != nil {
+		c := compareKeys(keys, s.key, key)
+		if c > 0 {
+			return errors.Errorf("file '%s' is not sorted by the keys at %v", s.name, key)
+		}
+		if c == 0 {
+			return errors.Errorf("duplicate key %v in file '%s'", key, s.name)
+		}
+	}
+	s.head, s.key = record, key
+	return nil
+}
+
+/**
+Merges sorted sides by keys, changed returns fields that differ and false if records are the same.
+ */
+func diffSorted[R any](ctx context.Context, oldSide, newSide *diffSide[R], keys []SortKey, changed func(a, b R) ([]string, bool, error), report DiffReport) (*DiffStats, error) {
+
+	stats := &DiffStats{}
+
+	emit := func(kind DiffKind, key []string, fields []string, a, b *R) error {
+		if report == nil {
+			return nil
+		}
+		d := &DiffRecord{ Kind: kind, Key: key, Fields: fields }
+		var err error
+		if a != nil {
+			if d.Old, err = oldSide.encode(*a); err != nil {
+				return err
+			}
+		}
+		if b != nil {
+			if d.New, err = newSide.encode(*b); err != nil {
+				return err
+			}
+		}
+		return report(d)
+	}
+
+	if err := oldSide.next(keys); err != nil {
+		return nil, err
+	}
+	if err := newSide.next(keys); err != nil {
+		return nil, err
+	}
+
+	for !oldSide.eof || !newSide.eof {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		var c int
+		switch {
+		case oldSide.eof:
+			c = 1
+		case newSide.eof:
+			c = -1
+		default:
+			c = compareKeys(keys, oldSide.key, newSide.key)
+		}
+
+		var err error
+		switch {
+		case c < 0:
+			stats.Removed++
+			if err = emit(DiffRemoved, oldSide.key, nil, &oldSide.head, nil); err == nil {
+				err = oldSide.next(keys)
+			}
+		case c > 0:
+			stats.Added++
+			if err = emit(DiffAdded, newSide.key, nil, nil, &newSide.head); err == nil {
+				err = newSide.next(keys)
+			}
+		default:
+			var fields []string
+			var modified bool
+			if fields, modified, err = changed(oldSide.head, newSide.head); err != nil {
+				return nil, err
+			}
+			if modified {
+				stats.Modified++
+				err = emit(DiffModified, newSide.key, fields, &oldSide.head, &newSide.head)
+			} else {
+				stats.Unchanged++
+			}
+			if err == nil {
+				if err = oldSide.next(keys); err == nil {
+					err = newSide.next(keys)
+				}
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return stats, nil
+}
+
+/**
+Sorts both inputs in to temp files unless they are sorted, cleanup removes the temp files.
+ */
+func (t *fileServiceImpl) diffInputs(oldFilePath, newFilePath, ext string, sorted bool, sortFn func(inputFilePath, outputFilePath string) error) (string, string, func(), error) {
+
+	if sorted {
+		return oldFilePath, newFilePath, func() {}, nil
+	}
+
+	runs := &sortRuns[struct{}]{ t: t, outputFilePath: newFilePath, ext: ext }
+	var paths []string
+	for _, inputFilePath := range []string{ oldFilePath, newFilePath } {
+		runPath, err := runs.newRunPath()
+		if err == nil {
+			err = sortFn(inputFilePath, runPath)
+		}
+		if err != nil {
+			runs.removeAll()
+			return "", "", nil, err
+		}
+		paths = append(paths, runPath)
+	}
+	return paths[0], paths[1], runs.removeAll, nil
+}
+
+func (t *fileServiceImpl) DiffCsvFiles(ctx context.Context, oldFilePath, newFilePath string, keys []SortKey, sorted bool, report DiffReport) (*DiffStats, error) {
+
+	oldPath, newPath, cleanup, err := t.diffInputs(oldFilePath, newFilePath, ".csv", sorted, func(inputFilePath, outputFilePath string) error {
+		return t.SortCsvFile(ctx, inputFilePath, outputFilePath, keys...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	oldInput, oldHeader, err := t.csvDiffSide(oldPath, oldFilePath, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer oldInput.close()
+
+	newInput, newHeader, err := t.csvDiffSide(newPath, newFilePath, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer newInput.close()
+
+	// columns are compared by name, missing column is empty
+	names := append([]string(nil), newHeader...)
+	for _, name := range oldHeader {
+		if indexOf(newHeader, name) < 0 {
+			names = append(names, name)
+		}
+	}
+	oldColumns := make([]int, len(names))
+	newColumns := make([]int, len(names))
+	for i, name := range names {
+		oldColumns[i] = indexOf(oldHeader, name)
+		newColumns[i] = indexOf(newHeader, name)
+	}
+
+	return diffSorted(ctx, oldInput.side, newInput.side, keys, func(a, b []string) ([]string, bool, error) {
+		var fields []string
+		for i, name := range names {
+			if csvValue(a, oldColumns[i]) != csvValue(b, newColumns[i]) {
+				fields = append(fields, name)
+			}
+		}
+		return fields, len(fields) > 0, nil
+	}, report)
+}
+
+type csvDiffInput struct {
+	side  *diffSide[[]string]
+	close func() error
+}
+
+func (t *fileServiceImpl) csvDiffSide(filePath, name string, keys []SortKey) (*csvDiffInput, []string, error) {
+
+	reader, err := t.OpenCsvFile(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	header, err := reader.Read()
+	if err != nil {
+		reader.Close()
+		return nil, nil, errors.Errorf("can not read header in file '%s', %v", name, err)
+	}
+	header = append([]string(nil), header...)
+
+	columns, err := csvSortColumns(header, keys)
+	if err != nil {
+		reader.Close()
+		return nil, nil, errors.Errorf("diff file '%s', %v", name, err)
+	}
+
+	side := &diffSide[[]string]{
+		name: name,
+		read: func() ([]string, error) {
+			row, err := reader.Read()
+			if err != nil {
+				return nil, err
+			}
+			// record could be reused by reader
+			return append([]string(nil), row...), nil
+		},
+		keys: func(row []string) ([]string, error) {
+			return csvRowKeys(row, columns), nil
+		},
+		encode: func(row []string) (json.RawMessage, error) {
+			return csvRowObject(header, row)
+		},
+	}
+	return &csvDiffInput{ side: side, close: reader.Close }, header, nil
+}
+
+/**
+Encodes row as JSON object with columns in order of the header.
+ */
+func csvRowObject(header, row []string) (json.RawMessage, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, name := range header {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(name)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(csvValue(row, i))
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func csvValue(row []string, i int) string {
+	if i >= 0 && i < len(row) {
+		return row[i]
+	}
+	return ""
+}
+
+func indexOf(list []string, value string) int {
+	for i, s := range list {
+		if s == value {
+			return i
+		}
+	}
+	return -1
+}
+
+func (t *fileServiceImpl) DiffJsonFiles(ctx context.Context, oldFilePath, newFilePath string, keys []SortKey, sorted bool, report DiffReport) (*DiffStats, error) {
+
+	oldPath, newPath, cleanup, err := t.diffInputs(oldFilePath, newFilePath, ".json", sorted, func(inputFilePath, outputFilePath string) error {
+		return t.SortJsonFile(ctx, inputFilePath, outputFilePath, keys...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	paths := jsonSortPaths(keys)
+	sides := make([]*diffSide[json.RawMessage], 2)
+	for i, filePath := range []string{ oldPath, newPath } {
+		reader, err := t.OpenJsonFile(filePath)
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		sides[i] = &diffSide[json.RawMessage]{
+			name: []string{ oldFilePath, newFilePath }[i],
+			read: reader.ReadRaw,
+			keys: func(raw json.RawMessage) ([]string, error) {
+				record, err := jsonSortKeys(raw, paths)
+				if err != nil {
+					return nil, err
+				}
+				return record.keys, nil
+			},
+			encode: func(raw json.RawMessage) (json.RawMessage, error) {
+				return raw, nil
+			},
+		}
+	}
+
+	return diffSorted(ctx, sides[0], sides[1], keys, jsonChangedFields, report)
+}
+
+/**
+Compares decoded records, for objects returns top level fields that differ in order of names.
+ */
+func jsonChangedFields(a, b json.RawMessage) ([]string, bool, error) {
+
+	x, err := decodeJsonValue(a)
+	if err != nil {
+		return nil, false, err
+	}
+	y, err := decodeJsonValue(b)
+	if err != nil {
+		return nil, false, err
+	}
+	if reflect.DeepEqual(x, y) {
+		return nil, false, nil
+	}
+
+	ox, okx := x.(map[string]interface{})
+	oy, oky := y.(map[string]interface{})
+	if !okx || !oky {
+		return nil, true, nil
+	}
+
+	var fields []string
+	for name, value := range ox {
+		if other, ok := oy[name]; !ok || !reflect.DeepEqual(value, other) {
+			fields = append(fields, name)
+		}
+	}
+	for name := range oy {
+		if _, ok := ox[name]; !ok {
+			fields = append(fields, name)
+		}
+	}
+	sort.Strings(fields)
+	return fields, true, nil
+}
+
+func decodeJsonValue(raw json.RawMessage) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	// numbers are compared as written
+	dec.UseNumber()
+	var value interface{}
+	err := dec.Decode(&value)
+	return value, err
+}
+
+func (t *fileServiceImpl) DiffProtoFiles(ctx context.Context, oldFilePath, newFilePath string, holder proto.Message, keys []SortKey, sorted bool, report DiffReport) (*DiffStats, error) {
+
+	messageType, err := t.protoFileType(oldFilePath)
+	if err != nil {
+		return nil, err
+	}
+	if holder == nil {
+		if messageType == nil {
+			return nil, errors.Errorf("holder is required for file '%s' without descriptor header", oldFilePath)
+		}
+		holder = messageType.New().Interface()
+	}
+
+	fieldKeys := make([]func(proto.Message) (string, error), len(keys))
+	for i, key := range keys {
+		if fieldKeys[i], err = protoFieldKey(holder.ProtoReflect().Descriptor(), key.Name); err != nil {
+			return nil, errors.Errorf("diff file '%s', %v", oldFilePath, err)
+		}
+	}
+	messageKeys := func(message proto.Message) ([]string, error) {
+		values := make([]string, len(fieldKeys))
+		for i, key := range fieldKeys {
+			value, err := key(message)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = value
+		}
+		return values, nil
+	}
+
+	oldPath, newPath, cleanup, err := t.diffInputs(oldFilePath, newFilePath, ".pb", sorted, func(inputFilePath, outputFilePath string) error {
+		return t.SortProtoFile(ctx, inputFilePath, outputFilePath, holder, func(a, b proto.Message) int {
+			// keys of scalar fields have no errors
+			x, _ := messageKeys(a)
+			y, _ := messageKeys(b)
+			return compareKeys(keys, x, y)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	sides := make([]*diffSide[proto.Message], 2)
+	for i, filePath := range []string{ oldPath, newPath } {
+		reader, err := t.OpenProtoFile(filePath)
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		sides[i] = &diffSide[proto.Message]{
+			name: []string{ oldFilePath, newFilePath }[i],
+			read: func() (proto.Message, error) {
+				message := holder.ProtoReflect().New().Interface()
+				return message, reader.ReadTo(message)
+			},
+			keys: messageKeys,
+			encode: func(message proto.Message) (json.RawMessage, error) {
+				return t.marshaler.MarshalOptions.Marshal(message)
+			},
+		}
+	}
+
+	return diffSorted(ctx, sides[0], sides[1], keys, func(a, b proto.Message) ([]string, bool, error) {
+		if proto.Equal(a, b) {
+			return nil, false, nil
+		}
+		return protoChangedFields(a.ProtoReflect(), b.ProtoReflect()), true, nil
+	}, report)
+}
+
+/**
+Returns names of fields that differ in order of the descriptor.
+ */
+func protoChangedFields(x, y protoreflect.Message) []string {
+	var fields []string
+	fds := x.Descriptor().Fields()
+	for i := 0; i < fds.Len(); i++ {
+		fd := fds.Get(i)
+		if !protoFieldEqual(x, y, fd) {
+			fields = append(fields, string(fd.Name()))
+		}
+	}
+	return fields
+}
+
+/**
+Compares one field by copying it to empty messages, that works for lists, maps and messages.
+ */
+func protoFieldEqual(x, y protoreflect.Message, fd protoreflect.FieldDescriptor) bool {
+	if x.Has(fd) != y.Has(fd) {
+		return false
+	}
+	if !x.Has(fd) {
+		return true
+	}
+	a, b := x.New(), y.New()
+	a.Set(fd, x.Get(fd))
+	b.Set(fd, y.Get(fd))
+	return proto.Equal(a.Interface(), b.Interface())
+}
+
+type csvDiffWriter struct {
+	w    *csvFileWriter
+	keys int
+}
+
+func (t *fileServiceImpl) NewCsvDiffFile(filePath string, keys ...string) (DiffWriter, error) {
+	w, err := t.newCsvFile(filePath, true, t.FileDialect(filePath), nil)
+	if err != nil {
+		return nil, err
+	}
+	header := append([]string{ "kind" }, keys...)
+	if err := w.Write(append(header, "fields", "old", "new")...); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	return &csvDiffWriter{ w: w, keys: len(keys) }, nil
+}
+
+func (w *csvDiffWriter) Write(record *DiffRecord) error {
+	row := []string{ string(record.Kind) }
+	for i := 0; i < w.keys; i++ {
+		row = append(row, csvValue(record.Key, i))
+	}
+	row = append(row, strings.Join(record.Fields, ","), string(record.Old), string(record.New))
+	return w.w.Write(row...)
+}
+
+func (w *csvDiffWriter) Close() error {
+	return w.w.Close()
+}
+
+func (w *csvDiffWriter) Abort() error {
+	return w.w.Abort()
+}
+
+type jsonDiffWriter struct {
+	w *jsonFileWriter
+}
+
+func (t *fileServiceImpl) NewJsonDiffFile(filePath string) (DiffWriter, error) {
+	w, err := t.newJsonFile(filePath, true)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonDiffWriter{ w: w }, nil
+}
+
+func (w *jsonDiffWriter) Write(record *DiffRecord) error {
+	raw, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return w.w.WriteRaw(raw)
+}
+
+func (w *jsonDiffWriter) Close() error {
+	return w.w.Close()
+}
+
+func (w *jsonDiffWriter) Abort() error {
+	return w.w.Abort()
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sprintframework/fsmod"
+	"github.com/stretchr/testify/require"
+	"io"
+	iofs "io/fs"
+	"testing"
+)
+
+func TestDiffCsvFiles(t *testing.T) {
+
+	mem := fsmod.MemFileSystem()
+	fs := fsmod.FileSystemService(mem)
+	fs.SetSortTempDir("tmp")
+	ctx := context.Background()
+
+	writeCsvRows(t, fs, "old.csv", [][]string{ { "id", "name", "price" }, { "3", "plum", "5" }, { "1", "apple", "2" }, { "2", "banana", "1" } })
+	writeCsvRows(t, fs, "new.csv", [][]string{ { "id", "name", "price", "color" }, { "4", "kiwi", "3", "" }, { "1", "apple", "2", "" }, { "3", "plum", "6", "blue" } })
+
+	keys := []fsmod.SortKey{ { Name: "id", Compare: fsmod.CompareNumbers } }
+	var diffs []*fsmod.DiffRecord
+	stats, err := fs.DiffCsvFiles(ctx, "old.csv", "new.csv", keys, false, func(d *fsmod.DiffRecord) error {
+		diffs = append(diffs, d)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, &fsmod.DiffStats{ Added: 1, Removed: 1, Modified: 1, Unchanged: 1 }, stats)
+
+	require.Equal(t, 3, len(diffs))
+	require.Equal(t, fsmod.DiffRemoved, diffs[0].Kind)
+	require.Equal(t, []string{ "2" }, diffs[0].Key)
+	require.JSONEq(t, `{"id":"2","name":"banana","price":"1"}`, string(diffs[0].Old))
+	require.Equal(t, fsmod.DiffModified, diffs[1].Kind)
+	require.Equal(t, []string{ "price", "color" }, diffs[1].Fields)
+	require.Equal(t, fsmod.DiffAdded, diffs[2].Kind)
+	require.Equal(t, []string{ "4" }, diffs[2].Key)
+	require.Nil(t, diffs[2].Old)
+
+	// temp sorted copies are removed
+	entries, err := iofs.ReadDir(mem, "tmp")
+	if err == nil {
+		require.Equal(t, 0, len(entries))
+	}
+
+	// unsorted input fails the sorted fast path
+	_, err = fs.DiffCsvFiles(ctx, "old.csv", "new.csv", keys, true, nil)
+	require.Error(t, err)
+
+	writer, err := fs.NewCsvDiffFile("diff.csv", "id")
+	require.NoError(t, err)
+	_, err = fs.DiffCsvFiles(ctx, "old.csv", "new.csv", keys, false, writer.Write)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	rows := readCsvRows(t, fs, "diff.csv")
+	require.Equal(t, []string{ "kind", "id", "fields", "old", "new" }, rows[0])
+	require.Equal(t, 4, len(rows))
+	require.Equal(t, []string{ "modified", "3", "price,color" }, rows[2][:3])
+}
+
+func TestDiffJsonFiles(t *testing.T) {
+
+	fs := fsmod.FileSystemService(fsmod.MemFileSystem())
+	ctx := context.Background()
+
+	write := func(filePath string, records ...string) {
+		writer, err := fs.NewJsonFile(filePath)
+		require.NoError(t, err)
+		for _, record := range records {
+			require.NoError(t, writer.Write(json.RawMessage(record)))
+		}
+		require.NoError(t, writer.Close())
+	}
+	write("old.json", `{"id":"a","n":1,"tags":["x"]}`, `{"id":"b","n":2}`, `{"id":"c","n":3}`)
+	write("new.json", `{"id":"a","tags":["x"],"n":1}`, `{"id":"b","n":2.0}`, `{"id":"d","n":4}`)
+
+	keys := []fsmod.SortKey{ { Name: "$.id" } }
+	writer, err := fs.NewJsonDiffFile("diff.json")
+	require.NoError(t, err)
+	stats, err := fs.DiffJsonFiles(ctx, "old.json", "new.json", keys, true, writer.Write)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	require.Equal(t, &fsmod.DiffStats{ Added: 1, Removed: 1, Modified: 1, Unchanged: 1 }, stats)
+
+	reader, err := fs.OpenJsonFile("diff.json")
+	require.NoError(t, err)
+	defer reader.Close()
+	var kinds []fsmod.DiffKind
+	for {
+		var d fsmod.DiffRecord
+		if err = reader.Read(&d); err != nil {
+			break
+		}
+		kinds = append(kinds, d.Kind)
+		if d.Kind == fsmod.DiffModified {
+			require.Equal(t, []string{ "n" }, d.Fields)
+		}
+	}
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, []fsmod.DiffKind{ fsmod.DiffModified, fsmod.DiffRemoved, fsmod.DiffAdded }, kinds)
+}
+
+func TestDiffProtoFiles(t *testing.T) {
+
+	fs := fsmod.FileSystemService(fsmod.MemFileSystem())
+
+	write := func(filePath string, domains ...*Domain) {
+		writer, err := fs.NewProtoFile(filePath)
+		require.NoError(t, err)
+		for _, domain := range domains {
+			_, err = writer.Write(domain)
+			require.NoError(t, err)
+		}
+		require.NoError(t, writer.Close())
+	}
+
+	var oldDomains, newDomains []*Domain
+	for i := 0; i < 20; i++ {
+		oldDomains = append(oldDomains, &Domain{ Domain: fmt.Sprintf("obj%02d", (i * 7) % 20), Zone: "zone" })
+	}
+	for i := 0; i < 20; i++ {
+		domain := &Domain{ Domain: fmt.Sprintf("obj%02d", (i * 3) % 20 + 5), Zone: "zone" }
+		if i % 4 == 0 {
+			domain.Options = []string{ "ttl" }
+		}
+		newDomains = append(newDomains, domain)
+	}
+	write("old.pb", oldDomains...)
+	write("new.pb", newDomains...)
+
+	var modified []*fsmod.DiffRecord
+	stats, err := fs.DiffProtoFiles(context.Background(), "old.pb", "new.pb", &Domain{}, []fsmod.SortKey{ { Name: "domain" } }, false, func(d *fsmod.DiffRecord) error {
+		if d.Kind == fsmod.DiffModified {
+			modified = append(modified, d)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(5), stats.Added)
+	require.Equal(t, int64(5), stats.Removed)
+	require.Equal(t, int64(15), stats.Modified + stats.Unchanged)
+	require.Equal(t, int(stats.Modified), len(modified))
+	for _, d := range modified {
+		require.Equal(t, []string{ "options" }, d.Fields)
+		require.NotNil(t, d.Old)
+		require.NotNil(t, d.New)
+	}
+}
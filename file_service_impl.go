@@ -6,21 +6,110 @@
 package fsmod
 
 import (
+	"context"
 	"github.com/sprintframework/fs"
 	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 )
 
 // default size is 64kb, possible to overwrite
 var DefaultBufferSize = 64 * 1024
 
+/**
+File service with the extensions of this module on top of the `fs` interface.
+ */
+type ExtendedFileService interface {
+	fs.FileService
+	CodecFileService
+	AtomicFileService
+	ContextFileService
+	CsvDialectFileService
+	ProtoCsvFileService
+	JsonCsvFileService
+	ProtoIndexFileService
+	ProtoFramedFileService
+	ProtoLimitFileService
+	ProtoFramingFileService
+	DescribedProtoFileService
+	FileSystemFileService
+	DatasetFileService
+	ManifestFileService
+	PartitionFileService
+	ParallelFileService
+	SortFileService
+	MergeFileService
+	DedupFileService
+	DiffFileService
+	CsvHeaderFileService
+}
+
+/**
+Extension of the file service with long-running operations that could be cancelled by context.
+On cancellation partial parts are removed and the context error is returned.
+ */
+type ContextFileService interface {
+
+	/*
+	Splits one single CSV in to parts, checks context between records.
+	 */
+	SplitCsvFileContext(ctx context.Context, inputFilePath string, limit int, partFn func (int) string) ([]string, error)
+
+	/*
+	Joins CSV files in to one, checks context between records.
+	 */
+	JoinCsvFilesContext(ctx context.Context, outputFilePath string, parts []string) error
+
+	/*
+	Splits one single JSON file in to parts, checks context between records.
+	 */
+	SplitJsonFileContext(ctx context.Context, inputFilePath string, limit int, partFn func (int) string) ([]string, error)
+
+	/*
+	Joins JSON files in to one, checks context between records.
+	 */
+	JoinJsonFilesContext(ctx context.Context, outputFilePath string, parts []string) error
+
+	/*
+	Splits one single protofile in to parts, checks context between records.
+	 */
+	SplitProtoFileContext(ctx context.Context, inputFilePath string, holder proto.Message, limit int, partFn func (int) string) ([]string, error)
+
+	/*
+	Joins protofiles in to one, checks context between records.
+	 */
+	JoinProtoFilesContext(ctx context.Context, outputFilePath string, row proto.Message, parts []string) error
+}
+
 type fileServiceImpl struct {
 	bufferSize int // read/write block buffer size
 	marshaler  runtime.JSONPb
+	codecs     map[string]Codec // compression codecs by file extension
+	detection  CodecDetection
+	csvDialect CsvDialect
+	repeatedSeparator string
+	jsonSampleSize int
+	protoIndexInterval int // records between index checkpoints, 0 disables index
+	protoFormat ProtoFormat
+	maxMessageSize int
+	protoFraming ProtoFraming
+	fsys       FileSystem
+	parallelism int // workers of split and join, sequential if less than 2
+	sortMemory  int64
+	sortTempDir string // directory of the output file if empty
+	maxOpenPartitions int
 }
 
-func FileService() fs.FileService {
-	return &fileServiceImpl{
+func FileService() ExtendedFileService {
+	return FileSystemService(OSFileSystem())
+}
+
+/**
+Creates file service that opens and creates files in the file system.
+ */
+func FileSystemService(fsys FileSystem) ExtendedFileService {
+	t := &fileServiceImpl{
+		fsys: fsys,
 		bufferSize: DefaultBufferSize,
 		marshaler: runtime.JSONPb{
 			MarshalOptions: protojson.MarshalOptions{
@@ -31,7 +120,18 @@ func FileService() fs.FileService {
 				DiscardUnknown: true,
 			},
 		},
+		codecs: make(map[string]Codec),
+		csvDialect: DefaultCsvDialect,
+		repeatedSeparator: DefaultRepeatedSeparator,
+		jsonSampleSize: DefaultJsonSampleSize,
+		maxMessageSize: DefaultMaxMessageSize,
+		sortMemory: DefaultSortMemory,
+		maxOpenPartitions: DefaultMaxOpenPartitions,
+	}
+	for _, codec := range DefaultCodecs {
+		t.RegisterCodec(codec)
 	}
+	return t
 }
 
 func (t *fileServiceImpl) BufferSize() int {
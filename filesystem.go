@@ -0,0 +1,670 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+File system used by the file service. Read side is io/fs.FS, write side creates, renames and removes files.
+OS implementation accepts native paths, other implementations use slash separated paths valid for io/fs.
+ */
+type FileSystem interface {
+	iofs.FS
+
+	/*
+	Creates or truncates the file.
+	 */
+	Create(name string) (WritableFile, error)
+
+	/*
+	Creates new temp file in the directory, last '*' in pattern is replaced by random string.
+	 */
+	CreateTemp(dir, pattern string) (WritableFile, error)
+
+	/*
+	Renames file, replacing the target if it exists.
+	 */
+	Rename(oldName, newName string) error
+
+	/*
+	Removes file.
+	 */
+	Remove(name string) error
+
+	/*
+	Creates directory with all parents, does nothing if it exists or directories are implicit like in object storage.
+	 */
+	MkdirAll(name string) error
+}
+
+/**
+Optional capability of the file system, where created file appears on the path only after successful Close
+and Abort discards it, like the upload to object storage. Atomic files are created on the path directly
+on such file systems, without temp file and rename.
+ */
+type AtomicCreateFileSystem interface {
+
+	/*
+	Reports that the file created on the path is committed by Close.
+	 */
+	AtomicCreate(name string) bool
+}
+
+func atomicCreate(fsys FileSystem, name string) bool {
+	a, ok := fsys.(AtomicCreateFileSystem)
+	return ok && a.AtomicCreate(name)
+}
+
+/**
+Extension of the file service with access to the file system behind all file path operations.
+ */
+type FileSystemFileService interface {
+
+	/*
+	Gets file system used to open and create files.
+	 */
+	FileSystem() FileSystem
+}
+
+/**
+File opened for writing by the file system.
+ */
+type WritableFile interface {
+	io.WriteCloser
+
+	/*
+	Gets name of the file in the file system.
+	 */
+	Name() string
+
+	/*
+	Commits content of the file to the storage.
+	 */
+	Sync() error
+}
+
+func (t *fileServiceImpl) FileSystem() FileSystem {
+	return t.fsys
+}
+
+/**
+Creates the file, atomic file is created as sibling temp file that is renamed on commit.
+ */
+func (t *fileServiceImpl) createFile(filePath string, atomic bool) (WritableFile, error) {
+	if atomic {
+		return createAtomicFile(t.fsys, filePath)
+	}
+	fd, err := t.fsys.Create(filePath)
+	if err != nil {
+		return nil, errors.Errorf("file create error '%s', %v", filePath, err)
+	}
+	return fd, nil
+}
+
+type osFileSystem struct {
+}
+
+/**
+Returns file system of the operating system, used by default.
+ */
+func OSFileSystem() FileSystem {
+	return osFileSystem{}
+}
+
+func (osFileSystem) Open(name string) (iofs.File, error) {
+	return os.Open(name)
+}
+
+func (osFileSystem) Stat(name string) (iofs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFileSystem) ReadDir(name string) ([]iofs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (osFileSystem) Create(name string) (WritableFile, error) {
+	return os.Create(name)
+}
+
+func (osFileSystem) CreateTemp(dir, pattern string) (WritableFile, error) {
+	if dir == "" {
+		dir = "."
+	}
+	fd, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	if err := fd.Chmod(AtomicFileMode); err != nil {
+		fd.Close()
+		os.Remove(fd.Name())
+		return nil, err
+	}
+	return fd, nil
+}
+
+/**
+Renames the file and syncs the directory, so the new name survives the crash.
+ */
+func (osFileSystem) Rename(oldName, newName string) error {
+	if err := os.Rename(oldName, newName); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(newName))
+}
+
+func (osFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFileSystem) MkdirAll(name string) error {
+	return os.MkdirAll(name, DirectoryMode)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.Errorf("directory open error '%s', %v", dir, err)
+	}
+	err = d.Sync()
+	d.Close()
+	if err != nil {
+		return errors.Errorf("directory sync error '%s', %v", dir, err)
+	}
+	return nil
+}
+
+/**
+In-memory file system, directories exist implicitly as prefixes of file names.
+ */
+type memFileSystem struct {
+	sync.RWMutex
+	files   map[string]*memData
+	counter int
+}
+
+type memData struct {
+	sync.RWMutex
+	content []byte
+	modTime time.Time
+}
+
+/**
+Returns empty in-memory file system, safe for concurrent use.
+ */
+func MemFileSystem() FileSystem {
+	return &memFileSystem{ files: make(map[string]*memData) }
+}
+
+func (m *memFileSystem) Open(name string) (iofs.File, error) {
+	if !iofs.ValidPath(name) {
+		return nil, &iofs.PathError{ Op: "open", Path: name, Err: iofs.ErrInvalid }
+	}
+	m.RLock()
+	data, ok := m.files[name]
+	m.RUnlock()
+	if ok {
+		data.RLock()
+		defer data.RUnlock()
+		info := &memFileInfo{ name: path.Base(name), size: int64(len(data.content)), modTime: data.modTime }
+		return &memReadFile{ Reader: bytes.NewReader(data.content), info: info }, nil
+	}
+	entries, err := m.ReadDir(name)
+	if err != nil {
+		return nil, &iofs.PathError{ Op: "open", Path: name, Err: iofs.ErrNotExist }
+	}
+	return &memDirFile{ info: &memFileInfo{ name: path.Base(name), dir: true }, entries: entries }, nil
+}
+
+func (m *memFileSystem) Stat(name string) (iofs.FileInfo, error) {
+	f, err := m.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+func (m *memFileSystem) ReadDir(name string) ([]iofs.DirEntry, error) {
+	if !iofs.ValidPath(name) {
+		return nil, &iofs.PathError{ Op: "readdir", Path: name, Err: iofs.ErrInvalid }
+	}
+	prefix := name + "/"
+	if name == "." {
+		prefix = ""
+	}
+
+	m.RLock()
+	defer m.RUnlock()
+
+	children := make(map[string]iofs.DirEntry)
+	for fileName, data := range m.files {
+		if !strings.HasPrefix(fileName, prefix) {
+			continue
+		}
+		rest := fileName[len(prefix):]
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			children[rest[:i]] = iofs.FileInfoToDirEntry(&memFileInfo{ name: rest[:i], dir: true })
+		} else {
+			data.RLock()
+			children[rest] = iofs.FileInfoToDirEntry(&memFileInfo{ name: rest, size: int64(len(data.content)), modTime: data.modTime })
+			data.RUnlock()
+		}
+	}
+
+	if len(children) == 0 && name != "." {
+		if _, ok := m.files[name]; ok {
+			return nil, &iofs.PathError{ Op: "readdir", Path: name, Err: errors.New("not a directory") }
+		}
+		return nil, &iofs.PathError{ Op: "readdir", Path: name, Err: iofs.ErrNotExist }
+	}
+
+	list := make([]iofs.DirEntry, 0, len(children))
+	for _, entry := range children {
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list, nil
+}
+
+func (m *memFileSystem) Create(name string) (WritableFile, error) {
+	if !iofs.ValidPath(name) || name == "." {
+		return nil, &iofs.PathError{ Op: "create", Path: name, Err: iofs.ErrInvalid }
+	}
+	data := &memData{ modTime: time.Now() }
+	m.Lock()
+	m.files[name] = data
+	m.Unlock()
+	return &memWriteFile{ name: name, data: data }, nil
+}
+
+func (m *memFileSystem) CreateTemp(dir, pattern string) (WritableFile, error) {
+	if dir == "" {
+		dir = "."
+	}
+	m.Lock()
+	m.counter++
+	random := strconv.Itoa(m.counter)
+	m.Unlock()
+	name := pattern + random
+	if i := strings.LastIndexByte(pattern, '*'); i >= 0 {
+		name = pattern[:i] + random + pattern[i+1:]
+	}
+	return m.Create(path.Join(dir, name))
+}
+
+func (m *memFileSystem) Rename(oldName, newName string) error {
+	if !iofs.ValidPath(newName) || newName == "." {
+		return &iofs.PathError{ Op: "rename", Path: newName, Err: iofs.ErrInvalid }
+	}
+	m.Lock()
+	defer m.Unlock()
+	data, ok := m.files[oldName]
+	if !ok {
+		return &iofs.PathError{ Op: "rename", Path: oldName, Err: iofs.ErrNotExist }
+	}
+	delete(m.files, oldName)
+	m.files[newName] = data
+	return nil
+}
+
+func (m *memFileSystem) Remove(name string) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.files[name]; !ok {
+		return &iofs.PathError{ Op: "remove", Path: name, Err: iofs.ErrNotExist }
+	}
+	delete(m.files, name)
+	return nil
+}
+
+/**
+Directories of in-memory file system are implicit, only the path is checked.
+ */
+func (m *memFileSystem) MkdirAll(name string) error {
+	if !iofs.ValidPath(name) {
+		return &iofs.PathError{ Op: "mkdir", Path: name, Err: iofs.ErrInvalid }
+	}
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i *memFileInfo) Name() string { return i.name }
+func (i *memFileInfo) Size() int64 { return i.size }
+func (i *memFileInfo) ModTime() time.Time { return i.modTime }
+func (i *memFileInfo) IsDir() bool { return i.dir }
+func (i *memFileInfo) Sys() interface{} { return nil }
+
+func (i *memFileInfo) Mode() iofs.FileMode {
+	if i.dir {
+		return iofs.ModeDir | 0755
+	}
+	return AtomicFileMode
+}
+
+/**
+Snapshot of the file content taken on open.
+ */
+type memReadFile struct {
+	*bytes.Reader
+	info *memFileInfo
+}
+
+func (f *memReadFile) Stat() (iofs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *memReadFile) Close() error {
+	return nil
+}
+
+type memDirFile struct {
+	info    *memFileInfo
+	entries []iofs.DirEntry
+}
+
+func (f *memDirFile) Stat() (iofs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *memDirFile) Read([]byte) (int, error) {
+	return 0, &iofs.PathError{ Op: "read", Path: f.info.name, Err: errors.New("is a directory") }
+}
+
+func (f *memDirFile) Close() error {
+	return nil
+}
+
+func (f *memDirFile) ReadDir(n int) ([]iofs.DirEntry, error) {
+	if n <= 0 {
+		list := f.entries
+		f.entries = nil
+		return list, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(f.entries) {
+		n = len(f.entries)
+	}
+	list := f.entries[:n]
+	f.entries = f.entries[n:]
+	return list, nil
+}
+
+type memWriteFile struct {
+	name string
+	data *memData
+}
+
+func (f *memWriteFile) Name() string {
+	return f.name
+}
+
+func (f *memWriteFile) Write(p []byte) (int, error) {
+	f.data.Lock()
+	f.data.content = append(f.data.content, p...)
+	f.data.modTime = time.Now()
+	f.data.Unlock()
+	return len(p), nil
+}
+
+func (f *memWriteFile) Sync() error {
+	return nil
+}
+
+func (f *memWriteFile) Close() error {
+	return nil
+}
+
+/**
+File system confined to the directory of the parent file system, names are io/fs paths relative to the directory.
+ */
+type subFileSystem struct {
+	parent FileSystem
+	dir    string
+}
+
+/**
+Returns file system rooted in the directory of the parent, names escaping the directory are rejected.
+ */
+func SubFileSystem(parent FileSystem, dir string) FileSystem {
+	return &subFileSystem{ parent: parent, dir: dir }
+}
+
+func (s *subFileSystem) fullName(op, name string) (string, error) {
+	if !iofs.ValidPath(name) {
+		return "", &iofs.PathError{ Op: op, Path: name, Err: iofs.ErrInvalid }
+	}
+	if name == "." {
+		return s.dir, nil
+	}
+	return path.Join(s.dir, name), nil
+}
+
+func (s *subFileSystem) Open(name string) (iofs.File, error) {
+	full, err := s.fullName("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return s.parent.Open(full)
+}
+
+func (s *subFileSystem) Stat(name string) (iofs.FileInfo, error) {
+	full, err := s.fullName("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return iofs.Stat(s.parent, full)
+}
+
+func (s *subFileSystem) ReadDir(name string) ([]iofs.DirEntry, error) {
+	full, err := s.fullName("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	return iofs.ReadDir(s.parent, full)
+}
+
+func (s *subFileSystem) Create(name string) (WritableFile, error) {
+	full, err := s.fullName("create", name)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := s.parent.Create(full)
+	if err != nil {
+		return nil, err
+	}
+	return &subWritableFile{ WritableFile: fd, name: name, parent: s.parent }, nil
+}
+
+func (s *subFileSystem) CreateTemp(dir, pattern string) (WritableFile, error) {
+	if dir == "" {
+		dir = "."
+	}
+	full, err := s.fullName("createtemp", dir)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := s.parent.CreateTemp(full, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &subWritableFile{ WritableFile: fd, name: path.Join(dir, path.Base(filepath.ToSlash(fd.Name()))), parent: s.parent }, nil
+}
+
+func (s *subFileSystem) Rename(oldName, newName string) error {
+	oldFull, err := s.fullName("rename", oldName)
+	if err != nil {
+		return err
+	}
+	newFull, err := s.fullName("rename", newName)
+	if err != nil {
+		return err
+	}
+	return s.parent.Rename(oldFull, newFull)
+}
+
+func (s *subFileSystem) Remove(name string) error {
+	full, err := s.fullName("remove", name)
+	if err != nil {
+		return err
+	}
+	return s.parent.Remove(full)
+}
+
+func (s *subFileSystem) AtomicCreate(name string) bool {
+	full, err := s.fullName("create", name)
+	return err == nil && atomicCreate(s.parent, full)
+}
+
+func (s *subFileSystem) MkdirAll(name string) error {
+	full, err := s.fullName("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return s.parent.MkdirAll(full)
+}
+
+/**
+File of the parent file system with the name relative to the sub directory.
+ */
+type subWritableFile struct {
+	WritableFile
+	name   string
+	parent FileSystem
+}
+
+func (f *subWritableFile) Name() string {
+	return f.name
+}
+
+/**
+Keeps abort of the parent file, like cancel of the upload in object storage.
+ */
+func (f *subWritableFile) Abort() error {
+	return abortFile(f.parent, f.WritableFile)
+}
+
+/**
+File system that dispatches names with URL scheme like s3://bucket/key to the file system registered for the scheme.
+Names without scheme go to the local file system. Rename across file systems is not supported.
+ */
+type schemeFileSystem struct {
+	local   FileSystem
+	schemes map[string]FileSystem
+}
+
+/**
+Returns file system routing names by URL scheme, the registered file systems receive full names with scheme.
+ */
+func SchemeFileSystem(local FileSystem, schemes map[string]FileSystem) FileSystem {
+	return &schemeFileSystem{ local: local, schemes: schemes }
+}
+
+func (s *schemeFileSystem) route(op, name string) (FileSystem, error) {
+	i := strings.Index(name, "://")
+	if i <= 0 {
+		return s.local, nil
+	}
+	if fsys, ok := s.schemes[name[:i]]; ok {
+		return fsys, nil
+	}
+	return nil, &iofs.PathError{ Op: op, Path: name, Err: errors.Errorf("unsupported scheme '%s'", name[:i]) }
+}
+
+func (s *schemeFileSystem) Open(name string) (iofs.File, error) {
+	fsys, err := s.route("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return fsys.Open(name)
+}
+
+func (s *schemeFileSystem) Stat(name string) (iofs.FileInfo, error) {
+	fsys, err := s.route("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return iofs.Stat(fsys, name)
+}
+
+func (s *schemeFileSystem) ReadDir(name string) ([]iofs.DirEntry, error) {
+	fsys, err := s.route("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	return iofs.ReadDir(fsys, name)
+}
+
+func (s *schemeFileSystem) Create(name string) (WritableFile, error) {
+	fsys, err := s.route("create", name)
+	if err != nil {
+		return nil, err
+	}
+	return fsys.Create(name)
+}
+
+func (s *schemeFileSystem) CreateTemp(dir, pattern string) (WritableFile, error) {
+	fsys, err := s.route("createtemp", dir)
+	if err != nil {
+		return nil, err
+	}
+	return fsys.CreateTemp(dir, pattern)
+}
+
+func (s *schemeFileSystem) Rename(oldName, newName string) error {
+	fsys, err := s.route("rename", oldName)
+	if err != nil {
+		return err
+	}
+	if target, err := s.route("rename", newName); err != nil {
+		return err
+	} else if target != fsys {
+		return &iofs.PathError{ Op: "rename", Path: oldName, Err: errors.Errorf("rename to '%s' crosses file systems", newName) }
+	}
+	return fsys.Rename(oldName, newName)
+}
+
+func (s *schemeFileSystem) Remove(name string) error {
+	fsys, err := s.route("remove", name)
+	if err != nil {
+		return err
+	}
+	return fsys.Remove(name)
+}
+
+func (s *schemeFileSystem) AtomicCreate(name string) bool {
+	fsys, err := s.route("create", name)
+	return err == nil && atomicCreate(fsys, name)
+}
+
+func (s *schemeFileSystem) MkdirAll(name string) error {
+	fsys, err := s.route("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return fsys.MkdirAll(name)
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod_test
+
+import (
+	"fmt"
+	"github.com/sprintframework/fsmod"
+	"github.com/stretchr/testify/require"
+	iofs "io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemFileSystem(t *testing.T) {
+
+	mem := fsmod.MemFileSystem()
+	fs := fsmod.FileSystemService(mem)
+	fs.SetProtoIndexInterval(2)
+
+	writer, err := fs.NewAtomicProtoFile("data/domains.pb.gz")
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = writer.Write(&Domain{ Domain: fmt.Sprintf("obj%d", i) })
+		require.NoError(t, err)
+	}
+
+	// atomic file is not visible before commit
+	_, err = iofs.Stat(mem, "data/domains.pb.gz")
+	require.Error(t, err)
+	require.NoError(t, writer.Close())
+
+	names, err := iofs.Glob(mem, "data/*")
+	require.NoError(t, err)
+	require.Equal(t, []string{ "data/domains.pb.gz", "data/domains.pb.gz" + fsmod.ProtoIndexExtension }, names)
+
+	require.Equal(t, []string{ "obj0", "obj1", "obj2", "obj3", "obj4" }, readDomains(t, fs, "data/domains.pb.gz"))
+
+	seeker, err := fs.OpenProtoSeekFile("data/domains.pb.gz")
+	require.NoError(t, err)
+	require.NoError(t, seeker.SeekRecord(3))
+	var msg Domain
+	require.NoError(t, seeker.ReadTo(&msg))
+	require.Equal(t, "obj3", msg.Domain)
+	require.NoError(t, seeker.Close())
+
+	parts, err := fs.SplitProtoFile("data/domains.pb.gz", &msg, 2, func(i int) string {
+		return fmt.Sprintf("parts/part%d.pb", i)
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, len(parts))
+	require.NoError(t, fs.JoinProtoFiles("joined.pb", &msg, parts))
+	require.Equal(t, []string{ "obj0", "obj1", "obj2", "obj3", "obj4" }, readDomains(t, fs, "joined.pb"))
+
+	csv, err := fs.NewCsvFile("table.csv")
+	require.NoError(t, err)
+	require.NoError(t, csv.Write("name", "count"))
+	require.NoError(t, csv.Write("first", "1"))
+	require.NoError(t, csv.Close())
+
+	content, err := iofs.ReadFile(mem, "table.csv")
+	require.NoError(t, err)
+	require.Equal(t, "name,count\nfirst,1\n", string(content))
+
+	_, err = fs.OpenCsvFile("missing.csv")
+	require.Error(t, err)
+}
+
+func TestSubFileSystem(t *testing.T) {
+
+	dir, err := ioutil.TempDir(os.TempDir(), "sub-fs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fs := fsmod.FileSystemService(fsmod.SubFileSystem(fsmod.OSFileSystem(), dir))
+
+	writer, err := fs.NewAtomicJsonFile("tenant.json")
+	require.NoError(t, err)
+	require.NoError(t, writer.Write(map[string]string{ "name": "first" }))
+	require.NoError(t, writer.Close())
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "tenant.json"))
+	require.NoError(t, err)
+	require.Equal(t, "{\"name\":\"first\"}\n", string(content))
+
+	reader, err := fs.OpenJsonFile("tenant.json")
+	require.NoError(t, err)
+	holder := make(map[string]string)
+	require.NoError(t, reader.Read(&holder))
+	require.Equal(t, "first", holder["name"])
+	require.NoError(t, reader.Close())
+
+	// names escaping the directory are rejected
+	_, err = fs.NewJsonFile("../escape.json")
+	require.Error(t, err)
+	_, err = fs.OpenJsonFile("/etc/hosts")
+	require.Error(t, err)
+}
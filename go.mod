@@ -1,12 +1,17 @@
 module github.com/sprintframework/fsmod
 
-go 1.17
+go 1.23
 
 require (
+	github.com/dsnet/compress v0.0.1
+	github.com/golang/snappy v0.0.4
 	github.com/grpc-ecosystem/grpc-gateway/v2 v2.15.1
+	github.com/klauspost/compress v1.15.15
+	github.com/pierrec/lz4/v4 v4.1.17
 	github.com/pkg/errors v0.9.1
 	github.com/sprintframework/fs v1.0.2
 	github.com/stretchr/testify v1.8.2
+	github.com/ulikunitz/xz v0.5.11
 	google.golang.org/protobuf v1.28.1
 )
 
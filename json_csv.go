@@ -0,0 +1,384 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
+	"strings"
+)
+
+// default number of JSON lines used to discover CSV header
+var DefaultJsonSampleSize = 1000
+
+/**
+Extension of the file service that converts JSON Lines files to CSV files and back.
+Nested objects are flattened in to dotted column names, arrays are stored as JSON text in a single column.
+ */
+type JsonCsvFileService interface {
+
+	/*
+	Gets number of JSON lines used to discover CSV header, default value is DefaultJsonSampleSize.
+	 */
+	JsonSampleSize() int
+
+	/*
+	Sets number of JSON lines used to discover CSV header, columns first seen after the sample are dropped.
+	 */
+	SetJsonSampleSize(size int)
+
+	/*
+	Converts JSON Lines file in to CSV file with header discovered from the sample of lines.
+	 */
+	ConvertJsonToCsv(ctx context.Context, inputFilePath, outputFilePath string) error
+
+	/*
+	Converts CSV file with header in to JSON Lines file rebuilding nested objects from dotted column names.
+	Values that are valid JSON numbers, booleans, arrays or objects are written as is, empty values are omitted.
+	 */
+	ConvertCsvToJson(ctx context.Context, inputFilePath, outputFilePath string) error
+}
+
+type jsonColumn struct {
+	name  string
+	value string
+}
+
+func (t *fileServiceImpl) JsonSampleSize() int {
+	return t.jsonSampleSize
+}
+
+func (t *fileServiceImpl) SetJsonSampleSize(size int) {
+	t.jsonSampleSize = size
+}
+
+func (t *fileServiceImpl) ConvertJsonToCsv(ctx context.Context, inputFilePath, outputFilePath string) error {
+
+	reader, err := t.OpenJsonFile(inputFilePath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	var sample [][]jsonColumn
+	index := make(map[string]int)
+	var header []string
+
+	for len(sample) < t.jsonSampleSize {
+
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		var raw json.RawMessage
+		raw, err = reader.ReadRaw()
+		if err != nil {
+			break
+		}
+
+		var row []jsonColumn
+		row, err = flattenJson(raw)
+		if err != nil {
+			return errors.Errorf("convert file '%s', %v", inputFilePath, err)
+		}
+		if row == nil {
+			continue
+		}
+
+		for _, col := range row {
+			if _, ok := index[col.name]; !ok {
+				index[col.name] = len(header)
+				header = append(header, col.name)
+			}
+		}
+		sample = append(sample, row)
+	}
+
+	if err != nil && err != io.EOF {
+		return errors.Errorf("convert file '%s', %v", inputFilePath, err)
+	}
+
+	writer, err := t.NewAtomicCsvFile(outputFilePath)
+	if err != nil {
+		return err
+	}
+
+	err = writer.Write(header...)
+
+	for _, row := range sample {
+		if err != nil {
+			break
+		}
+		err = writer.Write(jsonColumnsRecord(index, row)...)
+	}
+
+	for err == nil {
+
+		if err = ctx.Err(); err != nil {
+			break
+		}
+
+		var raw json.RawMessage
+		raw, err = reader.ReadRaw()
+		if err != nil {
+			break
+		}
+
+		var row []jsonColumn
+		row, err = flattenJson(raw)
+		if err != nil {
+			err = errors.Errorf("convert file '%s', %v", inputFilePath, err)
+			break
+		}
+		if row == nil {
+			continue
+		}
+
+		err = writer.Write(jsonColumnsRecord(index, row)...)
+	}
+
+	if err == io.EOF {
+		err = nil
+	}
+
+	if err != nil {
+		writer.Abort()
+		return err
+	}
+
+	return writer.Close()
+}
+
+func jsonColumnsRecord(index map[string]int, row []jsonColumn) []string {
+	record := make([]string, len(index))
+	for _, col := range row {
+		if i, ok := index[col.name]; ok {
+			record[i] = col.value
+		}
+	}
+	return record
+}
+
+/**
+Flattens JSON object in to the list of columns keeping the order of keys, returns nil for empty line
+and empty list for empty object, that is the row of empty values.
+ */
+func flattenJson(raw []byte) ([]jsonColumn, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	if raw[0] != '{' {
+		return nil, errors.Errorf("expected JSON object, got '%s'", firstBytes(raw, 32))
+	}
+	list := []jsonColumn{}
+	err := appendJsonColumns(&list, "", raw)
+	return list, err
+}
+
+func appendJsonColumns(list *[]jsonColumn, prefix string, raw []byte) error {
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+
+	for dec.More() {
+
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		name := prefix + token.(string)
+
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return err
+		}
+
+		switch value[0] {
+		case '{':
+			if err := appendJsonColumns(list, name + ".", value); err != nil {
+				return err
+			}
+		case '"':
+			var s string
+			if err := json.Unmarshal(value, &s); err != nil {
+				return err
+			}
+			*list = append(*list, jsonColumn{ name, s })
+		case 'n':
+			*list = append(*list, jsonColumn{ name, "" })
+		case '[':
+			var buf bytes.Buffer
+			if err := json.Compact(&buf, value); err != nil {
+				return err
+			}
+			*list = append(*list, jsonColumn{ name, buf.String() })
+		default:
+			*list = append(*list, jsonColumn{ name, string(value) })
+		}
+	}
+
+	return nil
+}
+
+func firstBytes(b []byte, n int) []byte {
+	if len(b) > n {
+		return b[:n]
+	}
+	return b
+}
+
+/**
+Node of the nested JSON object rebuilt from dotted column names, keeps the order of columns.
+ */
+type jsonNode struct {
+	column   int // index of the column for leaf, -1 for object
+	keys     []string
+	children map[string]*jsonNode
+}
+
+func newJsonTree(header []string) (*jsonNode, error) {
+
+	root := &jsonNode{ column: -1, children: make(map[string]*jsonNode) }
+
+	for i, name := range header {
+		node := root
+		path := strings.Split(name, ".")
+		for j, key := range path {
+			if node.column >= 0 {
+				return nil, errors.Errorf("column '%s' conflicts with column '%s'", name, header[node.column])
+			}
+			child, ok := node.children[key]
+			if !ok {
+				child = &jsonNode{ column: -1, children: make(map[string]*jsonNode) }
+				node.children[key] = child
+				node.keys = append(node.keys, key)
+			}
+			if j == len(path) - 1 {
+				if child.column >= 0 || len(child.keys) > 0 {
+					return nil, errors.Errorf("duplicate or conflicting column '%s'", name)
+				}
+				child.column = i
+			}
+			node = child
+		}
+	}
+
+	return root, nil
+}
+
+/**
+Writes object with non-empty values, returns false if nothing was written.
+ */
+func (n *jsonNode) writeTo(buf *bytes.Buffer, record []string) bool {
+
+	start := buf.Len()
+	buf.WriteByte('{')
+	empty := true
+
+	for _, key := range n.keys {
+
+		child := n.children[key]
+		mark := buf.Len()
+		if !empty {
+			buf.WriteByte(',')
+		}
+		keyBin, _ := json.Marshal(key)
+		buf.Write(keyBin)
+		buf.WriteByte(':')
+
+		if child.column >= 0 {
+			if child.column >= len(record) || record[child.column] == "" {
+				buf.Truncate(mark)
+				continue
+			}
+			writeJsonValue(buf, record[child.column])
+		} else if !child.writeTo(buf, record) {
+			buf.Truncate(mark)
+			continue
+		}
+		empty = false
+	}
+
+	buf.WriteByte('}')
+	if empty && start > 0 {
+		buf.Truncate(start)
+		return false
+	}
+	return !empty
+}
+
+func writeJsonValue(buf *bytes.Buffer, value string) {
+	switch value[0] {
+	case '{', '[', 't', 'f', '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		if json.Valid([]byte(value)) {
+			buf.WriteString(value)
+			return
+		}
+	}
+	valueBin, _ := json.Marshal(value)
+	buf.Write(valueBin)
+}
+
+func (t *fileServiceImpl) ConvertCsvToJson(ctx context.Context, inputFilePath, outputFilePath string) error {
+
+	reader, err := t.OpenCsvFile(inputFilePath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	header, err := reader.Read()
+	if err != nil {
+		return errors.Errorf("can not read header in file '%s', %v", inputFilePath, err)
+	}
+
+	tree, err := newJsonTree(header)
+	if err != nil {
+		return errors.Errorf("convert file '%s', %v", inputFilePath, err)
+	}
+
+	writer, err := t.NewAtomicJsonFile(outputFilePath)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	for {
+
+		if err = ctx.Err(); err != nil {
+			break
+		}
+
+		var row []string
+		row, err = reader.Read()
+		if err != nil {
+			break
+		}
+
+		buf.Reset()
+		tree.writeTo(&buf, row)
+		if err = writer.WriteRaw(buf.Bytes()); err != nil {
+			break
+		}
+	}
+
+	if err == io.EOF {
+		err = nil
+	}
+
+	if err != nil {
+		writer.Abort()
+		return err
+	}
+
+	return writer.Close()
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod_test
+
+import (
+	"context"
+	"github.com/sprintframework/fsmod"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestJsonCsvConvert(t *testing.T) {
+
+	fs := fsmod.FileService()
+
+	fd, err := ioutil.TempFile(os.TempDir(), "json-csv-test")
+	require.NoError(t, err)
+	filePath := fd.Name()
+	fd.Close()
+	os.Remove(filePath)
+
+	jsonFilePath := filePath + ".json"
+	csvFilePath := filePath + ".csv.gz"
+	defer os.Remove(jsonFilePath)
+	defer os.Remove(csvFilePath)
+
+	lines := `{"name":"one","count":1,"tags":["a","b"],"address":{"city":"Paris","geo":{"lat":1.5}}}
+{"name":"two, \"quoted\"","count":2,"active":true,"address":{"city":"Rome"}}
+{"name":"three","note":null,"late":"dropped"}
+`
+	err = ioutil.WriteFile(jsonFilePath, []byte(lines), 0644)
+	require.NoError(t, err)
+
+	fs.SetJsonSampleSize(2)
+	err = fs.ConvertJsonToCsv(context.Background(), jsonFilePath, csvFilePath)
+	require.NoError(t, err)
+
+	reader, err := fs.OpenCsvFile(csvFilePath)
+	require.NoError(t, err)
+
+	var rows [][]string
+	for {
+		row, err := reader.Read()
+		if err != nil {
+			break
+		}
+		rows = append(rows, row)
+	}
+	require.NoError(t, reader.Close())
+
+	require.Equal(t, [][]string{
+		{ "name", "count", "tags", "address.city", "address.geo.lat", "active" },
+		{ "one", "1", `["a","b"]`, "Paris", "1.5", "" },
+		{ `two, "quoted"`, "2", "", "Rome", "", "true" },
+		{ "three", "", "", "", "", "" },
+	}, rows)
+
+	err = fs.ConvertCsvToJson(context.Background(), csvFilePath, jsonFilePath)
+	require.NoError(t, err)
+
+	content, err := ioutil.ReadFile(jsonFilePath)
+	require.NoError(t, err)
+
+	require.Equal(t, `{"name":"one","count":1,"tags":["a","b"],"address":{"city":"Paris","geo":{"lat":1.5}}}
+{"name":"two, \"quoted\"","count":2,"address":{"city":"Rome"},"active":true}
+{"name":"three"}
+`, string(content))
+}
+
+func TestJsonCsvEmptyObject(t *testing.T) {
+
+	mem := fsmod.MemFileSystem()
+	fs := fsmod.FileSystemService(mem)
+	fs.SetJsonSampleSize(2)
+
+	writePart(t, mem, "items.json", "{\"id\":\"1\",\"name\":\"one\"}\n{}\n\n{\"id\":\"2\"}\n{}\n")
+	require.NoError(t, fs.ConvertJsonToCsv(context.Background(), "items.json", "items.csv"))
+
+	// empty object is the row of empty values, blank line is skipped
+	require.Equal(t, [][]string{ { "id", "name" }, { "1", "one" }, { "", "" }, { "2", "" }, { "", "" } }, readCsvRows(t, fs, "items.csv"))
+}
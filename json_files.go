@@ -7,26 +7,54 @@ package fsmod
 
 import (
 	"bufio"
-	"compress/gzip"
+	"context"
 	"encoding/json"
 	"github.com/sprintframework/fs"
 	"github.com/pkg/errors"
 	"io"
 	"os"
-	"strings"
 )
 
 type jsonStreamWriter struct {
 	fs    *fileServiceImpl
 	fd    io.Writer
 	fw    *bufio.Writer
-	gzw   *gzip.Writer
+	cw    io.WriteCloser
 	bw    *bufio.Writer
 	w     io.Writer
 }
 
 func (t *fileServiceImpl) NewJsonStream(fd io.Writer, withGzip bool) fs.JsonWriter {
+	w, err := t.NewJsonCodecStream(fd, withGzipCodec(withGzip))
+	if err != nil {
+		// signature of the fs interface has no error, it is returned by the first call of the writer
+		return jsonFailedStream{ err: err }
+	}
+	return w
+}
+
+/**
+Writer of the stream that could not be created.
+ */
+type jsonFailedStream struct {
+	err error
+}
+
+func (w jsonFailedStream) WriteRaw(message json.RawMessage) error {
+	return w.err
+}
 
+func (w jsonFailedStream) Write(object interface{}) error {
+	return w.err
+}
+
+func (w jsonFailedStream) Close() error {
+	return w.err
+}
+
+func (t *fileServiceImpl) NewJsonCodecStream(fd io.Writer, codec Codec) (fs.JsonWriter, error) {
+
+	var err error
 	w := &jsonStreamWriter{
 		fs:              t,
 		fd:              fd,
@@ -34,24 +62,26 @@ func (t *fileServiceImpl) NewJsonStream(fd io.Writer, withGzip bool) fs.JsonWrit
 
 	w.fw = bufio.NewWriterSize(w.fd, t.bufferSize)
 
-	if withGzip {
-		w.gzw = gzip.NewWriter(w.fw)
-		w.bw = bufio.NewWriterSize(w.gzw, t.bufferSize)
+	if codec != nil {
+		w.cw, err = codec.NewWriter(w.fw)
+		if err != nil {
+			return nil, errors.Errorf("codec '%s' write error, %v", codec.Extension(), err)
+		}
+		w.bw = bufio.NewWriterSize(w.cw, t.bufferSize)
 		w.w = w.bw
 	} else {
 		w.w = w.fw
 	}
 
-	return w
+	return w, nil
 }
 
 func (w *jsonStreamWriter) Close() (err error) {
 	if w.bw != nil {
 		w.bw.Flush()
 	}
-	if w.gzw != nil {
-		w.gzw.Flush()
-		err = w.gzw.Close()
+	if w.cw != nil {
+		err = w.cw.Close()
 	}
 	w.fw.Flush()
 	return err
@@ -68,30 +98,54 @@ func (w *jsonStreamWriter) Write(object interface{}) error {
 
 type jsonFileWriter struct {
 	fs    *fileServiceImpl
-	fd    *os.File
+	fd    WritableFile
 	fw    *bufio.Writer
-	gzw   *gzip.Writer
+	cw    io.WriteCloser
 	bw    *bufio.Writer
 	w     io.Writer
+	atomicPath string
 }
 
 func (t *fileServiceImpl) NewJsonFile(filePath string) (fs.JsonWriter, error) {
+	w, err := t.newJsonFile(filePath, false)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (t *fileServiceImpl) NewAtomicJsonFile(filePath string) (AtomicJsonWriter, error) {
+	w, err := t.newJsonFile(filePath, true)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (t *fileServiceImpl) newJsonFile(filePath string, atomic bool) (*jsonFileWriter, error) {
 
 	var err error
 	w := &jsonFileWriter {
 		fs: t,
 	}
 
-	w.fd, err = os.Create(filePath)
+	w.fd, err = t.createFile(filePath, atomic)
 	if err != nil {
-		return nil, errors.Errorf("file create error '%s', %v", filePath, err)
+		return nil, err
+	}
+	if atomic {
+		w.atomicPath = filePath
 	}
 
 	w.fw = bufio.NewWriterSize(w.fd, t.bufferSize)
 
-	if strings.HasSuffix(filePath, ".gz") {
-		w.gzw = gzip.NewWriter(w.fw)
-		w.bw = bufio.NewWriterSize(w.gzw, t.bufferSize)
+	if codec := t.FileCodec(filePath); codec != nil {
+		w.cw, err = codec.NewWriter(w.fw)
+		if err != nil {
+			abortFile(w.fs.fsys, w.fd)
+			return nil, errors.Errorf("codec '%s' write error in '%s', %v", codec.Extension(), filePath, err)
+		}
+		w.bw = bufio.NewWriterSize(w.cw, t.bufferSize)
 		w.w = w.bw
 	} else {
 		w.w = w.fw
@@ -101,15 +155,26 @@ func (t *fileServiceImpl) NewJsonFile(filePath string) (fs.JsonWriter, error) {
 }
 
 func (w *jsonFileWriter) Close() error {
+	var err error
 	if w.bw != nil {
-		w.bw.Flush()
+		err = w.bw.Flush()
 	}
-	if w.gzw != nil {
-		w.gzw.Flush()
-		w.gzw.Close()
+	if w.cw != nil {
+		if closeErr := w.cw.Close(); err == nil {
+			err = closeErr
+		}
 	}
-	w.fw.Flush()
-	return w.fd.Close()
+	if flushErr := w.fw.Flush(); err == nil {
+		err = flushErr
+	}
+	return closeFile(w.fs.fsys, w.fd, w.atomicPath, err)
+}
+
+func (w *jsonFileWriter) Abort() error {
+	if w.cw != nil {
+		w.cw.Close()
+	}
+	return abortFile(w.fs.fsys, w.fd)
 }
 
 func (w *jsonFileWriter) WriteRaw(message json.RawMessage) error {
@@ -136,12 +201,16 @@ func jsonWrite(w io.Writer, fs *fileServiceImpl, object interface{}) error {
 type jsonStreamReader struct {
 	fs    *fileServiceImpl
 	fr    io.Reader
-	gzr   *gzip.Reader
+	cr    io.ReadCloser
 	r     *bufio.Reader
 	lastErr error
 }
 
 func (t *fileServiceImpl) JsonStream(fr io.Reader, withGzip bool) (fs.JsonReader, error) {
+	return t.JsonCodecStream(fr, withGzipCodec(withGzip))
+}
+
+func (t *fileServiceImpl) JsonCodecStream(fr io.Reader, codec Codec) (fs.JsonReader, error) {
 
 	var err error
 	r := &jsonStreamReader{
@@ -149,12 +218,12 @@ func (t *fileServiceImpl) JsonStream(fr io.Reader, withGzip bool) (fs.JsonReader
 		fr: fr,
 	}
 
-	if withGzip {
-		r.gzr, err = gzip.NewReader(r.fr)
+	if codec != nil {
+		r.cr, err = codec.NewReader(r.fr)
 		if err != nil {
-			return nil, errors.Errorf("gzip read error, %v", err)
+			return nil, errors.Errorf("codec '%s' read error, %v", codec.Extension(), err)
 		}
-		r.r = bufio.NewReader(r.gzr)
+		r.r = bufio.NewReader(r.cr)
 	} else {
 		r.r = bufio.NewReader(r.fr)
 	}
@@ -164,8 +233,8 @@ func (t *fileServiceImpl) JsonStream(fr io.Reader, withGzip bool) (fs.JsonReader
 }
 
 func (r *jsonStreamReader) Close() (err error) {
-	if r.gzr != nil {
-		err = r.gzr.Close()
+	if r.cr != nil {
+		err = r.cr.Close()
 	}
 	return err
 }
@@ -203,24 +272,28 @@ func (r *jsonStreamReader) Read(holder interface{}) error {
 
 type jsonFileReader struct {
 	fs   *fileServiceImpl
-	fd   *os.File
+	fd   io.ReadCloser
 	fr   *bufio.Reader
-	gzr  *gzip.Reader
+	cr   io.ReadCloser
 	r    *bufio.Reader
 	lastErr error
 }
 
 func (t *fileServiceImpl) OpenJsonFile(filePath string) (fs.JsonReader, error) {
 
-	fd, err := os.Open(filePath)
+	fd, err := t.fsys.Open(filePath)
 	if err != nil {
 		return nil, errors.Errorf("file open error '%s', %v", filePath, err)
 	}
 
-	return t.JsonFile(fd)
+	return t.jsonFile(filePath, fd)
 }
 
 func (t *fileServiceImpl) JsonFile(fd *os.File) (fs.JsonReader, error) {
+	return t.jsonFile(fd.Name(), fd)
+}
+
+func (t *fileServiceImpl) jsonFile(filePath string, fd io.ReadCloser) (fs.JsonReader, error) {
 
 	var err error
 	r := &jsonFileReader{
@@ -230,12 +303,12 @@ func (t *fileServiceImpl) JsonFile(fd *os.File) (fs.JsonReader, error) {
 
 	r.fr = bufio.NewReaderSize(r.fd, t.bufferSize)
 
-	if strings.HasSuffix(fd.Name(), ".gz") {
-		r.gzr, err = gzip.NewReader(r.fr)
+	if codec := t.detectCodec(filePath, r.fr); codec != nil {
+		r.cr, err = codec.NewReader(r.fr)
 		if err != nil {
-			return nil, errors.Errorf("gzip read error in '%s', %v", fd.Name(), err)
+			return nil, errors.Errorf("codec '%s' read error in '%s', %v", codec.Extension(), filePath, err)
 		}
-		r.r = bufio.NewReader(r.gzr)
+		r.r = bufio.NewReader(r.cr)
 	} else {
 		r.r = r.fr
 	}
@@ -245,8 +318,8 @@ func (t *fileServiceImpl) JsonFile(fd *os.File) (fs.JsonReader, error) {
 }
 
 func (r *jsonFileReader) Close() error {
-	if r.gzr != nil {
-		r.gzr.Close()
+	if r.cr != nil {
+		r.cr.Close()
 	}
 	return r.fd.Close()
 }
@@ -283,6 +356,21 @@ func (r *jsonFileReader) Read(holder interface{}) error {
 }
 
 func (t *fileServiceImpl) SplitJsonFile(inputFilePath string, limit int, partFn func (int) string) ([]string, error) {
+	return t.SplitJsonFileContext(context.Background(), inputFilePath, limit, partFn)
+}
+
+func (t *fileServiceImpl) SplitJsonFileContext(ctx context.Context, inputFilePath string, limit int, partFn func (int) string) ([]string, error) {
+	return splitParts(t.splitJsonFile(ctx, inputFilePath, limit, partFn))
+}
+
+/**
+Splits JSON file and counts split records.
+ */
+func (t *fileServiceImpl) splitJsonFile(ctx context.Context, inputFilePath string, limit int, partFn func (int) string) (*splitResult, error) {
+
+	if t.parallelism > 1 {
+		return t.parallelSplitJsonFile(ctx, inputFilePath, limit, partFn)
+	}
 
 	reader, err := t.OpenJsonFile(inputFilePath)
 	if err != nil {
@@ -291,23 +379,32 @@ func (t *fileServiceImpl) SplitJsonFile(inputFilePath string, limit int, partFn
 	defer reader.Close()
 
 	var parts []string
-	var writer fs.JsonWriter
+	var records int64
+	var writer AtomicJsonWriter
 
 	partNum := 1
 	for cnt := limit; err == nil; cnt++ {
 
-		raw, err := reader.ReadRaw()
+		if err = ctx.Err(); err != nil {
+			break
+		}
+
+		var raw json.RawMessage
+		raw, err = reader.ReadRaw()
 		if err != nil {
 			break
 		}
 
 		if cnt == limit {
 			if writer != nil {
-				writer.Close()
+				err = writer.Close()
 				writer = nil
+				if err != nil {
+					break
+				}
 			}
 			partFilePath := partFn(partNum)
-			writer, err = t.NewJsonFile(partFilePath)
+			writer, err = t.NewAtomicJsonFile(partFilePath)
 			if err != nil {
 				break
 			}
@@ -317,6 +414,7 @@ func (t *fileServiceImpl) SplitJsonFile(inputFilePath string, limit int, partFn
 		}
 
 		err = writer.WriteRaw(raw)
+		records++
 	}
 
 	if err == io.EOF {
@@ -324,20 +422,28 @@ func (t *fileServiceImpl) SplitJsonFile(inputFilePath string, limit int, partFn
 	}
 
 	if writer != nil {
-		writer.Close()
+		if err != nil {
+			writer.Abort()
+		} else {
+			err = writer.Close()
+		}
 	}
 
 	if err != nil {
 		for _, part := range parts {
-			os.Remove(part)
+			t.fsys.Remove(part)
 		}
-		parts = nil
+		return nil, err
 	}
 
-	return parts, err
+	return &splitResult{ parts: parts, records: records }, nil
 }
 
 func (t *fileServiceImpl) JoinJsonFiles(outputFilePath string, parts []string) error {
+	return t.JoinJsonFilesContext(context.Background(), outputFilePath, parts)
+}
+
+func (t *fileServiceImpl) JoinJsonFilesContext(ctx context.Context, outputFilePath string, parts []string) error {
 
 	writer, err := t.NewJsonFile(outputFilePath)
 	if err != nil {
@@ -345,6 +451,10 @@ func (t *fileServiceImpl) JoinJsonFiles(outputFilePath string, parts []string) e
 	}
 	defer writer.Close()
 
+	if t.parallelism > 1 {
+		return t.parallelJoinJsonFiles(ctx, writer, outputFilePath, parts)
+	}
+
 	for _, part := range parts {
 
 		reader, err := t.OpenJsonFile(part)
@@ -354,7 +464,13 @@ func (t *fileServiceImpl) JoinJsonFiles(outputFilePath string, parts []string) e
 
 		for {
 
-			raw, err := reader.ReadRaw()
+			if err = ctx.Err(); err != nil {
+				reader.Close()
+				return err
+			}
+
+			var raw json.RawMessage
+			raw, err = reader.ReadRaw()
 			if err != nil {
 				break
 			}
@@ -0,0 +1,706 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"hash"
+	"io"
+	iofs "io/fs"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	ManifestFormatCsv   = "csv"
+	ManifestFormatJson  = "json"
+	ManifestFormatProto = "proto"
+)
+
+// recommended extension of manifest files, skipped in directory datasets
+var SplitManifestExtension = ".manifest.json"
+
+const splitManifestVersion = 1
+
+/**
+Extension of the file service that describes split parts in the JSON manifest and verifies them on join.
+Relative part paths in the manifest are relative to the directory of the manifest.
+ */
+type ManifestFileService interface {
+
+	/*
+	Splits CSV file and writes manifest of the parts.
+	 */
+	SplitCsvFileManifest(ctx context.Context, inputFilePath string, limit int, partFn func (int) string, manifestPath string) ([]string, error)
+
+	/*
+	Splits JSON file and writes manifest of the parts.
+	 */
+	SplitJsonFileManifest(ctx context.Context, inputFilePath string, limit int, partFn func (int) string, manifestPath string) ([]string, error)
+
+	/*
+	Splits protofile and writes manifest of the parts, holder could be nil for files with descriptor header.
+	 */
+	SplitProtoFileManifest(ctx context.Context, inputFilePath string, holder proto.Message, limit int, partFn func (int) string, manifestPath string) ([]string, error)
+
+	/*
+	Reads existing part files of the format and writes manifest for them.
+	 */
+	WriteSplitManifest(manifestPath, format, source string, parts []string) (*SplitManifest, error)
+
+	/*
+	Reads manifest, part paths are resolved against the directory of the manifest.
+	 */
+	ReadSplitManifest(manifestPath string) (*SplitManifest, error)
+
+	/*
+	Reads all parts and checks sizes, checksums, record counts and headers against the manifest.
+	 */
+	VerifySplitManifest(ctx context.Context, manifestPath string) error
+
+	/*
+	Joins CSV parts of the manifest. Sizes are checked before joining and checksums during joining,
+	output file is removed if any part does not match.
+	 */
+	JoinCsvManifest(ctx context.Context, outputFilePath, manifestPath string) error
+
+	/*
+	Joins JSON parts of the manifest with the same checks as CSV.
+	 */
+	JoinJsonManifest(ctx context.Context, outputFilePath, manifestPath string) error
+
+	/*
+	Joins protofile parts of the manifest with the same checks as CSV, row could be nil for files with descriptor header.
+	 */
+	JoinProtoManifest(ctx context.Context, outputFilePath string, row proto.Message, manifestPath string) error
+}
+
+/**
+Manifest of split parts.
+ */
+type SplitManifest struct {
+	Version int            `json:"version"`
+	Format  string         `json:"format"`
+	Source  string         `json:"source,omitempty"`
+	Header  []string       `json:"header,omitempty"` // CSV header of the first part
+	Records int64          `json:"records"`
+	Size    int64          `json:"size"`
+	Parts   []ManifestPart `json:"parts"`
+}
+
+/**
+Part file in the manifest. Record count does not include CSV header.
+ */
+type ManifestPart struct {
+	Path    string   `json:"path"`
+	Records int64    `json:"records"`
+	Size    int64    `json:"size"`
+	Sha256  string   `json:"sha256"`
+	Header  []string `json:"header,omitempty"`
+}
+
+/**
+Gets resolved paths of all parts.
+ */
+func (m *SplitManifest) PartPaths() []string {
+	paths := make([]string, len(m.Parts))
+	for i, part := range m.Parts {
+		paths[i] = part.Path
+	}
+	return paths
+}
+
+func (t *fileServiceImpl) SplitCsvFileManifest(ctx context.Context, inputFilePath string, limit int, partFn func (int) string, manifestPath string) ([]string, error) {
+	v, hfs := t.withHashFileSystem()
+	res, err := v.splitCsvFile(ctx, inputFilePath, nil, limit, partFn)
+	if err != nil {
+		return nil, err
+	}
+	return t.writeSplitManifest(hfs, res, limit, manifestPath, ManifestFormatCsv, inputFilePath)
+}
+
+func (t *fileServiceImpl) SplitJsonFileManifest(ctx context.Context, inputFilePath string, limit int, partFn func (int) string, manifestPath string) ([]string, error) {
+	v, hfs := t.withHashFileSystem()
+	res, err := v.splitJsonFile(ctx, inputFilePath, limit, partFn)
+	if err != nil {
+		return nil, err
+	}
+	return t.writeSplitManifest(hfs, res, limit, manifestPath, ManifestFormatJson, inputFilePath)
+}
+
+func (t *fileServiceImpl) SplitProtoFileManifest(ctx context.Context, inputFilePath string, holder proto.Message, limit int, partFn func (int) string, manifestPath string) ([]string, error) {
+	v, hfs := t.withHashFileSystem()
+	res, err := v.splitProtoFile(ctx, inputFilePath, holder, limit, partFn)
+	if err != nil {
+		return nil, err
+	}
+	return t.writeSplitManifest(hfs, res, limit, manifestPath, ManifestFormatProto, inputFilePath)
+}
+
+/**
+Writes manifest of just split parts from sizes and checksums measured while the parts were written,
+parts are removed if manifest can not be written.
+ */
+func (t *fileServiceImpl) writeSplitManifest(hfs *hashFileSystem, res *splitResult, limit int, manifestPath, format, source string) ([]string, error) {
+
+	m := &SplitManifest{
+		Version: splitManifestVersion,
+		Format:  format,
+		Source:  source,
+		Header:  res.header,
+	}
+
+	var err error
+	for i, part := range res.parts {
+		var mp *ManifestPart
+		if mp, err = hfs.describe(part); err != nil {
+			break
+		}
+		// every part except the last one has exactly limit records
+		mp.Records = int64(limit)
+		if i == len(res.parts) - 1 {
+			mp.Records = res.records - int64(limit) * int64(i)
+		}
+		mp.Header = res.header
+		m.addPart(mp)
+	}
+
+	if err == nil {
+		err = t.storeSplitManifest(manifestPath, m)
+	}
+	if err != nil {
+		for _, part := range res.parts {
+			t.fsys.Remove(part)
+		}
+		return nil, err
+	}
+
+	return res.parts, nil
+}
+
+func (t *fileServiceImpl) WriteSplitManifest(manifestPath, format, source string, parts []string) (*SplitManifest, error) {
+
+	m := &SplitManifest{
+		Version: splitManifestVersion,
+		Format:  format,
+		Source:  source,
+	}
+
+	for _, part := range parts {
+		mp, err := t.describePart(format, part)
+		if err != nil {
+			return nil, err
+		}
+		if m.Header == nil {
+			m.Header = mp.Header
+		}
+		m.addPart(mp)
+	}
+
+	if err := t.storeSplitManifest(manifestPath, m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *SplitManifest) addPart(mp *ManifestPart) {
+	m.Records += mp.Records
+	m.Size += mp.Size
+	m.Parts = append(m.Parts, *mp)
+}
+
+/**
+Writes manifest with part paths relative to the manifest directory.
+ */
+func (t *fileServiceImpl) storeSplitManifest(manifestPath string, m *SplitManifest) error {
+
+	dir, _ := splitFilePath(manifestPath)
+	stored := *m
+	stored.Parts = make([]ManifestPart, len(m.Parts))
+	for i, mp := range m.Parts {
+		mp.Path = relativePartPath(dir, mp.Path)
+		stored.Parts[i] = mp
+	}
+
+	content, err := json.MarshalIndent(&stored, "", "  ")
+	if err != nil {
+		return errors.Errorf("manifest marshal error '%s', %v", manifestPath, err)
+	}
+
+	fd, err := createAtomicFile(t.fsys, manifestPath)
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(append(content, '\n'))
+	return closeFile(t.fsys, fd, manifestPath, err)
+}
+
+func (t *fileServiceImpl) ReadSplitManifest(manifestPath string) (*SplitManifest, error) {
+
+	content, err := iofs.ReadFile(t.fsys, manifestPath)
+	if err != nil {
+		return nil, errors.Errorf("manifest read error '%s', %v", manifestPath, err)
+	}
+
+	m := new(SplitManifest)
+	if err := json.Unmarshal(content, m); err != nil {
+		return nil, errors.Errorf("manifest unmarshal error '%s', %v", manifestPath, err)
+	}
+
+	if m.Version != splitManifestVersion {
+		return nil, errors.Errorf("unsupported manifest version %d in '%s'", m.Version, manifestPath)
+	}
+
+	dir, _ := splitFilePath(manifestPath)
+	for i := range m.Parts {
+		m.Parts[i].Path = resolvePartPath(dir, m.Parts[i].Path)
+	}
+
+	return m, nil
+}
+
+func (t *fileServiceImpl) VerifySplitManifest(ctx context.Context, manifestPath string) error {
+
+	m, err := t.ReadSplitManifest(manifestPath)
+	if err != nil {
+		return err
+	}
+
+	for _, expected := range m.Parts {
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		actual, err := t.describePart(m.Format, expected.Path)
+		if err != nil {
+			return err
+		}
+		if err := verifyPart(&expected, actual.Size, actual.Sha256); err != nil {
+			return err
+		}
+		if actual.Records != expected.Records {
+			return errors.Errorf("part '%s' has %d records, manifest has %d", expected.Path, actual.Records, expected.Records)
+		}
+		if !equalStrings(actual.Header, expected.Header) {
+			return errors.Errorf("part '%s' header %v differs from manifest %v", expected.Path, actual.Header, expected.Header)
+		}
+	}
+
+	return nil
+}
+
+func (t *fileServiceImpl) JoinCsvManifest(ctx context.Context, outputFilePath, manifestPath string) error {
+	return t.joinManifest(manifestPath, ManifestFormatCsv, outputFilePath, func(v *fileServiceImpl, parts []string) error {
+		return v.joinCsvFiles(ctx, outputFilePath, nil, parts)
+	})
+}
+
+func (t *fileServiceImpl) JoinJsonManifest(ctx context.Context, outputFilePath, manifestPath string) error {
+	return t.joinManifest(manifestPath, ManifestFormatJson, outputFilePath, func(v *fileServiceImpl, parts []string) error {
+		return v.JoinJsonFilesContext(ctx, outputFilePath, parts)
+	})
+}
+
+func (t *fileServiceImpl) JoinProtoManifest(ctx context.Context, outputFilePath string, row proto.Message, manifestPath string) error {
+	return t.joinManifest(manifestPath, ManifestFormatProto, outputFilePath, func(v *fileServiceImpl, parts []string) error {
+		// type is read from the header of the first part without the verifying file system, so the part is read once
+		messageType, err := t.partsMessageType(parts)
+		if err != nil {
+			return err
+		}
+		return v.joinProtoFiles(ctx, outputFilePath, row, messageType, parts)
+	})
+}
+
+/**
+Checks part sizes, then runs join through the file system that verifies checksums of parts while they are read.
+ */
+func (t *fileServiceImpl) joinManifest(manifestPath, format, outputFilePath string, join func(v *fileServiceImpl, parts []string) error) error {
+
+	m, err := t.ReadSplitManifest(manifestPath)
+	if err != nil {
+		return err
+	}
+
+	if m.Format != format {
+		return errors.Errorf("manifest '%s' has format '%s', expected '%s'", manifestPath, m.Format, format)
+	}
+
+	for _, part := range m.Parts {
+		info, err := iofs.Stat(t.fsys, part.Path)
+		if err != nil {
+			return errors.Errorf("part of manifest '%s' is not available, %v", manifestPath, err)
+		}
+		if info.Size() != part.Size {
+			return errors.Errorf("part '%s' size %d differs from manifest %d", part.Path, info.Size(), part.Size)
+		}
+	}
+
+	mfs := newManifestFileSystem(t.fsys, m.Parts)
+	v := *t
+	v.fsys = mfs
+
+	err = join(&v, m.PartPaths())
+	if verifyErr := mfs.verify(); verifyErr != nil {
+		err = verifyErr
+	}
+	if err != nil {
+		t.fsys.Remove(outputFilePath)
+		return err
+	}
+
+	return nil
+}
+
+/**
+Reads the part through the measuring file system and counts records in it.
+ */
+func (t *fileServiceImpl) describePart(format, partPath string) (*ManifestPart, error) {
+
+	mfs := newManifestFileSystem(t.fsys, nil)
+	v := *t
+	v.fsys = mfs
+
+	mp := &ManifestPart{ Path: partPath }
+
+	var err error
+	switch format {
+	case ManifestFormatCsv:
+		err = v.countCsvRecords(mp)
+	case ManifestFormatJson:
+		err = v.countJsonRecords(mp)
+	case ManifestFormatProto:
+		err = v.countProtoRecords(mp)
+	default:
+		return nil, errors.Errorf("unknown manifest format '%s'", format)
+	}
+	if err != nil {
+		return nil, errors.Errorf("manifest read part '%s', %v", partPath, err)
+	}
+
+	f, ok := mfs.files[partPath]
+	if !ok {
+		return nil, errors.Errorf("manifest part '%s' was not read", partPath)
+	}
+	if f.err != nil {
+		return nil, errors.Errorf("manifest read part '%s', %v", partPath, f.err)
+	}
+	mp.Size = f.size
+	mp.Sha256 = hex.EncodeToString(f.hash.Sum(nil))
+	return mp, nil
+}
+
+func (t *fileServiceImpl) countCsvRecords(mp *ManifestPart) error {
+	reader, err := t.OpenCsvFile(mp.Path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// record could be reused by reader
+	mp.Header = append([]string(nil), header...)
+
+	for {
+		if _, err = reader.Read(); err != nil {
+			break
+		}
+		mp.Records++
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+func (t *fileServiceImpl) countJsonRecords(mp *ManifestPart) error {
+	reader, err := t.OpenJsonFile(mp.Path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	for {
+		if _, err = reader.ReadRaw(); err != nil {
+			break
+		}
+		mp.Records++
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+func (t *fileServiceImpl) countProtoRecords(mp *ManifestPart) error {
+	reader, err := t.OpenProtoFile(mp.Path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	// any message could be parsed in to empty one with unknown fields
+	var holder emptypb.Empty
+	for {
+		if err = reader.ReadTo(&holder); err != nil {
+			break
+		}
+		mp.Records++
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+func verifyPart(expected *ManifestPart, size int64, sha string) error {
+	if size != expected.Size {
+		return errors.Errorf("part '%s' size %d differs from manifest %d", expected.Path, size, expected.Size)
+	}
+	if sha != expected.Sha256 {
+		return errors.Errorf("part '%s' checksum %s differs from manifest %s", expected.Path, sha, expected.Sha256)
+	}
+	return nil
+}
+
+/**
+Stores path relative to the manifest directory if the part is in it or local, paths with URL scheme are stored as is.
+ */
+func relativePartPath(dir, partPath string) string {
+	if dir == "." || strings.Contains(partPath, "://") {
+		return partPath
+	}
+	prefix := dir
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	if strings.HasPrefix(partPath, prefix) {
+		return partPath[len(prefix):]
+	}
+	if strings.Contains(dir, "://") || filepath.IsAbs(partPath) != filepath.IsAbs(dir) {
+		return partPath
+	}
+	if rel, err := filepath.Rel(dir, partPath); err == nil {
+		return filepath.ToSlash(rel)
+	}
+	return partPath
+}
+
+func resolvePartPath(dir, partPath string) string {
+	if dir == "." || strings.Contains(partPath, "://") || strings.HasPrefix(partPath, "/") || filepath.IsAbs(partPath) {
+		return partPath
+	}
+	if strings.Contains(dir, "://") {
+		return joinFilePath(dir, partPath)
+	}
+	return path.Clean(joinFilePath(filepath.ToSlash(dir), partPath))
+}
+
+/**
+File system that hashes and measures opened files, and compares them with expected parts on EOF.
+ */
+type manifestFileSystem struct {
+	FileSystem
+	sync.Mutex // parts could be opened by parallel join
+	parts    []ManifestPart
+	expected map[string]*ManifestPart // nil if parts are only measured
+	files    map[string]*manifestFile
+}
+
+func newManifestFileSystem(fsys FileSystem, parts []ManifestPart) *manifestFileSystem {
+	m := &manifestFileSystem{
+		FileSystem: fsys,
+		parts:      parts,
+		files:      make(map[string]*manifestFile),
+	}
+	if parts != nil {
+		m.expected = make(map[string]*ManifestPart)
+		for i := range parts {
+			m.expected[parts[i].Path] = &parts[i]
+		}
+	}
+	return m
+}
+
+func (m *manifestFileSystem) Open(name string) (iofs.File, error) {
+	fd, err := m.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	var expected *ManifestPart
+	if m.expected != nil {
+		var ok bool
+		if expected, ok = m.expected[name]; !ok {
+			return fd, nil
+		}
+	}
+	f := &manifestFile{ File: fd, hash: sha256.New(), expected: expected }
+	// the last reading of the file is the one that counts
+	m.Lock()
+	m.files[name] = f
+	m.Unlock()
+	return f, nil
+}
+
+/**
+Checks in order of the manifest that every expected part was read completely and matched the manifest.
+ */
+func (m *manifestFileSystem) verify() error {
+	for i := range m.parts {
+		expected := &m.parts[i]
+		f, ok := m.files[expected.Path]
+		if !ok {
+			return errors.Errorf("part '%s' of manifest was not read", expected.Path)
+		}
+		if f.err != nil {
+			return f.err
+		}
+		if !f.eof {
+			return errors.Errorf("part '%s' of manifest was not read completely", expected.Path)
+		}
+	}
+	return nil
+}
+
+type manifestFile struct {
+	iofs.File
+	hash     hash.Hash
+	size     int64
+	eof      bool
+	err      error
+	expected *ManifestPart
+}
+
+func (f *manifestFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.hash.Write(p[:n])
+	f.size += int64(n)
+	if err == io.EOF {
+		if !f.eof {
+			f.eof = true
+			if f.expected != nil {
+				f.err = verifyPart(f.expected, f.size, hex.EncodeToString(f.hash.Sum(nil)))
+			}
+		}
+		if f.err != nil {
+			return n, f.err
+		}
+	}
+	return n, err
+}
+
+/**
+Reads the rest of the file on close, so the checksum covers trailing bytes not needed by the reader.
+ */
+func (f *manifestFile) Close() error {
+	if !f.eof {
+		if _, err := io.Copy(ioutil.Discard, f); err != nil && f.err == nil {
+			f.err = err
+		}
+	}
+	return f.File.Close()
+}
+
+/**
+Copy of the file service that hashes and measures files created by it.
+ */
+func (t *fileServiceImpl) withHashFileSystem() (*fileServiceImpl, *hashFileSystem) {
+	hfs := &hashFileSystem{ FileSystem: t.fsys, files: make(map[string]*hashFile) }
+	v := *t
+	v.fsys = hfs
+	return &v, hfs
+}
+
+/**
+File system that hashes and measures written files, temporary files are tracked under the name they are renamed to.
+ */
+type hashFileSystem struct {
+	FileSystem
+	sync.Mutex // parts could be written by parallel split
+	files map[string]*hashFile
+}
+
+func (h *hashFileSystem) Create(name string) (WritableFile, error) {
+	fd, err := h.FileSystem.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return h.track(name, fd), nil
+}
+
+func (h *hashFileSystem) CreateTemp(dir, pattern string) (WritableFile, error) {
+	fd, err := h.FileSystem.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return h.track(fd.Name(), fd), nil
+}
+
+func (h *hashFileSystem) AtomicCreate(name string) bool {
+	return atomicCreate(h.FileSystem, name)
+}
+
+func (h *hashFileSystem) track(name string, fd WritableFile) *hashFile {
+	f := &hashFile{ sizeFile: &sizeFile{ WritableFile: fd, fsys: h.FileSystem }, hash: sha256.New() }
+	h.Lock()
+	h.files[name] = f
+	h.Unlock()
+	return f
+}
+
+func (h *hashFileSystem) Rename(oldName, newName string) error {
+	if err := h.FileSystem.Rename(oldName, newName); err != nil {
+		return err
+	}
+	h.Lock()
+	if f, ok := h.files[oldName]; ok {
+		delete(h.files, oldName)
+		h.files[newName] = f
+	}
+	h.Unlock()
+	return nil
+}
+
+/**
+Gets size and checksum of the written part.
+ */
+func (h *hashFileSystem) describe(partPath string) (*ManifestPart, error) {
+	h.Lock()
+	f, ok := h.files[partPath]
+	h.Unlock()
+	if !ok {
+		return nil, errors.Errorf("manifest part '%s' was not written", partPath)
+	}
+	return &ManifestPart{ Path: partPath, Size: f.n, Sha256: hex.EncodeToString(f.hash.Sum(nil)) }, nil
+}
+
+type hashFile struct {
+	*sizeFile
+	hash hash.Hash
+}
+
+func (f *hashFile) Write(p []byte) (int, error) {
+	n, err := f.sizeFile.Write(p)
+	f.hash.Write(p[:n])
+	return n, err
+}
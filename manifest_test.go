@@ -0,0 +1,249 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sprintframework/fsmod"
+	"github.com/stretchr/testify/require"
+	iofs "io/fs"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCsvManifest(t *testing.T) {
+
+	mem := fsmod.MemFileSystem()
+	fs := fsmod.FileSystemService(mem)
+	ctx := context.Background()
+
+	csv, err := fs.NewCsvFile("table.csv")
+	require.NoError(t, err)
+	require.NoError(t, csv.Write("name", "count"))
+	for i := 0; i < 5; i++ {
+		require.NoError(t, csv.Write(fmt.Sprintf("name%d", i), strconv.Itoa(i)))
+	}
+	require.NoError(t, csv.Close())
+
+	manifestPath := "parts/table" + fsmod.SplitManifestExtension
+	parts, err := fs.SplitCsvFileManifest(ctx, "table.csv", 2, func(i int) string {
+		return fmt.Sprintf("parts/part%d.csv", i)
+	}, manifestPath)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(parts))
+
+	// paths are stored relative to the manifest
+	content, err := iofs.ReadFile(mem, manifestPath)
+	require.NoError(t, err)
+	var stored fsmod.SplitManifest
+	require.NoError(t, json.Unmarshal(content, &stored))
+	require.Equal(t, "part1.csv", stored.Parts[0].Path)
+
+	m, err := fs.ReadSplitManifest(manifestPath)
+	require.NoError(t, err)
+	require.Equal(t, fsmod.ManifestFormatCsv, m.Format)
+	require.Equal(t, parts, m.PartPaths())
+	require.Equal(t, int64(5), m.Records)
+	require.Equal(t, []string{ "name", "count" }, m.Header)
+	require.Equal(t, int64(1), m.Parts[2].Records)
+	require.Equal(t, int64(len("name,count\nname4,4\n")), m.Parts[2].Size)
+	require.NoError(t, fs.VerifySplitManifest(ctx, manifestPath))
+
+	// manifest is not a part of the dataset
+	list, err := fs.DatasetParts("parts")
+	require.NoError(t, err)
+	require.Equal(t, parts, list)
+
+	require.NoError(t, fs.JoinCsvManifest(ctx, "joined.csv", manifestPath))
+	original, err := iofs.ReadFile(mem, "table.csv")
+	require.NoError(t, err)
+	joined, err := iofs.ReadFile(mem, "joined.csv")
+	require.NoError(t, err)
+	require.Equal(t, original, joined)
+
+	// corrupted part of the same size is detected by checksum and output is removed
+	writePart(t, mem, "parts/part2.csv", "name,count\nname2,2\nname3,9\n")
+	require.Error(t, fs.VerifySplitManifest(ctx, manifestPath))
+	err = fs.JoinCsvManifest(ctx, "broken.csv", manifestPath)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "checksum")
+	_, err = iofs.Stat(mem, "broken.csv")
+	require.Error(t, err)
+
+	// truncated part is detected before joining
+	writePart(t, mem, "parts/part2.csv", "name,count\nname2,2\n")
+	err = fs.JoinCsvManifest(ctx, "broken.csv", manifestPath)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "size")
+
+	require.Error(t, fs.JoinJsonManifest(ctx, "broken.json", manifestPath))
+}
+
+func TestProtoManifest(t *testing.T) {
+
+	mem := fsmod.MemFileSystem()
+	fs := fsmod.FileSystemService(mem)
+	ctx := context.Background()
+
+	writer, err := fs.NewProtoFile("domains.pb.gz")
+	require.NoError(t, err)
+	for i := 0; i < 7; i++ {
+		_, err = writer.Write(&Domain{ Domain: fmt.Sprintf("obj%d", i) })
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Close())
+
+	var msg Domain
+	parts, err := fs.SplitProtoFileManifest(ctx, "domains.pb.gz", &msg, 3, func(i int) string {
+		return fmt.Sprintf("parts/part%d.pb.gz", i)
+	}, "domains" + fsmod.SplitManifestExtension)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(parts))
+
+	m, err := fs.ReadSplitManifest("domains" + fsmod.SplitManifestExtension)
+	require.NoError(t, err)
+	require.Equal(t, int64(7), m.Records)
+	require.Equal(t, int64(3), m.Parts[0].Records)
+	require.Equal(t, 64, len(m.Parts[0].Sha256))
+
+	require.NoError(t, fs.JoinProtoManifest(ctx, "joined.pb", &msg, "domains" + fsmod.SplitManifestExtension))
+	require.Equal(t, readDomains(t, fs, "domains.pb.gz"), readDomains(t, fs, "joined.pb"))
+}
+
+func TestManifestSinglePass(t *testing.T) {
+
+	fsys := &readCounter{ FileSystem: fsmod.MemFileSystem(), read: make(map[string]int64) }
+	fs := fsmod.FileSystemService(fsys)
+	ctx := context.Background()
+
+	writer, err := fs.NewDescribedProtoFile("domains.pb", (&Domain{}).ProtoReflect().Descriptor())
+	require.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		_, err = writer.Write(&Domain{ Domain: fmt.Sprintf("obj%d", i), Zone: strings.Repeat("z", 500) })
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Close())
+
+	manifestPath := "domains" + fsmod.SplitManifestExtension
+	for _, parallelism := range []int{ 1, 4 } {
+
+		fs.SetParallelism(parallelism)
+		fsys.reset()
+		parts, err := fs.SplitProtoFileManifest(ctx, "domains.pb", nil, 400, func(i int) string {
+			return fmt.Sprintf("parts/part%d.pb", i)
+		}, manifestPath)
+		require.NoError(t, err)
+		require.Equal(t, 3, len(parts))
+
+		// parts are described while written, not read back
+		for _, part := range parts {
+			require.Equal(t, int64(0), fsys.bytesRead(part), part)
+		}
+
+		m, err := fs.ReadSplitManifest(manifestPath)
+		require.NoError(t, err)
+		require.Equal(t, []int64{ 400, 400, 200 }, []int64{ m.Parts[0].Records, m.Parts[1].Records, m.Parts[2].Records })
+		require.NoError(t, fs.VerifySplitManifest(ctx, manifestPath))
+
+		described, err := fs.WriteSplitManifest("described" + fsmod.SplitManifestExtension, fsmod.ManifestFormatProto, "domains.pb", parts)
+		require.NoError(t, err)
+		require.Equal(t, described.Parts, m.Parts)
+	}
+
+	// type of the rows is taken from the header of the first part without reading the whole part twice
+	fsys.reset()
+	require.NoError(t, fs.JoinProtoManifest(ctx, "joined.pb", nil, manifestPath))
+	info, err := iofs.Stat(fsys, "parts/part1.pb")
+	require.NoError(t, err)
+	require.True(t, fsys.bytesRead("parts/part1.pb") < 2 * info.Size(), fsys.bytesRead("parts/part1.pb"))
+	require.Equal(t, readDomains(t, fs, "domains.pb"), readDomains(t, fs, "joined.pb"))
+}
+
+/**
+File system that counts bytes read from opened files.
+ */
+type readCounter struct {
+	fsmod.FileSystem
+	sync.Mutex
+	read map[string]int64
+}
+
+func (r *readCounter) Open(name string) (iofs.File, error) {
+	fd, err := r.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &countedFile{ File: fd, name: name, counter: r }, nil
+}
+
+func (r *readCounter) reset() {
+	r.Lock()
+	r.read = make(map[string]int64)
+	r.Unlock()
+}
+
+func (r *readCounter) bytesRead(name string) int64 {
+	r.Lock()
+	defer r.Unlock()
+	return r.read[name]
+}
+
+type countedFile struct {
+	iofs.File
+	name    string
+	counter *readCounter
+}
+
+func (f *countedFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.counter.Lock()
+	f.counter.read[f.name] += int64(n)
+	f.counter.Unlock()
+	return n, err
+}
+
+func TestJsonManifest(t *testing.T) {
+
+	fs := fsmod.FileSystemService(fsmod.MemFileSystem())
+	ctx := context.Background()
+
+	writer, err := fs.NewJsonFile("items.json")
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		require.NoError(t, writer.Write(map[string]int{ "id": i }))
+	}
+	require.NoError(t, writer.Close())
+
+	parts, err := fs.SplitJsonFileManifest(ctx, "items.json", 3, func(i int) string {
+		return fmt.Sprintf("out/items%d.json", i)
+	}, "out/items" + fsmod.SplitManifestExtension)
+	require.NoError(t, err)
+	require.Equal(t, []string{ "out/items1.json", "out/items2.json" }, parts)
+
+	require.NoError(t, fs.VerifySplitManifest(ctx, "out/items" + fsmod.SplitManifestExtension))
+	require.NoError(t, fs.JoinJsonManifest(ctx, "joined.json", "out/items" + fsmod.SplitManifestExtension))
+
+	reader, err := fs.OpenJsonFile("joined.json")
+	require.NoError(t, err)
+	defer reader.Close()
+	for i := 0; i < 4; i++ {
+		holder := make(map[string]int)
+		require.NoError(t, reader.Read(&holder))
+		require.Equal(t, i, holder["id"])
+	}
+}
+
+func writePart(t *testing.T, fsys fsmod.FileSystem, name, content string) {
+	fd, err := fsys.Create(name)
+	require.NoError(t, err)
+	_, err = fd.Write([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, fd.Close())
+}
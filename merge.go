@@ -0,0 +1,283 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+/**
+Collapses two CSV rows with equal keys in to one.
+ */
+type CsvReducer func(a, b []string) ([]string, error)
+
+/**
+Collapses two JSON records with equal keys in to one.
+ */
+type JsonReducer func(a, b json.RawMessage) (json.RawMessage, error)
+
+/**
+Collapses two messages with equal keys in to one.
+ */
+type ProtoReducer func(a, b proto.Message) (proto.Message, error)
+
+/**
+Extension of the file service that merges parts sorted by the same keys in to one sorted file in a single pass.
+Records with equal keys are taken in order of parts, reducer is optional and folds them in to one record.
+Merge fails if any part is not sorted, output file is written atomically.
+ */
+type MergeFileService interface {
+
+	/*
+	Merges sorted CSV parts, headers of all parts must be the same.
+	 */
+	MergeSortedCsvFiles(ctx context.Context, outputFilePath string, parts []string, keys []SortKey, reduce CsvReducer) error
+
+	/*
+	Merges JSON parts sorted by values of JSON paths.
+	 */
+	MergeSortedJsonFiles(ctx context.Context, outputFilePath string, parts []string, keys []SortKey, reduce JsonReducer) error
+
+	/*
+	Merges protofile parts sorted by comparator, row could be nil for files with descriptor header.
+	 */
+	MergeSortedProtoFiles(ctx context.Context, outputFilePath string, row proto.Message, parts []string, compare func(a, b proto.Message) int, reduce ProtoReducer) error
+}
+
+/**
+Merges inputs, checks order of the merged records and folds records with equal keys.
+ */
+func mergeSorted[R any](ctx context.Context, inputs []*mergeInput[R], compare func(a, b R) int, reduce func(a, b R) (R, error), write func(R) error) error {
+
+	var pending R
+	hasPending := false
+
+	err := mergeInputs(ctx, inputs, compare, func(record R) error {
+		if !hasPending {
+			pending, hasPending = record, true
+			return nil
+		}
+		c := compare(pending, record)
+		if c > 0 {
+			return errors.New("parts are not sorted by the keys")
+		}
+		if c == 0 && reduce != nil {
+			var err error
+			pending, err = reduce(pending, record)
+			return err
+		}
+		if err := write(pending); err != nil {
+			return err
+		}
+		pending = record
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if hasPending {
+		return write(pending)
+	}
+	return nil
+}
+
+func closeInputs[R any](inputs []*mergeInput[R]) {
+	for _, in := range inputs {
+		in.close()
+	}
+}
+
+func (t *fileServiceImpl) MergeSortedCsvFiles(ctx context.Context, outputFilePath string, parts []string, keys []SortKey, reduce CsvReducer) error {
+
+	var header []string
+	var columns []int // known after headers of all parts are read
+	var inputs []*mergeInput[*csvSortRecord]
+	defer func() { closeInputs(inputs) }()
+
+	for _, part := range parts {
+		reader, err := t.OpenCsvFile(part)
+		if err != nil {
+			return errors.Errorf("can not open file '%s', %v", part, err)
+		}
+		inputs = append(inputs, &mergeInput[*csvSortRecord]{
+			name: part,
+			read: func() (*csvSortRecord, error) {
+				row, err := reader.Read()
+				if err != nil {
+					return nil, err
+				}
+				// record could be reused by reader
+				return csvSortKeys(append([]string(nil), row...), columns), nil
+			},
+			close: reader.Close,
+		})
+
+		partHeader, err := reader.Read()
+		if err != nil {
+			return errors.Errorf("can not read header in file '%s', %v", part, err)
+		}
+		if header == nil {
+			header = append([]string(nil), partHeader...)
+		} else if !equalStrings(header, partHeader) {
+			return errors.Errorf("part '%s' header %v differs from %v", part, partHeader, header)
+		}
+	}
+
+	columns, err := csvSortColumns(header, keys)
+	if err != nil {
+		return errors.Errorf("merge file '%s', %v", outputFilePath, err)
+	}
+
+	var reduceRecords func(a, b *csvSortRecord) (*csvSortRecord, error)
+	if reduce != nil {
+		reduceRecords = func(a, b *csvSortRecord) (*csvSortRecord, error) {
+			row, err := reduce(a.row, b.row)
+			if err != nil {
+				return nil, err
+			}
+			// keys of the reduced record stay the same
+			return &csvSortRecord{ row: row, keys: a.keys }, nil
+		}
+	}
+
+	writer, err := t.newCsvFile(outputFilePath, true, t.FileDialect(outputFilePath), nil)
+	if err != nil {
+		return err
+	}
+	if header != nil {
+		err = writer.Write(header...)
+	}
+	if err == nil {
+		err = mergeSorted(ctx, inputs, func(a, b *csvSortRecord) int {
+			return compareKeys(keys, a.keys, b.keys)
+		}, reduceRecords, func(record *csvSortRecord) error {
+			return writer.Write(record.row...)
+		})
+	}
+
+	if err != nil {
+		writer.Abort()
+		return errors.Errorf("merge file '%s', %v", outputFilePath, err)
+	}
+	return writer.Close()
+}
+
+func (t *fileServiceImpl) MergeSortedJsonFiles(ctx context.Context, outputFilePath string, parts []string, keys []SortKey, reduce JsonReducer) error {
+
+	paths := jsonSortPaths(keys)
+	var inputs []*mergeInput[*jsonSortRecord]
+	defer func() { closeInputs(inputs) }()
+
+	for _, part := range parts {
+		reader, err := t.OpenJsonFile(part)
+		if err != nil {
+			return errors.Errorf("can not open file '%s', %v", part, err)
+		}
+		inputs = append(inputs, &mergeInput[*jsonSortRecord]{
+			name: part,
+			read: func() (*jsonSortRecord, error) {
+				raw, err := reader.ReadRaw()
+				if err != nil {
+					return nil, err
+				}
+				return jsonSortKeys(raw, paths)
+			},
+			close: reader.Close,
+		})
+	}
+
+	var reduceRecords func(a, b *jsonSortRecord) (*jsonSortRecord, error)
+	if reduce != nil {
+		reduceRecords = func(a, b *jsonSortRecord) (*jsonSortRecord, error) {
+			raw, err := reduce(a.raw, b.raw)
+			if err != nil {
+				return nil, err
+			}
+			// keys of the reduced record stay the same
+			return &jsonSortRecord{ raw: raw, keys: a.keys }, nil
+		}
+	}
+
+	writer, err := t.newJsonFile(outputFilePath, true)
+	if err != nil {
+		return err
+	}
+
+	err = mergeSorted(ctx, inputs, func(a, b *jsonSortRecord) int {
+		return compareKeys(keys, a.keys, b.keys)
+	}, reduceRecords, func(record *jsonSortRecord) error {
+		return writer.WriteRaw(record.raw)
+	})
+
+	if err != nil {
+		writer.Abort()
+		return errors.Errorf("merge file '%s', %v", outputFilePath, err)
+	}
+	return writer.Close()
+}
+
+func (t *fileServiceImpl) MergeSortedProtoFiles(ctx context.Context, outputFilePath string, row proto.Message, parts []string, compare func(a, b proto.Message) int, reduce ProtoReducer) error {
+
+	var messageType protoreflect.MessageType
+	var readers []*protoFileReader
+	defer func() {
+		for _, reader := range readers {
+			reader.Close()
+		}
+	}()
+
+	for i, part := range parts {
+		reader, err := t.openProtoFile(part)
+		if err != nil {
+			return errors.Errorf("can not open file '%s', %v", part, err)
+		}
+		readers = append(readers, reader)
+		if i == 0 {
+			messageType = reader.messageType
+		}
+	}
+
+	if row == nil {
+		if messageType == nil {
+			return errors.Errorf("row is required for files without descriptor header")
+		}
+		row = messageType.New().Interface()
+	}
+
+	inputs := make([]*mergeInput[proto.Message], len(readers))
+	for i, reader := range readers {
+		inputs[i] = &mergeInput[proto.Message]{
+			name: parts[i],
+			read: func() (proto.Message, error) {
+				message := row.ProtoReflect().New().Interface()
+				return message, reader.ReadTo(message)
+			},
+			// readers are closed above
+			close: func() error { return nil },
+		}
+	}
+
+	writer, err := t.newProtoFile(outputFilePath, true, describe(messageType))
+	if err != nil {
+		return err
+	}
+
+	err = mergeSorted(ctx, inputs, compare, reduce, func(message proto.Message) error {
+		_, err := writer.Write(message)
+		return err
+	})
+
+	if err != nil {
+		writer.Abort()
+		return errors.Errorf("merge file '%s', %v", outputFilePath, err)
+	}
+	return writer.Close()
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sprintframework/fsmod"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMergeSortedCsvFiles(t *testing.T) {
+
+	fs := fsmod.FileSystemService(fsmod.MemFileSystem())
+	ctx := context.Background()
+
+	// shards of word counts sorted by word
+	writeCsvRows(t, fs, "shard1.csv", [][]string{ { "word", "count" }, { "apple", "1" }, { "cherry", "2" }, { "plum", "1" } })
+	writeCsvRows(t, fs, "shard2.csv", [][]string{ { "word", "count" }, { "banana", "3" }, { "cherry", "5" } })
+	writeCsvRows(t, fs, "shard3.csv", [][]string{ { "word", "count" } })
+	parts := []string{ "shard1.csv", "shard2.csv", "shard3.csv" }
+	keys := []fsmod.SortKey{ { Name: "word" } }
+
+	require.NoError(t, fs.MergeSortedCsvFiles(ctx, "merged.csv", parts, keys, nil))
+	require.Equal(t, [][]string{ { "word", "count" }, { "apple", "1" }, { "banana", "3" }, { "cherry", "2" }, { "cherry", "5" }, { "plum", "1" } },
+		readCsvRows(t, fs, "merged.csv"))
+
+	require.NoError(t, fs.MergeSortedCsvFiles(ctx, "reduced.csv", parts, keys, func(a, b []string) ([]string, error) {
+		x, _ := strconv.Atoi(a[1])
+		y, _ := strconv.Atoi(b[1])
+		return []string{ a[0], strconv.Itoa(x + y) }, nil
+	}))
+	require.Equal(t, [][]string{ { "word", "count" }, { "apple", "1" }, { "banana", "3" }, { "cherry", "7" }, { "plum", "1" } },
+		readCsvRows(t, fs, "reduced.csv"))
+
+	// unsorted part fails the merge
+	writeCsvRows(t, fs, "unsorted.csv", [][]string{ { "word", "count" }, { "zebra", "1" }, { "ant", "1" } })
+	require.Error(t, fs.MergeSortedCsvFiles(ctx, "broken.csv", []string{ "shard1.csv", "unsorted.csv" }, keys, nil))
+	_, err := fs.OpenCsvFile("broken.csv")
+	require.Error(t, err)
+
+	writeCsvRows(t, fs, "other.csv", [][]string{ { "word", "total" } })
+	require.Error(t, fs.MergeSortedCsvFiles(ctx, "broken.csv", []string{ "shard1.csv", "other.csv" }, keys, nil))
+}
+
+func TestMergeSortedJsonFiles(t *testing.T) {
+
+	fs := fsmod.FileSystemService(fsmod.MemFileSystem())
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		writer, err := fs.NewJsonFile(fmt.Sprintf("part%d.json", i))
+		require.NoError(t, err)
+		for j := i; j < 30; j += 3 {
+			require.NoError(t, writer.Write(map[string]int{ "id": j }))
+		}
+		require.NoError(t, writer.Close())
+	}
+
+	keys := []fsmod.SortKey{ { Name: "id", Compare: fsmod.CompareNumbers } }
+	require.NoError(t, fs.MergeSortedJsonFiles(ctx, "merged.json", []string{ "part0.json", "part1.json", "part2.json" }, keys, nil))
+
+	reader, err := fs.OpenJsonFile("merged.json")
+	require.NoError(t, err)
+	defer reader.Close()
+	for i := 0; i < 30; i++ {
+		holder := make(map[string]int)
+		require.NoError(t, reader.Read(&holder))
+		require.Equal(t, i, holder["id"])
+	}
+	_, err = reader.ReadRaw()
+	require.Equal(t, io.EOF, err)
+
+	// the same part twice is collapsed by reducer
+	require.NoError(t, fs.MergeSortedJsonFiles(ctx, "reduced.json", []string{ "part0.json", "part0.json" }, keys, func(a, b json.RawMessage) (json.RawMessage, error) {
+		return a, nil
+	}))
+	reduced, err := fs.OpenJsonFile("reduced.json")
+	require.NoError(t, err)
+	defer reduced.Close()
+	count := 0
+	for {
+		if _, err = reduced.ReadRaw(); err != nil {
+			break
+		}
+		count++
+	}
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, 10, count)
+}
+
+func TestMergeSortedProtoFiles(t *testing.T) {
+
+	fs := fsmod.FileSystemService(fsmod.MemFileSystem())
+
+	var parts []string
+	for i := 0; i < 4; i++ {
+		part := fmt.Sprintf("part%d.pb", i)
+		writer, err := fs.NewProtoFile(part)
+		require.NoError(t, err)
+		for j := i; j < 40; j += 4 {
+			_, err = writer.Write(&Domain{ Domain: fmt.Sprintf("obj%02d", j) })
+			require.NoError(t, err)
+		}
+		require.NoError(t, writer.Close())
+		parts = append(parts, part)
+	}
+
+	compare := func(a, b proto.Message) int {
+		return strings.Compare(a.(*Domain).Domain, b.(*Domain).Domain)
+	}
+	require.NoError(t, fs.MergeSortedProtoFiles(context.Background(), "merged.pb", &Domain{}, parts, compare, nil))
+
+	domains := readDomains(t, fs, "merged.pb")
+	require.Equal(t, 40, len(domains))
+	for i, domain := range domains {
+		require.Equal(t, fmt.Sprintf("obj%02d", i), domain)
+	}
+}
+
+func writeCsvRows(t *testing.T, fs fsmod.ExtendedFileService, filePath string, rows [][]string) {
+	writer, err := fs.NewCsvFile(filePath)
+	require.NoError(t, err)
+	for _, row := range rows {
+		require.NoError(t, writer.Write(row...))
+	}
+	require.NoError(t, writer.Close())
+}
@@ -0,0 +1,430 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/sprintframework/fs"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"sync"
+)
+
+// records sent to workers at once
+var ParallelChunkSize = 1024
+
+// chunks buffered for each part, read ahead in parallel join and queued to the worker in parallel split
+var ParallelReadAhead = 4
+
+/**
+Extension of the file service that runs split and join in a pool of workers.
+
+In parallel split records are decoded sequentially and each part is encoded and compressed by its own worker,
+queue of each worker holds up to ParallelReadAhead chunks. In parallel join parts are decoded by workers ahead
+of the sequential writer. Output files are the same as in sequential mode.
+ */
+type ParallelFileService interface {
+
+	/*
+	Gets number of workers of split and join, default value is 0 that means sequential mode.
+	 */
+	Parallelism() int
+
+	/*
+	Sets number of workers used by SplitCsvFile, SplitJsonFile, SplitProtoFile, JoinCsvFiles, JoinJsonFiles, JoinProtoFiles
+	and their variants. Values less than 2 mean sequential mode.
+	 */
+	SetParallelism(workers int)
+}
+
+func (t *fileServiceImpl) Parallelism() int {
+	return t.parallelism
+}
+
+func (t *fileServiceImpl) SetParallelism(workers int) {
+	t.parallelism = workers
+}
+
+func (t *fileServiceImpl) parallelSplitCsvFile(ctx context.Context, inputFilePath string, dialect *CsvDialect, limit int, partFn func (int) string) (*splitResult, error) {
+	src, header, err := t.csvPartitionSource(inputFilePath, dialect, false)
+	if err != nil {
+		return nil, err
+	}
+	defer src.close()
+	res, err := parallelSplit(ctx, src, t.parallelism, limit, partFn)
+	if err != nil {
+		return nil, err
+	}
+	res.header = header
+	return res, nil
+}
+
+func (t *fileServiceImpl) parallelSplitJsonFile(ctx context.Context, inputFilePath string, limit int, partFn func (int) string) (*splitResult, error) {
+	src, err := t.jsonPartitionSource(inputFilePath, false)
+	if err != nil {
+		return nil, err
+	}
+	defer src.close()
+	return parallelSplit(ctx, src, t.parallelism, limit, partFn)
+}
+
+func (t *fileServiceImpl) parallelSplitProtoFile(ctx context.Context, inputFilePath string, holder proto.Message, limit int, partFn func (int) string) (*splitResult, error) {
+	src, _, err := t.protoPartitionSource(inputFilePath, holder, false)
+	if err != nil {
+		return nil, err
+	}
+	defer src.close()
+	return parallelSplit(ctx, src, t.parallelism, limit, partFn)
+}
+
+/**
+Parts written by the split, number of split records and CSV header are used to describe parts in the manifest.
+ */
+type splitResult struct {
+	parts   []string
+	records int64
+	header  []string
+}
+
+func splitParts(res *splitResult, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	return res.parts, nil
+}
+
+/**
+Reads records and sends them in chunks to the worker of the current part. Channel of the part holds ParallelReadAhead chunks,
+so memory is bounded by workers and chunks regardless of the part size, send is cancelled when any worker fails.
+ */
+func parallelSplit[R any](ctx context.Context, src *partitionSource[R], workers, limit int, partFn func (int) string) (*splitResult, error) {
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		errOnce.Do(func() { firstErr = err })
+		cancel()
+	}
+
+	slots := make(chan struct{}, workers)
+	var parts []string
+	var records int64
+	var ch chan []R
+	var chunk []R
+
+	send := func() error {
+		if len(chunk) > 0 {
+			select {
+			case ch <- chunk:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			chunk = nil
+		}
+		return nil
+	}
+	closePart := func() error {
+		var err error
+		if ch != nil {
+			err = send()
+			close(ch)
+			ch = nil
+		}
+		return err
+	}
+
+	var err error
+	for cnt := limit; err == nil; cnt++ {
+
+		if err = ctx.Err(); err != nil {
+			break
+		}
+
+		var record R
+		record, err = src.read()
+		if err != nil {
+			break
+		}
+
+		if cnt == limit {
+			if err = closePart(); err != nil {
+				break
+			}
+
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				err = ctx.Err()
+				continue
+			}
+
+			partFilePath := partFn(len(parts) + 1)
+			var writer partitionWriter[R]
+			writer, err = src.create(partFilePath)
+			if err != nil {
+				<-slots
+				break
+			}
+			parts = append(parts, partFilePath)
+
+			ch = make(chan []R, ParallelReadAhead)
+			wg.Add(1)
+			go func(writer partitionWriter[R], ch <-chan []R) {
+				defer wg.Done()
+				defer func() { <-slots }()
+				if err := writeParallelPart(ctx, writer, ch); err != nil {
+					fail(err)
+				}
+			}(writer, ch)
+
+			cnt = 0
+		}
+
+		chunk = append(chunk, src.clone(record))
+		records++
+		if len(chunk) == ParallelChunkSize {
+			err = send()
+		}
+	}
+
+	if err == io.EOF {
+		err = nil
+	}
+	if closeErr := closePart(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fail(err)
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		for _, part := range parts {
+			src.fsys.Remove(part)
+		}
+		return nil, firstErr
+	}
+
+	return &splitResult{ parts: parts, records: records }, nil
+}
+
+/**
+Writes all chunks of the part, the part is aborted if the split was cancelled.
+ */
+func writeParallelPart[R any](ctx context.Context, writer partitionWriter[R], ch <-chan []R) error {
+	for chunk := range ch {
+		if err := ctx.Err(); err != nil {
+			writer.Abort()
+			return err
+		}
+		for _, record := range chunk {
+			if err := writer.write(record); err != nil {
+				writer.Abort()
+				return err
+			}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		writer.Abort()
+		return err
+	}
+	return writer.Close()
+}
+
+/**
+Records of one part read by the worker.
+ */
+type parallelPart[R any] struct {
+	ch  chan []R
+	err error // valid after ch is closed
+}
+
+/**
+Reads parts in workers and passes their records to write in order of parts.
+Open function gets reader of the part with index, write function gets index of the part too.
+ */
+func parallelJoin[R any](ctx context.Context, parts []string, workers int,
+	open func(i int, part string) (read func() (R, error), close func() error, err error),
+	write func(i int, record R) error) error {
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, workers)
+	readers := make([]*parallelPart[R], len(parts))
+	for i := range readers {
+		readers[i] = &parallelPart[R]{ ch: make(chan []R, ParallelReadAhead) }
+	}
+
+	// slots are taken in order of parts and released by the writer, so read ahead is limited by the number of workers
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i, part := range parts {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				for _, p := range readers[i:] {
+					p.err = ctx.Err()
+					close(p.ch)
+				}
+				return
+			}
+			wg.Add(1)
+			go func(i int, part string, p *parallelPart[R]) {
+				defer wg.Done()
+				defer close(p.ch)
+				p.err = readParallelPart(ctx, i, part, p.ch, open)
+			}(i, part, readers[i])
+		}
+	}()
+
+	err := func() error {
+		for i, p := range readers {
+			for chunk := range p.ch {
+				for _, record := range chunk {
+					if err := write(i, record); err != nil {
+						return err
+					}
+				}
+			}
+			if p.err != nil {
+				return p.err
+			}
+			<-slots
+		}
+		return nil
+	}()
+
+	cancel()
+	for _, p := range readers {
+		// unblock readers waiting to send
+		for range p.ch {
+		}
+	}
+	wg.Wait()
+
+	return err
+}
+
+func readParallelPart[R any](ctx context.Context, i int, part string, ch chan<- []R,
+	open func(i int, part string) (func() (R, error), func() error, error)) error {
+
+	read, closeFn, err := open(i, part)
+	if err != nil {
+		return errors.Errorf("can not open file '%s', %v", part, err)
+	}
+	defer closeFn()
+
+	var chunk []R
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		record, err := read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Errorf("join read file '%s', %v", part, err)
+		}
+		chunk = append(chunk, record)
+		if len(chunk) == ParallelChunkSize {
+			select {
+			case ch <- chunk:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			chunk = nil
+		}
+	}
+
+	if len(chunk) > 0 {
+		select {
+		case ch <- chunk:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (t *fileServiceImpl) parallelJoinCsvFiles(ctx context.Context, writer fs.CsvWriter, outputFilePath string, dialect *CsvDialect, parts []string) error {
+	return parallelJoin(ctx, parts, t.parallelism, func(i int, part string) (func() ([]string, error), func() error, error) {
+		reader, err := t.OpenCsvDialectFile(part, t.csvDialectOf(part, dialect))
+		if err != nil {
+			return nil, nil, err
+		}
+		header, err := reader.Read()
+		if err != nil {
+			reader.Close()
+			return nil, nil, errors.Errorf("can not read header, %v", err)
+		}
+		// header of the first part is the first record
+		pending := i == 0
+		header = append([]string(nil), header...)
+		return func() ([]string, error) {
+			if pending {
+				pending = false
+				return header, nil
+			}
+			row, err := reader.Read()
+			if err != nil {
+				return nil, err
+			}
+			// record could be reused by reader
+			return append([]string(nil), row...), nil
+		}, reader.Close, nil
+	}, func(i int, row []string) error {
+		if err := writer.Write(row...); err != nil {
+			return errors.Errorf("can not write row to file '%s', %v", outputFilePath, err)
+		}
+		return nil
+	})
+}
+
+func (t *fileServiceImpl) parallelJoinJsonFiles(ctx context.Context, writer fs.JsonWriter, outputFilePath string, parts []string) error {
+	return parallelJoin(ctx, parts, t.parallelism, func(i int, part string) (func() (json.RawMessage, error), func() error, error) {
+		reader, err := t.OpenJsonFile(part)
+		if err != nil {
+			return nil, nil, err
+		}
+		return reader.ReadRaw, reader.Close, nil
+	}, func(i int, raw json.RawMessage) error {
+		if err := writer.WriteRaw(raw); err != nil {
+			return errors.Errorf("can not write row to file '%s', %v", outputFilePath, err)
+		}
+		return nil
+	})
+}
+
+func (t *fileServiceImpl) parallelJoinProtoFiles(ctx context.Context, writer fs.ProtoWriter, outputFilePath string, row proto.Message, parts []string) error {
+	return parallelJoin(ctx, parts, t.parallelism, func(i int, part string) (func() (proto.Message, error), func() error, error) {
+		reader, err := t.OpenProtoFile(part)
+		if err != nil {
+			return nil, nil, err
+		}
+		return func() (proto.Message, error) {
+			message := row.ProtoReflect().New().Interface()
+			return message, reader.ReadTo(message)
+		}, reader.Close, nil
+	}, func(i int, message proto.Message) error {
+		if _, err := writer.Write(message); err != nil {
+			return errors.Errorf("can not write row to file '%s', %v", outputFilePath, err)
+		}
+		return nil
+	})
+}
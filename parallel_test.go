@@ -0,0 +1,184 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/sprintframework/fsmod"
+	"github.com/stretchr/testify/require"
+	"io"
+	iofs "io/fs"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParallelCsvSplitJoin(t *testing.T) {
+
+	chunkSize := fsmod.ParallelChunkSize
+	fsmod.ParallelChunkSize = 3
+	defer func() { fsmod.ParallelChunkSize = chunkSize }()
+
+	mem := fsmod.MemFileSystem()
+	fs := fsmod.FileSystemService(mem)
+	writeGroups(t, fs, "table.csv.gz", 100)
+
+	sequential, err := fs.SplitCsvFile("table.csv.gz", 7, func(i int) string {
+		return fmt.Sprintf("seq/part%d.csv.gz", i)
+	})
+	require.NoError(t, err)
+	require.NoError(t, fs.JoinCsvFiles("seq.csv.gz", sequential))
+
+	fs.SetParallelism(4)
+	require.Equal(t, 4, fs.Parallelism())
+
+	parallel, err := fs.SplitCsvFile("table.csv.gz", 7, func(i int) string {
+		return fmt.Sprintf("par/part%d.csv.gz", i)
+	})
+	require.NoError(t, err)
+	require.Equal(t, len(sequential), len(parallel))
+
+	// parts are the same byte by byte
+	for i := range sequential {
+		require.Equal(t, readContent(t, mem, sequential[i]), readContent(t, mem, parallel[i]))
+	}
+
+	require.NoError(t, fs.JoinCsvFiles("par.csv.gz", parallel))
+	require.Equal(t, readContent(t, mem, "seq.csv.gz"), readContent(t, mem, "par.csv.gz"))
+	require.Equal(t, readContent(t, mem, "table.csv.gz"), readContent(t, mem, "par.csv.gz"))
+
+	// missing part fails the join
+	require.Error(t, fs.JoinCsvFiles("broken.csv", append(parallel, "par/missing.csv")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = fs.SplitCsvFileContext(ctx, "table.csv.gz", 7, func(i int) string {
+		return fmt.Sprintf("cancel/part%d.csv", i)
+	})
+	require.Error(t, err)
+	_, err = iofs.Stat(mem, "cancel/part1.csv")
+	require.Error(t, err)
+}
+
+func TestParallelSplitWorkerError(t *testing.T) {
+
+	chunkSize := fsmod.ParallelChunkSize
+	fsmod.ParallelChunkSize = 3
+	defer func() { fsmod.ParallelChunkSize = chunkSize }()
+
+	mem := fsmod.MemFileSystem()
+	fs := fsmod.FileSystemService(mem)
+	writeGroups(t, fs, "table.csv", 10000)
+	fs.RegisterCodec(brokenWriteCodec{ Codec: fsmod.GzipCodec })
+	fs.SetParallelism(2)
+
+	// single unlimited part, reader sends much more chunks than the worker queue holds
+	done := make(chan error, 1)
+	go func() {
+		_, err := fs.SplitCsvFile("table.csv", 0, func(i int) string {
+			return fmt.Sprintf("parts/part%d.csv.gz", i)
+		})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		require.Error(t, err)
+	case <-time.After(10 * time.Second):
+		require.FailNow(t, "split hangs after worker failure")
+	}
+
+	_, err := iofs.Stat(mem, "parts/part1.csv.gz")
+	require.Error(t, err)
+}
+
+/**
+Codec that fails every write in to the compression stream, failure is delayed until the split reader waits for the worker.
+ */
+type brokenWriteCodec struct {
+	fsmod.Codec
+}
+
+func (c brokenWriteCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	cw, err := c.Codec.NewWriter(w)
+	if err != nil {
+		return nil, err
+	}
+	return brokenWriter{ cw }, nil
+}
+
+type brokenWriter struct {
+	io.WriteCloser
+}
+
+func (w brokenWriter) Write(p []byte) (int, error) {
+	time.Sleep(100 * time.Millisecond)
+	return 0, io.ErrShortWrite
+}
+
+func TestParallelJsonSplitJoin(t *testing.T) {
+
+	mem := fsmod.MemFileSystem()
+	fs := fsmod.FileSystemService(mem)
+	fs.SetParallelism(3)
+
+	writer, err := fs.NewJsonFile("items.json")
+	require.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		require.NoError(t, writer.Write(map[string]string{ "id": strconv.Itoa(i) }))
+	}
+	require.NoError(t, writer.Close())
+
+	parts, err := fs.SplitJsonFile("items.json", 6, func(i int) string {
+		return fmt.Sprintf("parts/part%d.json", i)
+	})
+	require.NoError(t, err)
+	require.Equal(t, 9, len(parts))
+
+	require.NoError(t, fs.JoinJsonFiles("joined.json", parts))
+	require.Equal(t, readContent(t, mem, "items.json"), readContent(t, mem, "joined.json"))
+}
+
+func TestParallelProtoSplitJoin(t *testing.T) {
+
+	mem := fsmod.MemFileSystem()
+	fs := fsmod.FileSystemService(mem)
+	fs.SetProtoIndexInterval(5)
+
+	writer, err := fs.NewProtoFile("domains.pb.gz")
+	require.NoError(t, err)
+	for i := 0; i < 40; i++ {
+		_, err = writer.Write(&Domain{ Domain: fmt.Sprintf("obj%d", i) })
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Close())
+
+	var msg Domain
+	sequential, err := fs.SplitProtoFile("domains.pb.gz", &msg, 9, func(i int) string {
+		return fmt.Sprintf("seq/part%d.pb.gz", i)
+	})
+	require.NoError(t, err)
+
+	fs.SetParallelism(2)
+	parallel, err := fs.SplitProtoFile("domains.pb.gz", &msg, 9, func(i int) string {
+		return fmt.Sprintf("par/part%d.pb.gz", i)
+	})
+	require.NoError(t, err)
+	for i := range sequential {
+		require.Equal(t, readContent(t, mem, sequential[i]), readContent(t, mem, parallel[i]))
+		require.Equal(t, readContent(t, mem, sequential[i] + fsmod.ProtoIndexExtension), readContent(t, mem, parallel[i] + fsmod.ProtoIndexExtension))
+	}
+
+	require.NoError(t, fs.JoinProtoFiles("joined.pb.gz", &msg, parallel))
+	require.Equal(t, readDomains(t, fs, "domains.pb.gz"), readDomains(t, fs, "joined.pb.gz"))
+}
+
+func readContent(t *testing.T, fsys iofs.FS, name string) []byte {
+	content, err := iofs.ReadFile(fsys, name)
+	require.NoError(t, err)
+	return content
+}
@@ -0,0 +1,742 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// directory name of the partition for empty values, the same as in Hive
+var HiveDefaultPartition = "__HIVE_DEFAULT_PARTITION__"
+
+// default limit of parts open at once by hash and value splits, keeps split below the usual limit of open files
+var DefaultMaxOpenPartitions = 512
+
+/**
+Extension of the file service that splits files by size, by hash of the record key and by value of the record key.
+
+Key of CSV record is a column name, key of JSON record is a path of object fields and array indexes separated by dots like 'user.tags.0',
+key of protobuf record is a field name or a path of field names of nested messages. Missing values are empty.
+ */
+type PartitionFileService interface {
+
+	/*
+	Splits CSV file in to parts of about maxSize bytes each. Size is measured after compression,
+	so part could exceed it by one record and by the data buffered before and in the codec.
+	 */
+	SplitCsvFileSize(ctx context.Context, inputFilePath string, maxSize int64, partFn func (int) string) ([]string, error)
+
+	/*
+	Splits JSON file in to parts of about maxSize bytes each.
+	 */
+	SplitJsonFileSize(ctx context.Context, inputFilePath string, maxSize int64, partFn func (int) string) ([]string, error)
+
+	/*
+	Splits protofile in to parts of about maxSize bytes each, holder could be nil for files with descriptor header.
+	 */
+	SplitProtoFileSize(ctx context.Context, inputFilePath string, holder proto.Message, maxSize int64, partFn func (int) string) ([]string, error)
+
+	/*
+	Splits CSV file in to buckets by hash of the column value, so rows with the same value are in the same part.
+	Part numbers start from 1, empty buckets have no parts.
+	 */
+	SplitCsvFileHash(ctx context.Context, inputFilePath string, column string, buckets int, partFn func (int) string) ([]string, error)
+
+	/*
+	Splits JSON file in to buckets by hash of the value by JSON path.
+	 */
+	SplitJsonFileHash(ctx context.Context, inputFilePath string, jsonPath string, buckets int, partFn func (int) string) ([]string, error)
+
+	/*
+	Splits protofile in to buckets by hash of the field value.
+	 */
+	SplitProtoFileHash(ctx context.Context, inputFilePath string, holder proto.Message, field string, buckets int, partFn func (int) string) ([]string, error)
+
+	/*
+	Splits CSV file in to one part per distinct column value at path 'dir/column=value/name'.
+	All parts are open during split, so split fails if there are more distinct values than MaxOpenPartitions.
+	 */
+	SplitCsvFileValue(ctx context.Context, inputFilePath string, column string, dir, name string) ([]string, error)
+
+	/*
+	Splits JSON file in to one part per distinct value by JSON path at path 'dir/jsonPath=value/name'.
+	 */
+	SplitJsonFileValue(ctx context.Context, inputFilePath string, jsonPath string, dir, name string) ([]string, error)
+
+	/*
+	Splits protofile in to one part per distinct field value at path 'dir/field=value/name'.
+	 */
+	SplitProtoFileValue(ctx context.Context, inputFilePath string, holder proto.Message, field string, dir, name string) ([]string, error)
+
+	/*
+	Gets maximum number of parts open at once by hash and value splits, default value is DefaultMaxOpenPartitions.
+	 */
+	MaxOpenPartitions() int
+
+	/*
+	Sets maximum number of parts open at once, split fails with error when it needs more parts.
+	Zero or negative value disables the limit.
+	 */
+	SetMaxOpenPartitions(n int)
+}
+
+/**
+Part file being written by the split.
+ */
+type partitionWriter[R any] interface {
+	write(record R) error
+	size() int64 // bytes written to the file and buffered after the codec, buffer before the codec is not flushed
+	Close() error
+	Abort() error
+}
+
+/**
+Records of the input file and the factory of part files of the same format.
+ */
+type partitionSource[R any] struct {
+	fsys   FileSystem
+	read   func() (R, error)
+	clone  func(R) R // detaches record from the reader buffers
+	create func(partFilePath string) (partitionWriter[R], error)
+	close  func() error
+}
+
+func (t *fileServiceImpl) SplitCsvFileSize(ctx context.Context, inputFilePath string, maxSize int64, partFn func (int) string) ([]string, error) {
+	src, _, err := t.csvPartitionSource(inputFilePath, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	defer src.close()
+	return splitBySize(ctx, src, maxSize, partFn)
+}
+
+func (t *fileServiceImpl) SplitJsonFileSize(ctx context.Context, inputFilePath string, maxSize int64, partFn func (int) string) ([]string, error) {
+	src, err := t.jsonPartitionSource(inputFilePath, true)
+	if err != nil {
+		return nil, err
+	}
+	defer src.close()
+	return splitBySize(ctx, src, maxSize, partFn)
+}
+
+func (t *fileServiceImpl) SplitProtoFileSize(ctx context.Context, inputFilePath string, holder proto.Message, maxSize int64, partFn func (int) string) ([]string, error) {
+	src, _, err := t.protoPartitionSource(inputFilePath, holder, true)
+	if err != nil {
+		return nil, err
+	}
+	defer src.close()
+	return splitBySize(ctx, src, maxSize, partFn)
+}
+
+func (t *fileServiceImpl) SplitCsvFileHash(ctx context.Context, inputFilePath string, column string, buckets int, partFn func (int) string) ([]string, error) {
+	src, header, err := t.csvPartitionSource(inputFilePath, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	defer src.close()
+	key, err := csvColumnKey(header, column)
+	if err != nil {
+		return nil, errors.Errorf("split file '%s', %v", inputFilePath, err)
+	}
+	return splitByHash(ctx, src, t.maxOpenPartitions, key, buckets, partFn)
+}
+
+func (t *fileServiceImpl) SplitJsonFileHash(ctx context.Context, inputFilePath string, jsonPath string, buckets int, partFn func (int) string) ([]string, error) {
+	src, err := t.jsonPartitionSource(inputFilePath, false)
+	if err != nil {
+		return nil, err
+	}
+	defer src.close()
+	return splitByHash(ctx, src, t.maxOpenPartitions, jsonPathKey(jsonPath), buckets, partFn)
+}
+
+func (t *fileServiceImpl) SplitProtoFileHash(ctx context.Context, inputFilePath string, holder proto.Message, field string, buckets int, partFn func (int) string) ([]string, error) {
+	src, descriptor, err := t.protoPartitionSource(inputFilePath, holder, false)
+	if err != nil {
+		return nil, err
+	}
+	defer src.close()
+	key, err := protoFieldKey(descriptor, field)
+	if err != nil {
+		return nil, errors.Errorf("split file '%s', %v", inputFilePath, err)
+	}
+	return splitByHash(ctx, src, t.maxOpenPartitions, key, buckets, partFn)
+}
+
+func (t *fileServiceImpl) SplitCsvFileValue(ctx context.Context, inputFilePath string, column string, dir, name string) ([]string, error) {
+	src, header, err := t.csvPartitionSource(inputFilePath, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	defer src.close()
+	key, err := csvColumnKey(header, column)
+	if err != nil {
+		return nil, errors.Errorf("split file '%s', %v", inputFilePath, err)
+	}
+	return splitByValue(ctx, src, t.maxOpenPartitions, key, column, dir, name)
+}
+
+func (t *fileServiceImpl) SplitJsonFileValue(ctx context.Context, inputFilePath string, jsonPath string, dir, name string) ([]string, error) {
+	src, err := t.jsonPartitionSource(inputFilePath, false)
+	if err != nil {
+		return nil, err
+	}
+	defer src.close()
+	return splitByValue(ctx, src, t.maxOpenPartitions, jsonPathKey(jsonPath), jsonPath, dir, name)
+}
+
+func (t *fileServiceImpl) SplitProtoFileValue(ctx context.Context, inputFilePath string, holder proto.Message, field string, dir, name string) ([]string, error) {
+	src, descriptor, err := t.protoPartitionSource(inputFilePath, holder, false)
+	if err != nil {
+		return nil, err
+	}
+	defer src.close()
+	key, err := protoFieldKey(descriptor, field)
+	if err != nil {
+		return nil, errors.Errorf("split file '%s', %v", inputFilePath, err)
+	}
+	return splitByValue(ctx, src, t.maxOpenPartitions, key, field, dir, name)
+}
+
+/**
+Starts the next part when the current one reaches the size.
+ */
+func splitBySize[R any](ctx context.Context, src *partitionSource[R], maxSize int64, partFn func (int) string) ([]string, error) {
+
+	var parts []string
+	var writer partitionWriter[R]
+	var err error
+
+	for err == nil {
+
+		if err = ctx.Err(); err != nil {
+			break
+		}
+
+		var record R
+		record, err = src.read()
+		if err != nil {
+			break
+		}
+
+		if writer == nil || writer.size() >= maxSize {
+			if writer != nil {
+				err = writer.Close()
+				writer = nil
+				if err != nil {
+					break
+				}
+			}
+			partFilePath := partFn(len(parts) + 1)
+			writer, err = src.create(partFilePath)
+			if err != nil {
+				break
+			}
+			parts = append(parts, partFilePath)
+		}
+
+		err = writer.write(record)
+	}
+
+	if err == io.EOF {
+		err = nil
+	}
+
+	if writer != nil {
+		if err != nil {
+			writer.Abort()
+		} else {
+			err = writer.Close()
+		}
+	}
+
+	if err != nil {
+		for _, part := range parts {
+			src.fsys.Remove(part)
+		}
+		return nil, err
+	}
+
+	return parts, nil
+}
+
+func splitByHash[R any](ctx context.Context, src *partitionSource[R], maxOpen int, key func(R) (string, error), buckets int, partFn func (int) string) ([]string, error) {
+
+	if buckets <= 0 {
+		return nil, errors.Errorf("invalid number of buckets %d", buckets)
+	}
+
+	bucketOf := make(map[string]int)
+	parts, err := splitByKey(ctx, src, maxOpen, func(record R) (string, error) {
+		value, err := key(record)
+		if err != nil {
+			return "", err
+		}
+		h := fnv.New32a()
+		h.Write([]byte(value))
+		bucket := int(h.Sum32() % uint32(buckets)) + 1
+		partFilePath := partFn(bucket)
+		bucketOf[partFilePath] = bucket
+		return partFilePath, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(parts, func(i, j int) bool { return bucketOf[parts[i]] < bucketOf[parts[j]] })
+	return parts, nil
+}
+
+func splitByValue[R any](ctx context.Context, src *partitionSource[R], maxOpen int, key func(R) (string, error), keyName, dir, name string) ([]string, error) {
+	// directory of the value is created before the first record of the value
+	create := src.create
+	dirs := *src
+	dirs.create = func(partFilePath string) (partitionWriter[R], error) {
+		partDir, _ := splitFilePath(partFilePath)
+		if err := src.fsys.MkdirAll(partDir); err != nil {
+			return nil, errors.Errorf("directory create error '%s', %v", partDir, err)
+		}
+		return create(partFilePath)
+	}
+	return splitByKey(ctx, &dirs, maxOpen, func(record R) (string, error) {
+		value, err := key(record)
+		if err != nil {
+			return "", err
+		}
+		return joinFilePath(joinFilePath(dir, escapeHivePath(keyName) + "=" + escapeHivePath(value)), name), nil
+	})
+}
+
+func (t *fileServiceImpl) MaxOpenPartitions() int {
+	return t.maxOpenPartitions
+}
+
+func (t *fileServiceImpl) SetMaxOpenPartitions(n int) {
+	t.maxOpenPartitions = n
+}
+
+/**
+Writes records to parts by path, all parts stay open until the end of the input. Parts are returned in order of the first record.
+Split fails before opening more than maxOpen parts, instead of running out of file handles and buffers.
+ */
+func splitByKey[R any](ctx context.Context, src *partitionSource[R], maxOpen int, partPath func(R) (string, error)) ([]string, error) {
+
+	var parts []string
+	writers := make(map[string]partitionWriter[R])
+	var err error
+
+	for err == nil {
+
+		if err = ctx.Err(); err != nil {
+			break
+		}
+
+		var record R
+		record, err = src.read()
+		if err != nil {
+			break
+		}
+
+		var partFilePath string
+		partFilePath, err = partPath(record)
+		if err != nil {
+			break
+		}
+
+		writer, ok := writers[partFilePath]
+		if !ok {
+			if maxOpen > 0 && len(writers) >= maxOpen {
+				err = errors.Errorf("split needs more than %d open parts, part '%s' exceeds MaxOpenPartitions", maxOpen, partFilePath)
+				break
+			}
+			writer, err = src.create(partFilePath)
+			if err != nil {
+				break
+			}
+			writers[partFilePath] = writer
+			parts = append(parts, partFilePath)
+		}
+
+		err = writer.write(record)
+	}
+
+	if err == io.EOF {
+		err = nil
+	}
+
+	for _, part := range parts {
+		if err != nil {
+			writers[part].Abort()
+		} else {
+			err = writers[part].Close()
+		}
+	}
+
+	if err != nil {
+		for _, part := range parts {
+			src.fsys.Remove(part)
+		}
+		return nil, err
+	}
+
+	return parts, nil
+}
+
+/**
+Escapes characters that are not allowed in partition directory names the same way as Hive.
+ */
+func escapeHivePath(value string) string {
+	if value == "" {
+		return HiveDefaultPartition
+	}
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c < 0x20 || c == 0x7F || strings.IndexByte("\"#%'*/:=?\\{[]^", c) >= 0 {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		} else {
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+func csvColumnKey(header []string, column string) (func([]string) (string, error), error) {
+	for i, name := range header {
+		if name == column {
+			return func(row []string) (string, error) {
+				if i < len(row) {
+					return row[i], nil
+				}
+				return "", nil
+			}, nil
+		}
+	}
+	return nil, errors.Errorf("column '%s' not found in header %v", column, header)
+}
+
+func jsonPathKey(jsonPath string) func(json.RawMessage) (string, error) {
+	path := strings.Split(strings.TrimPrefix(jsonPath, "$."), ".")
+	return func(raw json.RawMessage) (string, error) {
+		return jsonPathValue(raw, path)
+	}
+}
+
+/**
+Gets value by path, strings are unquoted and other values are returned as JSON text.
+ */
+func jsonPathValue(raw json.RawMessage, path []string) (string, error) {
+	for _, name := range path {
+		raw = bytes.TrimSpace(raw)
+		switch {
+		case len(raw) > 0 && raw[0] == '{':
+			var obj map[string]json.RawMessage
+			if err := json.Unmarshal(raw, &obj); err != nil {
+				return "", err
+			}
+			raw = obj[name]
+		case len(raw) > 0 && raw[0] == '[':
+			var arr []json.RawMessage
+			if err := json.Unmarshal(raw, &arr); err != nil {
+				return "", err
+			}
+			i, err := strconv.Atoi(name)
+			if err != nil || i < 0 || i >= len(arr) {
+				return "", nil
+			}
+			raw = arr[i]
+		default:
+			return "", nil
+		}
+	}
+	raw = bytes.TrimSpace(raw)
+	switch {
+	case len(raw) == 0 || string(raw) == "null":
+		return "", nil
+	case raw[0] == '"':
+		var s string
+		err := json.Unmarshal(raw, &s)
+		return s, err
+	default:
+		return string(raw), nil
+	}
+}
+
+/**
+Resolves field path by proto or JSON names, only the last field could be not a message.
+ */
+func protoFieldKey(descriptor protoreflect.MessageDescriptor, field string) (func(proto.Message) (string, error), error) {
+
+	var path []protoreflect.FieldDescriptor
+	md := descriptor
+	for _, name := range strings.Split(field, ".") {
+		if md == nil {
+			return nil, errors.Errorf("field '%s' is not a message in '%s'", path[len(path)-1].Name(), field)
+		}
+		fd := md.Fields().ByName(protoreflect.Name(name))
+		if fd == nil {
+			fd = md.Fields().ByJSONName(name)
+		}
+		if fd == nil {
+			return nil, errors.Errorf("field '%s' not found in message '%s'", name, md.FullName())
+		}
+		if fd.IsList() || fd.IsMap() {
+			return nil, errors.Errorf("repeated field '%s' could not be a key", fd.FullName())
+		}
+		path = append(path, fd)
+		md = fd.Message()
+	}
+	if md != nil {
+		return nil, errors.Errorf("message field '%s' could not be a key", field)
+	}
+
+	return func(message proto.Message) (string, error) {
+		m := message.ProtoReflect()
+		for _, fd := range path[:len(path)-1] {
+			if !m.Has(fd) {
+				return "", nil
+			}
+			m = m.Get(fd).Message()
+		}
+		fd := path[len(path)-1]
+		value := m.Get(fd)
+		switch fd.Kind() {
+		case protoreflect.EnumKind:
+			if ev := fd.Enum().Values().ByNumber(value.Enum()); ev != nil {
+				return string(ev.Name()), nil
+			}
+			return strconv.Itoa(int(value.Enum())), nil
+		case protoreflect.BytesKind:
+			return fmt.Sprintf("%x", value.Bytes()), nil
+		default:
+			return value.String(), nil
+		}
+	}, nil
+}
+
+/**
+Opens the source, nil dialect means that each file has dialect by extension. Measured source counts bytes of parts for size splits.
+ */
+func (t *fileServiceImpl) csvPartitionSource(inputFilePath string, dialect *CsvDialect, measured bool) (*partitionSource[[]string], []string, error) {
+
+	reader, err := t.OpenCsvDialectFile(inputFilePath, t.csvDialectOf(inputFilePath, dialect))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header, err := reader.Read()
+	if err != nil {
+		reader.Close()
+		return nil, nil, err
+	}
+	// record could be reused by reader
+	header = append([]string(nil), header...)
+
+	v, sfs := t.withSizeFileSystem(measured)
+	return &partitionSource[[]string]{
+		fsys: t.fsys,
+		read: reader.Read,
+		clone: func(row []string) []string {
+			return append([]string(nil), row...)
+		},
+		create: func(partFilePath string) (partitionWriter[[]string], error) {
+			w, err := v.newCsvFile(partFilePath, true, v.csvDialectOf(partFilePath, dialect), nil)
+			if err != nil {
+				return nil, err
+			}
+			if err = w.Write(header...); err != nil {
+				w.Abort()
+				return nil, err
+			}
+			return &csvPartWriter{ csvFileWriter: w, file: sfs.lastFile() }, nil
+		},
+		close: reader.Close,
+	}, header, nil
+}
+
+func (t *fileServiceImpl) jsonPartitionSource(inputFilePath string, measured bool) (*partitionSource[json.RawMessage], error) {
+
+	reader, err := t.OpenJsonFile(inputFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	v, sfs := t.withSizeFileSystem(measured)
+	return &partitionSource[json.RawMessage]{
+		fsys: t.fsys,
+		read: reader.ReadRaw,
+		clone: func(raw json.RawMessage) json.RawMessage {
+			return append(json.RawMessage(nil), raw...)
+		},
+		create: func(partFilePath string) (partitionWriter[json.RawMessage], error) {
+			w, err := v.newJsonFile(partFilePath, true)
+			if err != nil {
+				return nil, err
+			}
+			return &jsonPartWriter{ jsonFileWriter: w, file: sfs.lastFile() }, nil
+		},
+		close: reader.Close,
+	}, nil
+}
+
+func (t *fileServiceImpl) protoPartitionSource(inputFilePath string, holder proto.Message, measured bool) (*partitionSource[proto.Message], protoreflect.MessageDescriptor, error) {
+
+	reader, err := t.openProtoFile(inputFilePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	messageType := reader.messageType
+	if holder == nil {
+		if messageType == nil {
+			reader.Close()
+			return nil, nil, errors.Errorf("holder is required for file '%s' without descriptor header", inputFilePath)
+		}
+		holder = messageType.New().Interface()
+	}
+
+	v, sfs := t.withSizeFileSystem(measured)
+	return &partitionSource[proto.Message]{
+		fsys: t.fsys,
+		read: func() (proto.Message, error) {
+			return holder, reader.ReadTo(holder)
+		},
+		clone: proto.Clone,
+		create: func(partFilePath string) (partitionWriter[proto.Message], error) {
+			w, err := v.newProtoFile(partFilePath, true, describe(messageType))
+			if err != nil {
+				return nil, err
+			}
+			return &protoPartWriter{ protoFileWriter: w, file: sfs.lastFile() }, nil
+		},
+		close: reader.Close,
+	}, holder.ProtoReflect().Descriptor(), nil
+}
+
+type csvPartWriter struct {
+	*csvFileWriter
+	file *sizeFile
+}
+
+func (w *csvPartWriter) write(row []string) error {
+	return w.Write(row...)
+}
+
+/**
+Without codec CSV writer shares the file buffer of at least 4kb, with codec its buffer is flushed when full,
+flush on every record would push tiny writes in to the compressor.
+ */
+func (w *csvPartWriter) size() int64 {
+	return w.file.n + int64(w.fw.Buffered())
+}
+
+type jsonPartWriter struct {
+	*jsonFileWriter
+	file *sizeFile
+}
+
+func (w *jsonPartWriter) write(raw json.RawMessage) error {
+	return w.WriteRaw(raw)
+}
+
+func (w *jsonPartWriter) size() int64 {
+	return w.file.n + int64(w.fw.Buffered())
+}
+
+type protoPartWriter struct {
+	*protoFileWriter
+	file *sizeFile
+}
+
+func (w *protoPartWriter) write(message proto.Message) error {
+	_, err := w.Write(message)
+	return err
+}
+
+func (w *protoPartWriter) size() int64 {
+	return w.file.n + int64(w.fw.Buffered())
+}
+
+/**
+Copy of the file service that counts bytes written to created files, the same service if not measured.
+ */
+func (t *fileServiceImpl) withSizeFileSystem(measured bool) (*fileServiceImpl, *sizeFileSystem) {
+	if !measured {
+		return t, nil
+	}
+	sfs := &sizeFileSystem{ FileSystem: t.fsys }
+	v := *t
+	v.fsys = sfs
+	return &v, sfs
+}
+
+type sizeFileSystem struct {
+	FileSystem
+	last *sizeFile // the last created file
+}
+
+func (s *sizeFileSystem) Create(name string) (WritableFile, error) {
+	fd, err := s.FileSystem.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	s.last = &sizeFile{ WritableFile: fd, fsys: s.FileSystem }
+	return s.last, nil
+}
+
+func (s *sizeFileSystem) CreateTemp(dir, pattern string) (WritableFile, error) {
+	fd, err := s.FileSystem.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	s.last = &sizeFile{ WritableFile: fd, fsys: s.FileSystem }
+	return s.last, nil
+}
+
+func (s *sizeFileSystem) AtomicCreate(name string) bool {
+	return atomicCreate(s.FileSystem, name)
+}
+
+func (s *sizeFileSystem) lastFile() *sizeFile {
+	if s == nil {
+		return nil
+	}
+	return s.last
+}
+
+type sizeFile struct {
+	WritableFile
+	fsys FileSystem
+	n    int64
+}
+
+func (f *sizeFile) Write(p []byte) (int, error) {
+	n, err := f.WritableFile.Write(p)
+	f.n += int64(n)
+	return n, err
+}
+
+/**
+Keeps abort of the wrapped file, like cancel of the upload in object storage.
+ */
+func (f *sizeFile) Abort() error {
+	if aborter, ok := f.WritableFile.(Aborter); ok {
+		return aborter.Abort()
+	}
+	f.WritableFile.Close()
+	return f.fsys.Remove(f.Name())
+}
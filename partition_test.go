@@ -0,0 +1,311 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/sprintframework/fsmod"
+	"github.com/stretchr/testify/require"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestSplitCsvFileSize(t *testing.T) {
+
+	mem := fsmod.MemFileSystem()
+	fs := fsmod.FileSystemService(mem)
+
+	writeGroups(t, fs, "table.csv", 100)
+
+	parts, err := fs.SplitCsvFileSize(context.Background(), "table.csv", 200, func(i int) string {
+		return fmt.Sprintf("parts/part%d.csv", i)
+	})
+	require.NoError(t, err)
+	require.True(t, len(parts) > 1)
+
+	for i, part := range parts {
+		info, err := iofs.Stat(mem, part)
+		require.NoError(t, err)
+		if i < len(parts) - 1 {
+			// part is closed after the record that reached the size
+			require.True(t, info.Size() >= 200)
+			require.True(t, info.Size() < 200 + 20)
+		}
+	}
+
+	dataset, err := fs.OpenCsvDataset("parts")
+	require.NoError(t, err)
+	defer dataset.Close()
+	_, err = dataset.Read()
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		row, err := dataset.Read()
+		require.NoError(t, err)
+		require.Equal(t, strconv.Itoa(i), row[0])
+	}
+	_, err = dataset.Read()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestSplitCsvFileSizeCodec(t *testing.T) {
+
+	fs := fsmod.FileSystemService(fsmod.MemFileSystem())
+	writes := 0
+	fs.RegisterCodec(countingCodec{ Codec: fsmod.GzipCodec, writes: &writes })
+
+	writeGroups(t, fs, "table.csv", 2000)
+	parts, err := fs.SplitCsvFileSize(context.Background(), "table.csv", 2000, func(i int) string {
+		return fmt.Sprintf("parts/part%d.csv.gz", i)
+	})
+	require.NoError(t, err)
+	require.True(t, len(parts) > 0)
+
+	// records reach the compressor in buffered blocks, not one by one
+	require.True(t, writes < 100, "writes to codec %d", writes)
+
+	dataset, err := fs.OpenCsvDataset("parts")
+	require.NoError(t, err)
+	defer dataset.Close()
+	count := 0
+	for {
+		if _, err = dataset.Read(); err != nil {
+			break
+		}
+		count++
+	}
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, 2001, count)
+}
+
+/**
+Codec that counts writes in to the compression stream.
+ */
+type countingCodec struct {
+	fsmod.Codec
+	writes *int
+}
+
+func (c countingCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	cw, err := c.Codec.NewWriter(w)
+	if err != nil {
+		return nil, err
+	}
+	return &countingWriter{ WriteCloser: cw, writes: c.writes }, nil
+}
+
+type countingWriter struct {
+	io.WriteCloser
+	writes *int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w.writes++
+	return w.WriteCloser.Write(p)
+}
+
+func TestSplitCsvFileHash(t *testing.T) {
+
+	fs := fsmod.FileSystemService(fsmod.MemFileSystem())
+	writeGroups(t, fs, "table.csv", 50)
+
+	parts, err := fs.SplitCsvFileHash(context.Background(), "table.csv", "group", 3, func(i int) string {
+		return fmt.Sprintf("buckets/bucket%d.csv", i)
+	})
+	require.NoError(t, err)
+	require.True(t, len(parts) > 1 && len(parts) <= 3)
+
+	partOf := make(map[string]string)
+	total := 0
+	for _, part := range parts {
+		reader, err := fs.OpenCsvFile(part)
+		require.NoError(t, err)
+		header, err := reader.Read()
+		require.NoError(t, err)
+		require.Equal(t, []string{ "id", "group" }, header)
+		for {
+			row, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			if prev, ok := partOf[row[1]]; ok {
+				require.Equal(t, prev, part)
+			}
+			partOf[row[1]] = part
+			total++
+		}
+		reader.Close()
+	}
+	require.Equal(t, 50, total)
+	require.Equal(t, 5, len(partOf))
+
+	_, err = fs.SplitCsvFileHash(context.Background(), "table.csv", "missing", 3, func(i int) string {
+		return fmt.Sprintf("buckets/bucket%d.csv", i)
+	})
+	require.Error(t, err)
+}
+
+func TestSplitCsvFileValue(t *testing.T) {
+
+	fs := fsmod.FileSystemService(fsmod.MemFileSystem())
+
+	csv, err := fs.NewCsvFile("table.csv")
+	require.NoError(t, err)
+	require.NoError(t, csv.Write("id", "path"))
+	require.NoError(t, csv.Write("1", "a/b"))
+	require.NoError(t, csv.Write("2", ""))
+	require.NoError(t, csv.Write("3", "a/b"))
+	require.NoError(t, csv.Close())
+
+	parts, err := fs.SplitCsvFileValue(context.Background(), "table.csv", "path", "by", "data.csv")
+	require.NoError(t, err)
+	require.Equal(t, []string{ "by/path=a%2Fb/data.csv", "by/path=" + fsmod.HiveDefaultPartition + "/data.csv" }, parts)
+
+	reader, err := fs.OpenCsvFile(parts[0])
+	require.NoError(t, err)
+	defer reader.Close()
+	var rows [][]string
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		rows = append(rows, append([]string(nil), row...))
+	}
+	require.Equal(t, [][]string{ { "id", "path" }, { "1", "a/b" }, { "3", "a/b" } }, rows)
+}
+
+func TestSplitCsvFileValueOS(t *testing.T) {
+
+	fs := fsmod.FileService()
+	dir := t.TempDir()
+	inputFilePath := filepath.Join(dir, "table.csv")
+
+	csv, err := fs.NewCsvFile(inputFilePath)
+	require.NoError(t, err)
+	require.NoError(t, csv.Write("id", "group"))
+	for i := 0; i < 6; i++ {
+		require.NoError(t, csv.Write(strconv.Itoa(i), strconv.Itoa(i % 2)))
+	}
+	require.NoError(t, csv.Close())
+
+	// directories of values are created on the OS file system
+	outputDir := filepath.Join(dir, "by")
+	parts, err := fs.SplitCsvFileValue(context.Background(), inputFilePath, "group", outputDir, "data.csv")
+	require.NoError(t, err)
+	require.Equal(t, []string{ filepath.Join(outputDir, "group=0", "data.csv"), filepath.Join(outputDir, "group=1", "data.csv") }, parts)
+
+	for _, part := range parts {
+		info, err := os.Stat(part)
+		require.NoError(t, err)
+		require.True(t, info.Size() > 0)
+	}
+	require.Equal(t, [][]string{ { "id", "group" }, { "1", "1" }, { "3", "1" }, { "5", "1" } }, readCsvRows(t, fs, parts[1]))
+}
+
+func TestSplitCsvFileMaxOpenPartitions(t *testing.T) {
+
+	mem := fsmod.MemFileSystem()
+	fs := fsmod.FileSystemService(mem)
+	require.Equal(t, fsmod.DefaultMaxOpenPartitions, fs.MaxOpenPartitions())
+
+	writeGroups(t, fs, "table.csv", 100)
+
+	// more distinct values than open parts fails and removes written parts
+	fs.SetMaxOpenPartitions(3)
+	_, err := fs.SplitCsvFileValue(context.Background(), "table.csv", "group", "by", "data.csv")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "MaxOpenPartitions")
+	_, err = iofs.Stat(mem, "by/group=group0/data.csv")
+	require.Error(t, err)
+
+	_, err = fs.SplitCsvFileHash(context.Background(), "table.csv", "group", 5, func(i int) string {
+		return fmt.Sprintf("buckets/part%d.csv", i)
+	})
+	require.Error(t, err)
+
+	fs.SetMaxOpenPartitions(0)
+	parts, err := fs.SplitCsvFileValue(context.Background(), "table.csv", "group", "by", "data.csv")
+	require.NoError(t, err)
+	require.Equal(t, 5, len(parts))
+}
+
+func TestSplitJsonFilePartitions(t *testing.T) {
+
+	fs := fsmod.FileSystemService(fsmod.MemFileSystem())
+	ctx := context.Background()
+
+	writer, err := fs.NewJsonFile("users.json")
+	require.NoError(t, err)
+	countries := []string{ "US", "DE", "US", "FR" }
+	for i, country := range countries {
+		require.NoError(t, writer.Write(map[string]interface{}{ "user": map[string]interface{}{ "id": i, "country": country } }))
+	}
+	require.NoError(t, writer.Close())
+
+	parts, err := fs.SplitJsonFileValue(ctx, "users.json", "user.country", "users", "part.json")
+	require.NoError(t, err)
+	require.Equal(t, []string{ "users/user.country=US/part.json", "users/user.country=DE/part.json", "users/user.country=FR/part.json" }, parts)
+
+	parts, err = fs.SplitJsonFileHash(ctx, "users.json", "$.user.id", 2, func(i int) string {
+		return fmt.Sprintf("hash/part%d.json", i)
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(parts))
+
+	parts, err = fs.SplitJsonFileSize(ctx, "users.json", 1, func(i int) string {
+		return fmt.Sprintf("size/part%d.json", i)
+	})
+	require.NoError(t, err)
+	require.Equal(t, 4, len(parts))
+}
+
+func TestSplitProtoFilePartitions(t *testing.T) {
+
+	fs := fsmod.FileSystemService(fsmod.MemFileSystem())
+	ctx := context.Background()
+
+	writer, err := fs.NewProtoFile("domains.pb")
+	require.NoError(t, err)
+	for i := 0; i < 6; i++ {
+		_, err = writer.Write(&Domain{ Domain: fmt.Sprintf("obj%d", i), DnsProvider: fmt.Sprintf("dns%d", i % 2) })
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Close())
+
+	var msg Domain
+	parts, err := fs.SplitProtoFileValue(ctx, "domains.pb", &msg, "dnsProvider", "domains", "part.pb")
+	require.NoError(t, err)
+	require.Equal(t, []string{ "domains/dnsProvider=dns0/part.pb", "domains/dnsProvider=dns1/part.pb" }, parts)
+	require.Equal(t, []string{ "obj1", "obj3", "obj5" }, readDomains(t, fs, parts[1]))
+
+	parts, err = fs.SplitProtoFileHash(ctx, "domains.pb", &msg, "dns_provider", 4, func(i int) string {
+		return fmt.Sprintf("hash/part%d.pb", i)
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(parts))
+
+	_, err = fs.SplitProtoFileHash(ctx, "domains.pb", &msg, "options", 4, func(i int) string {
+		return fmt.Sprintf("hash/part%d.pb", i)
+	})
+	require.Error(t, err)
+}
+
+func writeGroups(t *testing.T, fs fsmod.ExtendedFileService, filePath string, n int) {
+	csv, err := fs.NewCsvFile(filePath)
+	require.NoError(t, err)
+	require.NoError(t, csv.Write("id", "group"))
+	for i := 0; i < n; i++ {
+		require.NoError(t, csv.Write(strconv.Itoa(i), fmt.Sprintf("group%d", i % 5)))
+	}
+	require.NoError(t, csv.Close())
+}
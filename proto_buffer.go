@@ -0,0 +1,120 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// default limit of the single proto message in readers
+var DefaultMaxMessageSize = 64 * 1024 * 1024
+
+/**
+Extension of the file service with the limit of the message size in proto readers.
+ */
+type ProtoLimitFileService interface {
+
+	/*
+	Gets maximum size of the single message in proto readers, default value is DefaultMaxMessageSize.
+	 */
+	MaxMessageSize() int
+
+	/*
+	Sets maximum size of the single message in proto readers, zero or negative value disables the limit.
+	 */
+	SetMaxMessageSize(size int)
+}
+
+/**
+Error returned by proto readers when the length of the record exceeds MaxMessageSize.
+ */
+type MessageSizeError struct {
+	Size   int64
+	Limit  int
+}
+
+func (e *MessageSizeError) Error() string {
+	return fmt.Sprintf("message size %d exceeds limit %d", e.Size, e.Limit)
+}
+
+func (t *fileServiceImpl) MaxMessageSize() int {
+	return t.maxMessageSize
+}
+
+func (t *fileServiceImpl) SetMaxMessageSize(size int) {
+	t.maxMessageSize = size
+}
+
+/**
+Block buffer reused between records of the reader, grows to the largest record.
+ */
+type blockBuffer struct {
+	buf      []byte
+	maxSize  int
+	framing  ProtoFraming
+	lenBuf   [4]byte
+}
+
+func (b *blockBuffer) checkSize(size int64) error {
+	if b.maxSize > 0 && size > int64(b.maxSize) {
+		return &MessageSizeError{ Size: size, Limit: b.maxSize }
+	}
+	return nil
+}
+
+/**
+Returns slice of the buffer with the given length, content is valid until the next call.
+ */
+func (b *blockBuffer) get(n int) []byte {
+	if cap(b.buf) < n {
+		b.buf = make([]byte, n)
+	}
+	return b.buf[:n]
+}
+
+/**
+Reads length prefixed record in to the buffer.
+ */
+func (b *blockBuffer) readBlock(r io.Reader) ([]byte, error) {
+
+	blockLen, _, err := readProtoLength(r, b.framing, b.lenBuf[:])
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.checkSize(int64(blockLen)); err != nil {
+		return nil, err
+	}
+
+	block := b.get(int(blockLen))
+	if _, err := io.ReadFull(r, block); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return block, nil
+}
+
+/**
+Skips length prefixed record without reading it in to memory, returns number of bytes skipped.
+ */
+func (b *blockBuffer) skipBlock(r io.Reader) (int64, error) {
+
+	blockLen, prefixLen, err := readProtoLength(r, b.framing, b.lenBuf[:])
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.CopyN(ioutil.Discard, r, int64(blockLen))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return int64(prefixLen) + n, err
+}
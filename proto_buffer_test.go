@@ -0,0 +1,115 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod_test
+
+import (
+	"bytes"
+	"github.com/sprintframework/fsmod"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestProtoMaxMessageSize(t *testing.T) {
+
+	fs := fsmod.FileService()
+	require.Equal(t, fsmod.DefaultMaxMessageSize, fs.MaxMessageSize())
+
+	fd, err := ioutil.TempFile(os.TempDir(), "proto-buffer-test")
+	require.NoError(t, err)
+	filePath := fd.Name()
+	fd.Close()
+	defer os.Remove(filePath)
+
+	for _, format := range []fsmod.ProtoFormat{ fsmod.ProtoFormatPlain, fsmod.ProtoFormatFramed } {
+
+		fs.SetProtoFormat(format)
+		fs.SetMaxMessageSize(0)
+
+		writer, err := fs.NewProtoFile(filePath)
+		require.NoError(t, err)
+		_, err = writer.Write(&Domain{ Domain: "small" })
+		require.NoError(t, err)
+		_, err = writer.Write(&Domain{ Domain: strings.Repeat("a", 2000) })
+		require.NoError(t, err)
+		_, err = writer.Write(&Domain{ Domain: "last" })
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+
+		// buffer grows to the largest record and is reused
+		require.Equal(t, []string{ "small", strings.Repeat("a", 2000), "last" }, readDomains(t, fs, filePath))
+
+		fs.SetMaxMessageSize(1000)
+
+		reader, err := fs.OpenProtoFile(filePath)
+		require.NoError(t, err)
+		var msg Domain
+		require.NoError(t, reader.ReadTo(&msg))
+		err = reader.ReadTo(&msg)
+		sizeErr, ok := err.(*fsmod.MessageSizeError)
+		require.True(t, ok, err)
+		require.Equal(t, 1000, sizeErr.Limit)
+		require.True(t, sizeErr.Size > 2000)
+		require.NoError(t, reader.Close())
+
+		content, err := ioutil.ReadFile(filePath)
+		require.NoError(t, err)
+		stream, err := fs.ProtoCodecStream(bytes.NewReader(content), nil)
+		require.NoError(t, err)
+		require.NoError(t, stream.ReadTo(&msg))
+		_, ok = stream.ReadTo(&msg).(*fsmod.MessageSizeError)
+		require.True(t, ok)
+	}
+
+	// recovery reader skips oversized record
+	var reports []*fsmod.CorruptedRecordError
+	reader, err := fs.OpenProtoRecoveryFile(filePath, func(e *fsmod.CorruptedRecordError) {
+		reports = append(reports, e)
+	})
+	require.NoError(t, err)
+	var msg Domain
+	require.NoError(t, reader.ReadTo(&msg))
+	require.Equal(t, "small", msg.Domain)
+	require.NoError(t, reader.ReadTo(&msg))
+	require.Equal(t, "last", msg.Domain)
+	require.Equal(t, io.EOF, reader.ReadTo(&msg))
+	require.NoError(t, reader.Close())
+	require.Equal(t, 1, len(reports))
+}
+
+func TestProtoBlockBufferReuse(t *testing.T) {
+
+	fs := fsmod.FileSystemService(fsmod.MemFileSystem())
+
+	for _, format := range []fsmod.ProtoFormat{ fsmod.ProtoFormatPlain, fsmod.ProtoFormatFramed } {
+
+		fs.SetProtoFormat(format)
+		writer, err := fs.NewProtoFile("domains.pb")
+		require.NoError(t, err)
+		for i := 0; i < 1000; i++ {
+			_, err = writer.Write(&Domain{ Domain: "obj" })
+			require.NoError(t, err)
+		}
+		require.NoError(t, writer.Close())
+
+		reader, err := fs.OpenProtoFile("domains.pb")
+		require.NoError(t, err)
+		var msg Domain
+		require.NoError(t, reader.ReadTo(&msg))
+
+		// only the string field allocates, block of the record is read in to the same buffer
+		allocs := testing.AllocsPerRun(500, func() {
+			if err := reader.ReadTo(&msg); err != nil {
+				t.Fatal(err)
+			}
+		})
+		require.True(t, allocs <= 1, "allocs per read %v", allocs)
+		require.NoError(t, reader.Close())
+	}
+}
@@ -0,0 +1,574 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/sprintframework/fs"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// default separator of repeated scalar values in CSV column
+var DefaultRepeatedSeparator = "|"
+
+/**
+Extension of the file service that converts CSV files to protofiles and back by message descriptor.
+Nested messages are flattened in to dotted column names, repeated scalars are joined by separator escaped by backslash,
+repeated messages, maps and recursive messages are stored as JSON in a single column.
+Column names are proto names or JSON names depending on UseProtoNames of marshal options.
+ */
+type ProtoCsvFileService interface {
+
+	/*
+	Gets separator of repeated scalar values, default value is DefaultRepeatedSeparator.
+	 */
+	RepeatedSeparator() string
+
+	/*
+	Sets separator of repeated scalar values.
+	 */
+	SetRepeatedSeparator(sep string)
+
+	/*
+	Generates CSV header for the message descriptor.
+	 */
+	ProtoCsvHeader(descriptor protoreflect.MessageDescriptor) []string
+
+	/*
+	Populates message from CSV record by matching column names to field names. Unknown columns are ignored.
+	 */
+	DecodeCsvProto(record fs.CsvRecord, message proto.Message) error
+
+	/*
+	Flattens message in to the record placing values by header columns.
+	 */
+	EncodeCsvProto(header []string, message proto.Message) ([]string, error)
+
+	/*
+	Converts CSV file with header in to protofile, holder is used for each record.
+	 */
+	ConvertCsvToProto(ctx context.Context, inputFilePath, outputFilePath string, holder proto.Message) error
+
+	/*
+	Converts protofile in to CSV file with generated header, holder is used for each record.
+	 */
+	ConvertProtoToCsv(ctx context.Context, inputFilePath, outputFilePath string, holder proto.Message) error
+}
+
+/**
+Column of the flattened message, path goes through nested singular messages.
+ */
+type protoCsvColumn struct {
+	name    string
+	path    []protoreflect.FieldDescriptor
+	json    bool
+}
+
+func (t *fileServiceImpl) RepeatedSeparator() string {
+	return t.repeatedSeparator
+}
+
+func (t *fileServiceImpl) SetRepeatedSeparator(sep string) {
+	t.repeatedSeparator = sep
+}
+
+func protoFieldName(fd protoreflect.FieldDescriptor, useProtoNames bool) string {
+	if useProtoNames {
+		return string(fd.Name())
+	}
+	return fd.JSONName()
+}
+
+func protoCsvColumns(descriptor protoreflect.MessageDescriptor, useProtoNames bool) []protoCsvColumn {
+	var list []protoCsvColumn
+	visited := map[protoreflect.FullName]bool{ descriptor.FullName(): true }
+	appendProtoCsvColumns(&list, descriptor, "", nil, visited, useProtoNames)
+	return list
+}
+
+func appendProtoCsvColumns(list *[]protoCsvColumn, descriptor protoreflect.MessageDescriptor, prefix string, path []protoreflect.FieldDescriptor, visited map[protoreflect.FullName]bool, useProtoNames bool) {
+
+	fields := descriptor.Fields()
+	for i := 0; i < fields.Len(); i++ {
+
+		fd := fields.Get(i)
+		name := prefix + protoFieldName(fd, useProtoNames)
+		fieldPath := append(append([]protoreflect.FieldDescriptor(nil), path...), fd)
+
+		if fd.Message() != nil && !fd.IsList() && !fd.IsMap() && !visited[fd.Message().FullName()] {
+			visited[fd.Message().FullName()] = true
+			appendProtoCsvColumns(list, fd.Message(), name + ".", fieldPath, visited, useProtoNames)
+			delete(visited, fd.Message().FullName())
+			continue
+		}
+
+		*list = append(*list, protoCsvColumn{
+			name: name,
+			path: fieldPath,
+			json: fd.Message() != nil || fd.IsMap(),
+		})
+	}
+}
+
+func (t *fileServiceImpl) ProtoCsvHeader(descriptor protoreflect.MessageDescriptor) []string {
+	var header []string
+	for _, col := range protoCsvColumns(descriptor, t.marshaler.MarshalOptions.UseProtoNames) {
+		header = append(header, col.name)
+	}
+	return header
+}
+
+/**
+Finds columns for the header, nil column if header name does not match any field.
+Both proto names and JSON names are accepted on reading.
+ */
+func (t *fileServiceImpl) protoCsvColumnsOf(header []string, descriptor protoreflect.MessageDescriptor) []*protoCsvColumn {
+
+	byName := make(map[string]*protoCsvColumn)
+	useProtoNames := t.marshaler.MarshalOptions.UseProtoNames
+	for _, opt := range []bool{ !useProtoNames, useProtoNames } {
+		columns := protoCsvColumns(descriptor, opt)
+		for i := range columns {
+			byName[columns[i].name] = &columns[i]
+		}
+	}
+
+	list := make([]*protoCsvColumn, len(header))
+	for i, name := range header {
+		list[i] = byName[name]
+	}
+	return list
+}
+
+func (t *fileServiceImpl) DecodeCsvProto(record fs.CsvRecord, message proto.Message) error {
+
+	var header []string
+	var values []string
+	if indexed, ok := record.(csvIndexed); ok {
+		index := indexed.columnIndex()
+		header = make([]string, len(index))
+		for name, i := range index {
+			if i >= 0 && i < len(header) {
+				header[i] = name
+			}
+		}
+		values = record.Record()
+	} else {
+		for name, value := range record.Fields() {
+			header = append(header, name)
+			values = append(values, value)
+		}
+	}
+
+	return t.decodeCsvProto(t.protoCsvColumnsOf(header, message.ProtoReflect().Descriptor()), values, message)
+}
+
+func (t *fileServiceImpl) decodeCsvProto(columns []*protoCsvColumn, values []string, message proto.Message) error {
+
+	m := message.ProtoReflect()
+	for i, col := range columns {
+		if col == nil || i >= len(values) || protoCsvEmpty(col, values[i]) {
+			continue
+		}
+		if err := t.decodeCsvProtoColumn(m, col, values[i]); err != nil {
+			return errors.Errorf("decode column '%s' error, %v", col.name, err)
+		}
+	}
+
+	return nil
+}
+
+/**
+Empty cell is an unset field, values from EmptyValues table are unset only for kinds that could not hold them as text.
+ */
+func protoCsvEmpty(col *protoCsvColumn, value string) bool {
+	if value == "" {
+		return true
+	}
+	if col.json {
+		return false
+	}
+	switch col.path[len(col.path)-1].Kind() {
+	case protoreflect.StringKind, protoreflect.BytesKind:
+		return false
+	}
+	return EmptyValues[value]
+}
+
+func (t *fileServiceImpl) decodeCsvProtoColumn(m protoreflect.Message, col *protoCsvColumn, value string) error {
+
+	n := len(col.path)
+	for _, fd := range col.path[:n-1] {
+		m = m.Mutable(fd).Message()
+	}
+	fd := col.path[n-1]
+
+	if col.json {
+		return t.decodeProtoJsonField(m, fd, value)
+	}
+
+	if fd.IsList() {
+		list := m.Mutable(fd).List()
+		for _, item := range splitRepeated(value, t.repeatedSeparator) {
+			v, err := decodeProtoScalar(fd, item)
+			if err != nil {
+				return err
+			}
+			list.Append(v)
+		}
+		return nil
+	}
+
+	v, err := decodeProtoScalar(fd, value)
+	if err != nil {
+		return err
+	}
+	m.Set(fd, v)
+	return nil
+}
+
+/**
+Unmarshals single field from JSON value through the temporary message of the same type.
+ */
+func (t *fileServiceImpl) decodeProtoJsonField(m protoreflect.Message, fd protoreflect.FieldDescriptor, value string) error {
+
+	wrapper, err := json.Marshal(map[string]json.RawMessage{ fd.JSONName(): json.RawMessage(value) })
+	if err != nil {
+		return err
+	}
+
+	tmp := m.New()
+	if err := t.marshaler.UnmarshalOptions.Unmarshal(wrapper, tmp.Interface()); err != nil {
+		return err
+	}
+
+	m.Set(fd, tmp.Get(fd))
+	return nil
+}
+
+func decodeProtoScalar(fd protoreflect.FieldDescriptor, value string) (protoreflect.Value, error) {
+
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(value), nil
+	case protoreflect.BytesKind:
+		b, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return protoreflect.Value{}, err
+		}
+		return protoreflect.ValueOfBytes(b), nil
+	case protoreflect.BoolKind:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return protoreflect.Value{}, err
+		}
+		return protoreflect.ValueOfBool(b), nil
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByName(protoreflect.Name(value)); ev != nil {
+			return protoreflect.ValueOfEnum(ev.Number()), nil
+		}
+		n, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return protoreflect.Value{}, errors.Errorf("unknown enum value '%s'", value)
+		}
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(n)), nil
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		n, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return protoreflect.Value{}, err
+		}
+		return protoreflect.ValueOfInt32(int32(n)), nil
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return protoreflect.Value{}, err
+		}
+		return protoreflect.ValueOfInt64(n), nil
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return protoreflect.Value{}, err
+		}
+		return protoreflect.ValueOfUint32(uint32(n)), nil
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return protoreflect.Value{}, err
+		}
+		return protoreflect.ValueOfUint64(n), nil
+	case protoreflect.FloatKind:
+		f, err := strconv.ParseFloat(value, 32)
+		if err != nil {
+			return protoreflect.Value{}, err
+		}
+		return protoreflect.ValueOfFloat32(float32(f)), nil
+	case protoreflect.DoubleKind:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return protoreflect.Value{}, err
+		}
+		return protoreflect.ValueOfFloat64(f), nil
+	}
+
+	return protoreflect.Value{}, errors.Errorf("unsupported field kind %s", fd.Kind())
+}
+
+func (t *fileServiceImpl) EncodeCsvProto(header []string, message proto.Message) ([]string, error) {
+	return t.encodeCsvProto(t.protoCsvColumnsOf(header, message.ProtoReflect().Descriptor()), message)
+}
+
+func (t *fileServiceImpl) encodeCsvProto(columns []*protoCsvColumn, message proto.Message) ([]string, error) {
+
+	record := make([]string, len(columns))
+	m := message.ProtoReflect()
+
+	for i, col := range columns {
+		if col == nil {
+			continue
+		}
+		value, err := t.encodeCsvProtoColumn(m, col)
+		if err != nil {
+			return nil, errors.Errorf("encode column '%s' error, %v", col.name, err)
+		}
+		record[i] = value
+	}
+
+	return record, nil
+}
+
+func (t *fileServiceImpl) encodeCsvProtoColumn(m protoreflect.Message, col *protoCsvColumn) (string, error) {
+
+	n := len(col.path)
+	for _, fd := range col.path[:n-1] {
+		if !m.Has(fd) {
+			return "", nil
+		}
+		m = m.Get(fd).Message()
+	}
+	fd := col.path[n-1]
+
+	if fd.HasPresence() && !m.Has(fd) {
+		return "", nil
+	}
+
+	if col.json {
+		if !m.Has(fd) {
+			return "", nil
+		}
+		return t.encodeProtoJsonField(m, fd)
+	}
+
+	if fd.IsList() {
+		list := m.Get(fd).List()
+		items := make([]string, list.Len())
+		for i := 0; i < list.Len(); i++ {
+			items[i] = encodeProtoScalar(fd, list.Get(i))
+		}
+		return joinRepeated(items, t.repeatedSeparator), nil
+	}
+
+	return encodeProtoScalar(fd, m.Get(fd)), nil
+}
+
+/**
+Joins repeated values escaping backslash and separator inside values by backslash.
+ */
+func joinRepeated(items []string, sep string) string {
+	if sep == "" {
+		return strings.Join(items, sep)
+	}
+	escaper := strings.NewReplacer(`\`, `\\`, sep, `\` + sep)
+	escaped := make([]string, len(items))
+	for i, item := range items {
+		escaped[i] = escaper.Replace(item)
+	}
+	return strings.Join(escaped, sep)
+}
+
+/**
+Splits repeated values by separator that is not escaped by backslash.
+ */
+func splitRepeated(value, sep string) []string {
+	if sep == "" {
+		return []string{ value }
+	}
+	var items []string
+	var sb strings.Builder
+	for i := 0; i < len(value); {
+		switch {
+		case value[i] == '\\' && strings.HasPrefix(value[i+1:], sep):
+			sb.WriteString(sep)
+			i += 1 + len(sep)
+		case value[i] == '\\' && i + 1 < len(value):
+			sb.WriteByte(value[i+1])
+			i += 2
+		case strings.HasPrefix(value[i:], sep):
+			items = append(items, sb.String())
+			sb.Reset()
+			i += len(sep)
+		default:
+			sb.WriteByte(value[i])
+			i++
+		}
+	}
+	return append(items, sb.String())
+}
+
+/**
+Marshals single field in to JSON value through the temporary message of the same type.
+ */
+func (t *fileServiceImpl) encodeProtoJsonField(m protoreflect.Message, fd protoreflect.FieldDescriptor) (string, error) {
+
+	tmp := m.New()
+	tmp.Set(fd, m.Get(fd))
+
+	opts := t.marshaler.MarshalOptions
+	opts.UseProtoNames = false
+	opts.EmitUnpopulated = false
+	opts.Multiline = false
+	jsonBin, err := opts.Marshal(tmp.Interface())
+	if err != nil {
+		return "", err
+	}
+
+	var wrapper map[string]json.RawMessage
+	if err := json.Unmarshal(jsonBin, &wrapper); err != nil {
+		return "", err
+	}
+	return string(wrapper[fd.JSONName()]), nil
+}
+
+func encodeProtoScalar(fd protoreflect.FieldDescriptor, v protoreflect.Value) string {
+
+	switch fd.Kind() {
+	case protoreflect.BytesKind:
+		return base64.StdEncoding.EncodeToString(v.Bytes())
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			return string(ev.Name())
+		}
+		return strconv.Itoa(int(v.Enum()))
+	case protoreflect.FloatKind:
+		return strconv.FormatFloat(v.Float(), 'g', -1, 32)
+	case protoreflect.DoubleKind:
+		return strconv.FormatFloat(v.Float(), 'g', -1, 64)
+	}
+
+	return v.String()
+}
+
+func (t *fileServiceImpl) ConvertCsvToProto(ctx context.Context, inputFilePath, outputFilePath string, holder proto.Message) error {
+
+	reader, err := t.OpenCsvFile(inputFilePath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	header, err := reader.Read()
+	if err != nil {
+		return errors.Errorf("can not read header in file '%s', %v", inputFilePath, err)
+	}
+	columns := t.protoCsvColumnsOf(append([]string(nil), header...), holder.ProtoReflect().Descriptor())
+
+	writer, err := t.NewAtomicProtoFile(outputFilePath)
+	if err != nil {
+		return err
+	}
+
+	for {
+
+		if err = ctx.Err(); err != nil {
+			break
+		}
+
+		var row []string
+		row, err = reader.Read()
+		if err != nil {
+			break
+		}
+
+		proto.Reset(holder)
+		if err = t.decodeCsvProto(columns, row, holder); err != nil {
+			err = errors.Errorf("convert file '%s', %v", inputFilePath, err)
+			break
+		}
+
+		if _, err = writer.Write(holder); err != nil {
+			break
+		}
+	}
+
+	if err == io.EOF {
+		err = nil
+	}
+
+	if err != nil {
+		writer.Abort()
+		return err
+	}
+
+	return writer.Close()
+}
+
+func (t *fileServiceImpl) ConvertProtoToCsv(ctx context.Context, inputFilePath, outputFilePath string, holder proto.Message) error {
+
+	reader, err := t.OpenProtoFile(inputFilePath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	header := t.ProtoCsvHeader(holder.ProtoReflect().Descriptor())
+	columns := t.protoCsvColumnsOf(header, holder.ProtoReflect().Descriptor())
+
+	writer, err := t.NewAtomicCsvFile(outputFilePath)
+	if err != nil {
+		return err
+	}
+
+	err = writer.Write(header...)
+
+	for err == nil {
+
+		if err = ctx.Err(); err != nil {
+			break
+		}
+
+		proto.Reset(holder)
+		err = reader.ReadTo(holder)
+		if err != nil {
+			break
+		}
+
+		var row []string
+		row, err = t.encodeCsvProto(columns, holder)
+		if err != nil {
+			err = errors.Errorf("convert file '%s', %v", inputFilePath, err)
+			break
+		}
+
+		err = writer.Write(row...)
+	}
+
+	if err == io.EOF {
+		err = nil
+	}
+
+	if err != nil {
+		writer.Abort()
+		return err
+	}
+
+	return writer.Close()
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod_test
+
+import (
+	"context"
+	"github.com/sprintframework/fsmod"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestProtoCsvConvert(t *testing.T) {
+
+	fs := fsmod.FileService()
+
+	fd, err := ioutil.TempFile(os.TempDir(), "proto-csv-test")
+	require.NoError(t, err)
+	filePath := fd.Name()
+	fd.Close()
+	os.Remove(filePath)
+
+	protoFilePath := filePath + ".pb"
+	csvFilePath := filePath + ".csv"
+	defer os.Remove(protoFilePath)
+	defer os.Remove(csvFilePath)
+
+	obj1 := &Domain{
+		Domain:  "obj1",
+		Options: []string{ "zone", "localhost" },
+		Certificates: &Certificates{
+			CertUrl:    "http://example.com",
+			PrivateKey: []byte{ 1, 2, 3 },
+		},
+		SelfIssuer: &SelfIssuer{
+			Certificate: []byte{ 4 },
+			Issuer: &SelfIssuer{
+				Certificate: []byte{ 5 },
+			},
+		},
+	}
+
+	obj2 := &Domain{
+		Domain: "obj2",
+		DnsProvider: "dns",
+	}
+
+	pf, err := fs.NewProtoFile(protoFilePath)
+	require.NoError(t, err)
+	_, err = pf.Write(obj1)
+	require.NoError(t, err)
+	_, err = pf.Write(obj2)
+	require.NoError(t, err)
+	require.NoError(t, pf.Close())
+
+	err = fs.ConvertProtoToCsv(context.Background(), protoFilePath, csvFilePath, new(Domain))
+	require.NoError(t, err)
+
+	reader, err := fs.OpenCsvFile(csvFilePath)
+	require.NoError(t, err)
+
+	file, err := reader.ReadHeader()
+	require.NoError(t, err)
+	require.Equal(t, fs.ProtoCsvHeader(new(Domain).ProtoReflect().Descriptor()), file.Header())
+	require.Contains(t, file.Header(), "certificates.cert_url")
+	require.Contains(t, file.Header(), "self_issuer.issuer")
+	require.NotContains(t, file.Header(), "self_issuer.issuer.certificate")
+
+	record, err := file.Next()
+	require.NoError(t, err)
+	require.Equal(t, "zone|localhost", record.Field("options", ""))
+	require.Equal(t, "http://example.com", record.Field("certificates.cert_url", ""))
+	require.Equal(t, "AQID", record.Field("certificates.private_key", ""))
+
+	var decoded Domain
+	err = fs.DecodeCsvProto(record, &decoded)
+	require.NoError(t, err)
+	require.True(t, proto.Equal(obj1, &decoded), decoded.String())
+
+	record, err = file.Next()
+	require.NoError(t, err)
+	require.Equal(t, "", record.Field("certificates.cert_url", "-"))
+
+	_, err = file.Next()
+	require.Equal(t, io.EOF, err)
+	require.NoError(t, reader.Close())
+
+	// Test reverse
+	os.Remove(protoFilePath)
+	err = fs.ConvertCsvToProto(context.Background(), csvFilePath, protoFilePath, new(Domain))
+	require.NoError(t, err)
+
+	pr, err := fs.OpenProtoFile(protoFilePath)
+	require.NoError(t, err)
+
+	var msg Domain
+	require.NoError(t, pr.ReadTo(&msg))
+	require.True(t, proto.Equal(obj1, &msg), msg.String())
+	require.NoError(t, pr.ReadTo(&msg))
+	require.True(t, proto.Equal(obj2, &msg), msg.String())
+	require.Equal(t, io.EOF, pr.ReadTo(&msg))
+	require.NoError(t, pr.Close())
+
+	// Test JSON names and separator
+	opts := fs.MarshalOptions()
+	opts.UseProtoNames = false
+	fs.SetMarshalOptions(opts)
+	fs.SetRepeatedSeparator(";")
+
+	header := fs.ProtoCsvHeader(new(Domain).ProtoReflect().Descriptor())
+	require.Contains(t, header, "certificates.certUrl")
+
+	row, err := fs.EncodeCsvProto([]string{ "domain", "options", "certificates.certUrl", "unknown" }, obj1)
+	require.NoError(t, err)
+	require.Equal(t, "obj1,zone;localhost,http://example.com,", strings.Join(row, ","))
+}
+
+func TestProtoCsvTextValues(t *testing.T) {
+
+	fs := fsmod.FileService()
+	header := fs.ProtoCsvHeader(new(Domain).ProtoReflect().Descriptor())
+
+	// empty values table does not apply to strings, separator inside values is escaped
+	obj := &Domain{
+		Domain:  "NaN",
+		Zone:    "null",
+		Options: []string{ "a|b", `c\d`, "N/A", "" },
+	}
+	record, err := fs.EncodeCsvProto(header, obj)
+	require.NoError(t, err)
+
+	decoded := new(Domain)
+	require.NoError(t, fs.DecodeCsvProto(fs.NewCsvSchema(header).Record(record), decoded))
+	require.True(t, proto.Equal(obj, decoded))
+}
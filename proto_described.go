@@ -0,0 +1,253 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"github.com/sprintframework/fs"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"io"
+)
+
+// magic of the descriptor header followed by the version byte
+var ProtoDescribedMagic = []byte{ 'F', 'S', 'P', 'D', 1 }
+
+/**
+Extension of the file service with self-describing protofiles.
+Described file starts with the header that contains full name of the message and serialized FileDescriptorSet with all dependencies.
+All proto readers skip the header, split and join accept nil holder for described files and keep the header in outputs.
+ */
+type DescribedProtoFileService interface {
+
+	/*
+	Creates protofile with the descriptor header of the message.
+	 */
+	NewDescribedProtoFile(filePath string, descriptor protoreflect.MessageDescriptor) (fs.ProtoWriter, error)
+
+	/*
+	Opens described protofile. Messages are created by linked Go type if it is registered, otherwise by dynamicpb.
+	 */
+	OpenDescribedProtoFile(filePath string) (DescribedProtoReader, error)
+}
+
+/**
+Reader of the described protofile.
+ */
+type DescribedProtoReader interface {
+	fs.ProtoReader
+
+	/*
+	Gets descriptor of the message stored in the file.
+	 */
+	Descriptor() protoreflect.MessageDescriptor
+
+	/*
+	Reads next message in to the new instance.
+	 */
+	Read() (proto.Message, error)
+}
+
+func (t *fileServiceImpl) NewDescribedProtoFile(filePath string, descriptor protoreflect.MessageDescriptor) (fs.ProtoWriter, error) {
+	if descriptor == nil {
+		return nil, errors.Errorf("descriptor is required for described file '%s'", filePath)
+	}
+	w, err := t.newProtoFile(filePath, false, descriptor)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (t *fileServiceImpl) OpenDescribedProtoFile(filePath string) (DescribedProtoReader, error) {
+
+	r, err := t.openProtoFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.messageType == nil {
+		r.Close()
+		return nil, errors.Errorf("file '%s' has no descriptor header", filePath)
+	}
+
+	return &describedProtoReader{ r }, nil
+}
+
+type describedProtoReader struct {
+	*protoFileReader
+}
+
+func (r *describedProtoReader) Descriptor() protoreflect.MessageDescriptor {
+	return r.messageType.Descriptor()
+}
+
+func (r *describedProtoReader) Read() (proto.Message, error) {
+	message := r.messageType.New().Interface()
+	if err := r.ReadTo(message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+/**
+Returns message type of the described protofile or nil if file has no header.
+ */
+func (t *fileServiceImpl) protoFileType(filePath string) (protoreflect.MessageType, error) {
+
+	reader, err := t.openProtoFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return reader.messageType, nil
+}
+
+/**
+Returns descriptor of the message type or nil if type is unknown.
+ */
+func describe(messageType protoreflect.MessageType) protoreflect.MessageDescriptor {
+	if messageType == nil {
+		return nil
+	}
+	return messageType.Descriptor()
+}
+
+/**
+Skips descriptor header and magic of the framed format, returns frame reader for framed format.
+ */
+func (t *fileServiceImpl) detectProtoHeaders(r io.Reader) (io.Reader, protoreflect.MessageType, *protoFrameReader, error) {
+	br, messageType, headerLen, err := readProtoDescriptor(r, t.maxMessageSize)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	out, frames := detectProtoFrames(br, headerLen, t.maxMessageSize)
+	return out, messageType, frames, nil
+}
+
+/**
+Writes descriptor header with the message and all files it depends on.
+ */
+func writeProtoDescriptor(w io.Writer, descriptor protoreflect.MessageDescriptor) error {
+
+	set := new(descriptorpb.FileDescriptorSet)
+	visited := make(map[string]bool)
+
+	var add func(file protoreflect.FileDescriptor)
+	add = func(file protoreflect.FileDescriptor) {
+		if visited[file.Path()] {
+			return
+		}
+		visited[file.Path()] = true
+		imports := file.Imports()
+		for i := 0; i < imports.Len(); i++ {
+			add(imports.Get(i).FileDescriptor)
+		}
+		set.File = append(set.File, protodesc.ToFileDescriptorProto(file))
+	}
+	add(descriptor.ParentFile())
+
+	blob, err := proto.Marshal(set)
+	if err != nil {
+		return errors.Errorf("descriptor marshal error, %v", err)
+	}
+
+	name := []byte(descriptor.FullName())
+	var buf bytes.Buffer
+	buf.Write(ProtoDescribedMagic)
+	binary.Write(&buf, binary.BigEndian, uint32(len(name)))
+	buf.Write(name)
+	binary.Write(&buf, binary.BigEndian, uint32(len(blob)))
+	buf.Write(blob)
+
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+/**
+Reads descriptor header if stream starts with it, returns nil message type otherwise.
+Also returns length of the header in bytes.
+ */
+func readProtoDescriptor(r io.Reader, maxSize int) (*bufio.Reader, protoreflect.MessageType, int64, error) {
+
+	br, described := peekMagic(r, ProtoDescribedMagic)
+	if !described {
+		return br, nil, 0, nil
+	}
+
+	limit := blockBuffer{ maxSize: maxSize }
+	readBlock := func() ([]byte, error) {
+		var lenBuf [4]byte
+		if _, err := io.ReadFull(br, lenBuf[:]); err != nil {
+			return nil, err
+		}
+		n := binary.BigEndian.Uint32(lenBuf[:])
+		if err := limit.checkSize(int64(n)); err != nil {
+			return nil, err
+		}
+		block := make([]byte, n)
+		_, err := io.ReadFull(br, block)
+		return block, err
+	}
+
+	name, err := readBlock()
+	if err != nil {
+		return nil, nil, 0, errors.Errorf("descriptor header read error, %v", err)
+	}
+
+	blob, err := readBlock()
+	if err != nil {
+		return nil, nil, 0, errors.Errorf("descriptor header read error, %v", err)
+	}
+
+	messageType, err := resolveMessageType(protoreflect.FullName(name), blob)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	headerLen := int64(len(ProtoDescribedMagic) + 4 + len(name) + 4 + len(blob))
+	return br, messageType, headerLen, nil
+}
+
+/**
+Returns linked Go type of the message if it is registered, otherwise dynamic type built from the descriptors.
+ */
+func resolveMessageType(name protoreflect.FullName, descriptorSet []byte) (protoreflect.MessageType, error) {
+
+	if messageType, err := protoregistry.GlobalTypes.FindMessageByName(name); err == nil {
+		return messageType, nil
+	}
+
+	set := new(descriptorpb.FileDescriptorSet)
+	if err := proto.Unmarshal(descriptorSet, set); err != nil {
+		return nil, errors.Errorf("descriptor unmarshal error, %v", err)
+	}
+
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, errors.Errorf("invalid descriptor of '%s', %v", name, err)
+	}
+
+	desc, err := files.FindDescriptorByName(name)
+	if err != nil {
+		return nil, errors.Errorf("message '%s' not found in descriptor, %v", name, err)
+	}
+
+	messageDesc, ok := desc.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, errors.Errorf("descriptor '%s' is not a message", name)
+	}
+
+	return dynamicpb.NewMessageType(messageDesc), nil
+}
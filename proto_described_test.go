@@ -0,0 +1,163 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod_test
+
+import (
+	"fmt"
+	"github.com/sprintframework/fsmod"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestProtoDescribed(t *testing.T) {
+
+	fs := fsmod.FileService()
+	fs.SetProtoIndexInterval(2)
+
+	for _, ext := range []string{ ".pb", ".pb.gz" } {
+
+		fd, err := ioutil.TempFile(os.TempDir(), "proto-described-test")
+		require.NoError(t, err)
+		filePath := fd.Name() + ext
+		fd.Close()
+		os.Remove(fd.Name())
+		defer os.Remove(filePath)
+		defer os.Remove(filePath + fsmod.ProtoIndexExtension)
+
+		writer, err := fs.NewDescribedProtoFile(filePath, (&Domain{}).ProtoReflect().Descriptor())
+		require.NoError(t, err)
+		for i := 0; i < 5; i++ {
+			_, err = writer.Write(&Domain{ Domain: fmt.Sprintf("obj%d", i) })
+			require.NoError(t, err)
+		}
+		require.NoError(t, writer.Close())
+
+		// plain reader skips the header
+		require.Equal(t, []string{ "obj0", "obj1", "obj2", "obj3", "obj4" }, readDomains(t, fs, filePath))
+
+		reader, err := fs.OpenDescribedProtoFile(filePath)
+		require.NoError(t, err)
+		require.Equal(t, protoreflect.FullName("sprint.Domain"), reader.Descriptor().FullName())
+		msg, err := reader.Read()
+		require.NoError(t, err)
+		require.Equal(t, "obj0", msg.(*Domain).Domain)
+		require.NoError(t, reader.Close())
+
+		seeker, err := fs.OpenProtoSeekFile(filePath)
+		require.NoError(t, err)
+		require.Equal(t, int64(5), seeker.Count())
+		require.NoError(t, seeker.SeekRecord(3))
+		var holder Domain
+		require.NoError(t, seeker.ReadTo(&holder))
+		require.Equal(t, "obj3", holder.Domain)
+		require.NoError(t, seeker.SeekRecord(0))
+		require.NoError(t, seeker.ReadTo(&holder))
+		require.Equal(t, "obj0", holder.Domain)
+		require.NoError(t, seeker.Close())
+
+		// split and join without holder keep the header
+		parts, err := fs.SplitProtoFile(filePath, nil, 2, func(i int) string {
+			return fmt.Sprintf("%s.part%d%s", fd.Name(), i, ext)
+		})
+		require.NoError(t, err)
+		require.Equal(t, 3, len(parts))
+
+		joinPath := fd.Name() + ".join" + ext
+		require.NoError(t, fs.JoinProtoFiles(joinPath, nil, parts))
+		for _, part := range parts {
+			os.Remove(part)
+			os.Remove(part + fsmod.ProtoIndexExtension)
+		}
+		defer os.Remove(joinPath)
+		defer os.Remove(joinPath + fsmod.ProtoIndexExtension)
+
+		joined, err := fs.OpenDescribedProtoFile(joinPath)
+		require.NoError(t, err)
+		var list []string
+		for {
+			msg, err := joined.Read()
+			if err != nil {
+				require.Equal(t, io.EOF, err)
+				break
+			}
+			list = append(list, msg.(*Domain).Domain)
+		}
+		require.NoError(t, joined.Close())
+		require.Equal(t, []string{ "obj0", "obj1", "obj2", "obj3", "obj4" }, list)
+	}
+
+}
+
+func TestProtoDescribedDynamic(t *testing.T) {
+
+	fs := fsmod.FileService()
+
+	// message type that is not linked in to the binary
+	file, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:    proto.String("fsmod/unlinked.proto"),
+		Package: proto.String("fsmod.unlinked"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Record"),
+			Field: []*descriptorpb.FieldDescriptorProto{{
+				Name:     proto.String("name"),
+				JsonName: proto.String("name"),
+				Number:   proto.Int32(1),
+				Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+				Type:     descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+			}},
+		}},
+	}, nil)
+	require.NoError(t, err)
+	desc := file.Messages().Get(0)
+
+	fd, err := ioutil.TempFile(os.TempDir(), "proto-described-test")
+	require.NoError(t, err)
+	filePath := fd.Name()
+	fd.Close()
+	defer os.Remove(filePath)
+
+	writer, err := fs.NewDescribedProtoFile(filePath, desc)
+	require.NoError(t, err)
+	msg := dynamicpb.NewMessage(desc)
+	msg.Set(desc.Fields().ByName("name"), protoreflect.ValueOfString("first"))
+	_, err = writer.Write(msg)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	reader, err := fs.OpenDescribedProtoFile(filePath)
+	require.NoError(t, err)
+	defer reader.Close()
+	require.Equal(t, protoreflect.FullName("fsmod.unlinked.Record"), reader.Descriptor().FullName())
+
+	read, err := reader.Read()
+	require.NoError(t, err)
+	_, ok := read.(*dynamicpb.Message)
+	require.True(t, ok)
+	field := read.ProtoReflect().Descriptor().Fields().ByName("name")
+	require.Equal(t, "first", read.ProtoReflect().Get(field).String())
+
+	_, err = reader.Read()
+	require.Equal(t, io.EOF, err)
+
+	// file without header is rejected
+	plainPath := filePath + ".plain"
+	plain, err := fs.NewProtoFile(plainPath)
+	require.NoError(t, err)
+	require.NoError(t, plain.Close())
+	defer os.Remove(plainPath)
+
+	_, err = fs.OpenDescribedProtoFile(plainPath)
+	require.Error(t, err)
+}
@@ -8,145 +8,163 @@ package fsmod
 import (
 	"bufio"
 	"bytes"
-	"compress/gzip"
+	"context"
 	"encoding/binary"
 	"github.com/sprintframework/fs"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
 	"github.com/pkg/errors"
 	"io"
+	iofs "io/fs"
 	"os"
-	"strings"
 )
 
 type protoStreamReader struct {
 	fd   io.Reader
 	fr   *bufio.Reader
-	gzr   *gzip.Reader
+	cr    io.ReadCloser
 	r     io.Reader
-	lenBuf  [4]byte
+	block   blockBuffer
+	frames  *protoFrameReader // nil for plain format
 }
 
 func (t *fileServiceImpl) ProtoStream(fr io.Reader, withGzip bool) (fs.ProtoReader, error) {
+	return t.ProtoCodecStream(fr, withGzipCodec(withGzip))
+}
+
+func (t *fileServiceImpl) ProtoCodecStream(fr io.Reader, codec Codec) (fs.ProtoReader, error) {
 
 	var err error
 	r := &protoStreamReader{
 		fd: fr,
+		block: t.newBlockBuffer(),
 	}
 
 	r.fr = bufio.NewReaderSize(r.fd, t.bufferSize)
 
-	if withGzip {
-		r.gzr, err = gzip.NewReader(r.fr)
+	if codec != nil {
+		r.cr, err = codec.NewReader(r.fr)
 		if err != nil {
-			return nil, errors.Errorf("gzip read error  %v", err)
+			return nil, errors.Errorf("codec '%s' read error, %v", codec.Extension(), err)
 		}
-		r.r = r.gzr
+		r.r = r.cr
 	} else {
 		r.r = r.fr
 	}
 
+	r.r, _, r.frames, err = t.detectProtoHeaders(r.r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
 	return r, nil
 
 }
 
 func (r *protoStreamReader) Close() error {
-	if r.gzr != nil {
-		r.gzr.Close()
+	if r.cr != nil {
+		r.cr.Close()
 	}
 	return nil
 }
 
 func (r *protoStreamReader) ReadTo(message proto.Message) error {
 
-	lenBuf := r.lenBuf[:]
-
-	n, err := io.ReadFull(r.r, lenBuf)
-	if err != nil {
-		return err
-	} else if n != len(lenBuf) {
-		return errors.Errorf("wrong number read %d, expected %d", n, len(lenBuf))
+	if r.frames != nil {
+		return r.frames.readTo(message)
 	}
 
-	blockLen := int(binary.BigEndian.Uint32(lenBuf))
-
-	block := make([]byte, blockLen)
-	n, err = io.ReadFull(r.r, block)
+	block, err := r.block.readBlock(r.r)
 	if err != nil {
 		return err
-	} else if n != len(block) {
-		return errors.Errorf("wrong read bytes %d expected %d", n, len(block))
 	}
 
 	return proto.Unmarshal(block, message)
 }
 
 type protoFileReader struct {
-	fd   *os.File
+	fd   iofs.File
 	fr   *bufio.Reader
-	gzr   *gzip.Reader
+	cr    io.ReadCloser
 	r     io.Reader
-	lenBuf  [4]byte
+	block   blockBuffer
+	frames  *protoFrameReader // nil for plain format
+	messageType protoreflect.MessageType // nil if file has no descriptor header
 }
 
 func (t *fileServiceImpl) OpenProtoFile(filePath string) (fs.ProtoReader, error) {
+	r, err := t.openProtoFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
 
-	fd, err := os.Open(filePath)
+func (t *fileServiceImpl) openProtoFile(filePath string) (*protoFileReader, error) {
+
+	fd, err := t.fsys.Open(filePath)
 	if err != nil {
 		return nil, errors.Errorf("file open error '%s', %v", filePath, err)
 	}
 
-	return t.ProtoFile(fd)
+	return t.protoFile(filePath, fd)
 }
 
 func (t *fileServiceImpl) ProtoFile(fd *os.File) (fs.ProtoReader, error) {
+	r, err := t.protoFile(fd.Name(), fd)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (t *fileServiceImpl) protoFile(filePath string, fd iofs.File) (*protoFileReader, error) {
 
 	var err error
 	r := &protoFileReader{
 		fd: fd,
+		block: t.newBlockBuffer(),
 	}
 
 	r.fr = bufio.NewReaderSize(r.fd, t.bufferSize)
 
-	if strings.HasSuffix(fd.Name(), ".gz") {
-		r.gzr, err = gzip.NewReader(r.fr)
+	if codec := t.detectCodec(filePath, r.fr); codec != nil {
+		r.cr, err = codec.NewReader(r.fr)
 		if err != nil {
-			return nil, errors.Errorf("gzip read error in '%s', %v", fd.Name(), err)
+			return nil, errors.Errorf("codec '%s' read error in '%s', %v", codec.Extension(), filePath, err)
 		}
-		r.r = r.gzr
+		r.r = r.cr
 	} else {
 		r.r = r.fr
 	}
 
+	r.r, r.messageType, r.frames, err = t.detectProtoHeaders(r.r)
+	if err != nil {
+		r.Close()
+		return nil, errors.Errorf("header read error in '%s', %v", filePath, err)
+	}
+
 	return r, nil
 
 }
 
 func (r *protoFileReader) Close() error {
-	if r.gzr != nil {
-		r.gzr.Close()
+	if r.cr != nil {
+		r.cr.Close()
 	}
 	return r.fd.Close()
 }
 
 func (r *protoFileReader) ReadTo(message proto.Message) error {
 
-	lenBuf := r.lenBuf[:]
-
-	n, err := io.ReadFull(r.r, lenBuf)
-	if err != nil {
-		return err
-	} else if n != len(lenBuf) {
-		return errors.Errorf("wrong number read %d, expected %d", n, len(lenBuf))
+	if r.frames != nil {
+		return r.frames.readTo(message)
 	}
 
-	blockLen := int(binary.BigEndian.Uint32(lenBuf))
-
-	block := make([]byte, blockLen)
-	n, err = io.ReadFull(r.r, block)
+	block, err := r.block.readBlock(r.r)
 	if err != nil {
 		return err
-	} else if n != len(block) {
-		return errors.Errorf("wrong read bytes %d expected %d", n, len(block))
 	}
 
 	return proto.Unmarshal(block, message)
@@ -155,57 +173,88 @@ func (r *protoFileReader) ReadTo(message proto.Message) error {
 type protoStreamWriter struct {
 	fd   io.Writer
 	fw   *bufio.Writer
-	gzw  *gzip.Writer
+	cw   io.WriteCloser
 	bw   *bufio.Writer
 	w    io.Writer
+	write protoWriteFn
 }
 
 func (t *fileServiceImpl) NewProtoStream(fd io.Writer, withGzip bool) fs.ProtoWriter {
+	w, err := t.NewProtoCodecStream(fd, withGzipCodec(withGzip))
+	if err != nil {
+		// signature of the fs interface has no error, it is returned by the first call of the writer
+		return protoFailedStream{ err: err }
+	}
+	return w
+}
 
+/**
+Writer of the stream that could not be created.
+ */
+type protoFailedStream struct {
+	err error
+}
+
+func (w protoFailedStream) Write(message proto.Message) ([]byte, error) {
+	return nil, w.err
+}
+
+func (w protoFailedStream) Close() error {
+	return w.err
+}
+
+func (t *fileServiceImpl) NewProtoCodecStream(fd io.Writer, codec Codec) (fs.ProtoWriter, error) {
+
+	var err error
 	w := &protoStreamWriter{
 		fd:              fd,
 	}
 
 	w.fw = bufio.NewWriterSize(fd, t.bufferSize)
 
-	if withGzip {
-		w.gzw = gzip.NewWriter(w.fw)
-		w.bw = bufio.NewWriterSize(w.gzw, t.bufferSize)
+	if codec != nil {
+		w.cw, err = codec.NewWriter(w.fw)
+		if err != nil {
+			return nil, errors.Errorf("codec '%s' write error, %v", codec.Extension(), err)
+		}
+		w.bw = bufio.NewWriterSize(w.cw, t.bufferSize)
 		w.w = w.bw
 	} else {
 		w.w = w.fw
 	}
 
-	return w
+	if w.write, err = t.protoWriter(w.w); err != nil {
+		return nil, err
+	}
+
+	return w, nil
 }
 
 func (w *protoStreamWriter) Close() (err error) {
 	if w.bw != nil {
 		w.bw.Flush()
 	}
-	if w.gzw != nil {
-		w.gzw.Flush()
-		err = w.gzw.Close()
+	if w.cw != nil {
+		err = w.cw.Close()
 	}
 	w.fw.Flush()
 	return err
 }
 
 func (w *protoStreamWriter) Write(message proto.Message) ([]byte, error) {
-	return protobufWrite(w.w, message)
+	return w.write(w.w, message)
 }
 
-func protobufWrite(w io.Writer, message proto.Message) ([]byte, error) {
+func protobufWrite(w io.Writer, message proto.Message, framing ProtoFraming) ([]byte, error) {
 
-	var lenBufArr  [4]byte
-	lenBuf := lenBufArr[:]
+	var lenBufArr  [binary.MaxVarintLen64]byte
 
 	blob, err := proto.Marshal(message)
 	if err != nil {
 		return nil, errors.Errorf("proto marshal error, %v", err)
 	}
 
-	binary.BigEndian.PutUint32(lenBuf, uint32(len(blob)))
+	lenBuf := appendProtoLength(lenBufArr[:0], framing, len(blob))
 
 	if n, err := w.Write(lenBuf); err != nil {
 		return blob, err
@@ -224,23 +273,36 @@ func protobufWrite(w io.Writer, message proto.Message) ([]byte, error) {
 
 type protoBufWriter struct {
 	fw   bytes.Buffer
-	gzw  *gzip.Writer
+	cw   io.WriteCloser
 	bw   *bufio.Writer
 	w    io.Writer
+	write protoWriteFn
 }
 
 func (t *fileServiceImpl) NewProtoBuf(withGzip bool) (fs.ProtoWriter, error) {
+	return t.NewProtoCodecBuf(withGzipCodec(withGzip))
+}
 
+func (t *fileServiceImpl) NewProtoCodecBuf(codec Codec) (fs.ProtoWriter, error) {
+
+	var err error
 	w := new(protoBufWriter)
 
-	if withGzip {
-		w.gzw = gzip.NewWriter(&w.fw)
-		w.bw = bufio.NewWriterSize(w.gzw, t.bufferSize)
+	if codec != nil {
+		w.cw, err = codec.NewWriter(&w.fw)
+		if err != nil {
+			return nil, errors.Errorf("codec '%s' write error, %v", codec.Extension(), err)
+		}
+		w.bw = bufio.NewWriterSize(w.cw, t.bufferSize)
 		w.w = w.bw
 	} else {
 		w.w = &w.fw
 	}
 
+	if w.write, err = t.protoWriter(w.w); err != nil {
+		return nil, err
+	}
+
 	return w, nil
 }
 
@@ -248,9 +310,8 @@ func (w *protoBufWriter) Close() error {
 	if w.bw != nil {
 		w.bw.Flush()
 	}
-	if w.gzw != nil {
-		w.gzw.Flush()
-		w.gzw.Close()
+	if w.cw != nil {
+		w.cw.Close()
 	}
 	return nil
 }
@@ -264,70 +325,180 @@ func (w *protoBufWriter) Bytes() []byte {
 }
 
 func (w *protoBufWriter) Write(message proto.Message) ([]byte, error) {
-	return protobufWrite(w.w, message)
+	return w.write(w.w, message)
 }
 
 type protoFileWriter struct {
-	fd   *os.File
+	fsys FileSystem
+	fd   WritableFile
 	fw   *bufio.Writer
-	gzw  *gzip.Writer
+	cw   io.WriteCloser
 	bw   *bufio.Writer
 	w    io.Writer
+	atomicPath string
+	codec Codec
+	index *protoIndex // nil if index is disabled
+	write protoWriteFn
 }
 
 func (t *fileServiceImpl) NewProtoFile(filePath string) (fs.ProtoWriter, error) {
+	w, err := t.newProtoFile(filePath, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (t *fileServiceImpl) NewAtomicProtoFile(filePath string) (AtomicProtoWriter, error) {
+	w, err := t.newProtoFile(filePath, true, nil)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (t *fileServiceImpl) newProtoFile(filePath string, atomic bool, descriptor protoreflect.MessageDescriptor) (*protoFileWriter, error) {
 
 	var err error
 	w := new(protoFileWriter)
+	w.fsys = t.fsys
 
-	w.fd, err = os.Create(filePath)
+	w.fd, err = t.createFile(filePath, atomic)
 	if err != nil {
-		return nil, errors.Errorf("file create error '%s', %v", filePath, err)
+		return nil, err
+	}
+	if atomic {
+		w.atomicPath = filePath
 	}
 
 	w.fw = bufio.NewWriterSize(w.fd, t.bufferSize)
+	var out io.Writer = w.fw
+
+	w.codec = t.FileCodec(filePath)
+	if t.protoIndexInterval > 0 {
+		w.index = &protoIndex{
+			interval:   t.protoIndexInterval,
+			compressed: w.codec != nil,
+			counter:    &countingWriter{ w: w.fw },
+		}
+		out = w.index.counter
+	}
 
-	if strings.HasSuffix(filePath, ".gz") {
-		w.gzw = gzip.NewWriter(w.fw)
-		w.bw = bufio.NewWriterSize(w.gzw, t.bufferSize)
+	if w.codec != nil {
+		w.cw, err = w.codec.NewWriter(out)
+		if err != nil {
+			abortFile(w.fsys, w.fd)
+			return nil, errors.Errorf("codec '%s' write error in '%s', %v", w.codec.Extension(), filePath, err)
+		}
+		w.bw = bufio.NewWriterSize(w.cw, t.bufferSize)
 		w.w = w.bw
 	} else {
-		w.w = w.fw
+		w.w = out
+	}
+
+	if descriptor != nil {
+		if err = writeProtoDescriptor(w.w, descriptor); err != nil {
+			w.Abort()
+			return nil, errors.Errorf("write descriptor error in '%s', %v", filePath, err)
+		}
+	}
+
+	if w.write, err = t.protoWriter(w.w); err != nil {
+		w.Abort()
+		return nil, errors.Errorf("write header error in '%s', %v", filePath, err)
 	}
 
 	return w, nil
 }
 
 func (w *protoFileWriter) Close() error {
+	var err error
 	if w.bw != nil {
-		w.bw.Flush()
+		err = w.bw.Flush()
+	}
+	if w.cw != nil {
+		if closeErr := w.cw.Close(); err == nil {
+			err = closeErr
+		}
 	}
-	if w.gzw != nil {
-		w.gzw.Flush()
-		w.gzw.Close()
+	if flushErr := w.fw.Flush(); err == nil {
+		err = flushErr
 	}
-	w.fw.Flush()
-	return w.fd.Close()
+	filePath := w.fd.Name()
+	if w.atomicPath != "" {
+		filePath = w.atomicPath
+	}
+	if err = closeFile(w.fsys, w.fd, w.atomicPath, err); err != nil {
+		return err
+	}
+	if w.index == nil {
+		// index of the previous content would point to wrong offsets
+		if err = w.fsys.Remove(filePath + ProtoIndexExtension); errors.Is(err, iofs.ErrNotExist) {
+			err = nil
+		}
+		return err
+	}
+	return writeProtoIndex(w.fsys, filePath, w.index)
+}
+
+func (w *protoFileWriter) Abort() error {
+	if w.cw != nil {
+		w.cw.Close()
+	}
+	return abortFile(w.fsys, w.fd)
 }
 
 func (w *protoFileWriter) Write(message proto.Message) ([]byte, error) {
-	return protobufWrite(w.w, message)
+	if w.index != nil {
+		if err := w.checkpoint(); err != nil {
+			return nil, err
+		}
+	}
+	return w.write(w.w, message)
 }
 
 func (t *fileServiceImpl) SplitProtoFile(inputFilePath string, holder proto.Message, limit int, partFn func (int) string) ([]string, error) {
+	return t.SplitProtoFileContext(context.Background(), inputFilePath, holder, limit, partFn)
+}
+
+func (t *fileServiceImpl) SplitProtoFileContext(ctx context.Context, inputFilePath string, holder proto.Message, limit int, partFn func (int) string) ([]string, error) {
+	return splitParts(t.splitProtoFile(ctx, inputFilePath, holder, limit, partFn))
+}
 
-	reader, err := t.OpenProtoFile(inputFilePath)
+/**
+Splits protofile and counts split records.
+ */
+func (t *fileServiceImpl) splitProtoFile(ctx context.Context, inputFilePath string, holder proto.Message, limit int, partFn func (int) string) (*splitResult, error) {
+
+	if t.parallelism > 1 {
+		return t.parallelSplitProtoFile(ctx, inputFilePath, holder, limit, partFn)
+	}
+
+	reader, err := t.openProtoFile(inputFilePath)
 	if err != nil {
 		return nil, err
 	}
 	defer reader.Close()
 
+	messageType := reader.messageType
+	if holder == nil {
+		if messageType == nil {
+			return nil, errors.Errorf("holder is required for file '%s' without descriptor header", inputFilePath)
+		}
+		holder = messageType.New().Interface()
+	}
+
 	var parts []string
-	var writer fs.ProtoWriter
+	var records int64
+	var writer *protoFileWriter
 
 	partNum := 1
 	for cnt := limit; err == nil; cnt++ {
 
+		if err = ctx.Err(); err != nil {
+			break
+		}
+
 		err = reader.ReadTo(holder)
 		if err != nil {
 			break
@@ -335,11 +506,14 @@ func (t *fileServiceImpl) SplitProtoFile(inputFilePath string, holder proto.Mess
 
 		if cnt == limit {
 			if writer != nil {
-				writer.Close()
+				err = writer.Close()
 				writer = nil
+				if err != nil {
+					break
+				}
 			}
 			partFilePath := partFn(partNum)
-			writer, err = t.NewProtoFile(partFilePath)
+			writer, err = t.newProtoFile(partFilePath, true, describe(messageType))
 			if err != nil {
 				break
 			}
@@ -349,6 +523,7 @@ func (t *fileServiceImpl) SplitProtoFile(inputFilePath string, holder proto.Mess
 		}
 
 		_, err = writer.Write(holder)
+		records++
 	}
 
 	if err == io.EOF {
@@ -356,27 +531,68 @@ func (t *fileServiceImpl) SplitProtoFile(inputFilePath string, holder proto.Mess
 	}
 
 	if writer != nil {
-		writer.Close()
+		if err != nil {
+			writer.Abort()
+		} else {
+			err = writer.Close()
+		}
 	}
 
 	if err != nil {
 		for _, part := range parts {
-			os.Remove(part)
+			t.fsys.Remove(part)
 		}
-		parts = nil
+		return nil, err
 	}
 
-	return parts, err
+	return &splitResult{ parts: parts, records: records }, nil
 }
 
 func (t *fileServiceImpl) JoinProtoFiles(outputFilePath string, row proto.Message, parts []string) error {
+	return t.JoinProtoFilesContext(context.Background(), outputFilePath, row, parts)
+}
+
+func (t *fileServiceImpl) JoinProtoFilesContext(ctx context.Context, outputFilePath string, row proto.Message, parts []string) error {
+	messageType, err := t.partsMessageType(parts)
+	if err != nil {
+		return err
+	}
+	return t.joinProtoFiles(ctx, outputFilePath, row, messageType, parts)
+}
 
-	writer, err := t.NewProtoFile(outputFilePath)
+/**
+Gets message type from the descriptor header of the first part, nil if there is no header.
+ */
+func (t *fileServiceImpl) partsMessageType(parts []string) (protoreflect.MessageType, error) {
+	if len(parts) == 0 {
+		return nil, nil
+	}
+	messageType, err := t.protoFileType(parts[0])
+	if err != nil {
+		return nil, errors.Errorf("can not open file '%s', %v", parts[0], err)
+	}
+	return messageType, nil
+}
+
+func (t *fileServiceImpl) joinProtoFiles(ctx context.Context, outputFilePath string, row proto.Message, messageType protoreflect.MessageType, parts []string) error {
+
+	if row == nil {
+		if messageType == nil {
+			return errors.Errorf("row is required for files without descriptor header")
+		}
+		row = messageType.New().Interface()
+	}
+
+	writer, err := t.newProtoFile(outputFilePath, false, describe(messageType))
 	if err != nil {
 		return err
 	}
 	defer writer.Close()
 
+	if t.parallelism > 1 {
+		return t.parallelJoinProtoFiles(ctx, writer, outputFilePath, row, parts)
+	}
+
 	for _, part := range parts {
 
 		reader, err := t.OpenProtoFile(part)
@@ -386,6 +602,11 @@ func (t *fileServiceImpl) JoinProtoFiles(outputFilePath string, row proto.Messag
 
 		for {
 
+			if err = ctx.Err(); err != nil {
+				reader.Close()
+				return err
+			}
+
 			err = reader.ReadTo(row)
 			if err != nil {
 				break
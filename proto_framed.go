@@ -0,0 +1,297 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sprintframework/fs"
+	"google.golang.org/protobuf/proto"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+)
+
+/**
+Format of records written by proto writers. Readers detect the format by the magic header.
+ */
+type ProtoFormat int
+
+const (
+	// records prefixed by uint32 length, compatible with previous versions
+	ProtoFormatPlain ProtoFormat = iota
+	// file starts with magic header, each record has checksum of the length and CRC32C of the body
+	ProtoFormatFramed
+)
+
+// magic header of the framed format followed by the version byte
+var ProtoFramedMagic = []byte{ 'F', 'S', 'P', 'F', 1 }
+
+const protoFrameHeaderLen = 8
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+/**
+Extension of the file service with checksums of records and recovery of damaged protofiles.
+ */
+type ProtoFramedFileService interface {
+
+	/*
+	Gets format of records written by proto writers, default value is ProtoFormatPlain.
+	 */
+	ProtoFormat() ProtoFormat
+
+	/*
+	Sets format of records written by proto writers.
+	 */
+	SetProtoFormat(format ProtoFormat)
+
+	/*
+	Opens framed protofile that skips corrupted records instead of failing the whole file.
+	Each corrupted region is passed to the report function, reader resynchronizes on the next valid frame.
+	 */
+	OpenProtoRecoveryFile(filePath string, report func(*CorruptedRecordError)) (fs.ProtoReader, error)
+}
+
+/**
+Error returned on corrupted record in framed protofile.
+ */
+type CorruptedRecordError struct {
+	Offset  int64  // offset of the record in the uncompressed stream
+	Length  int64  // number of skipped bytes
+	Reason  string
+}
+
+func (e *CorruptedRecordError) Error() string {
+	return fmt.Sprintf("corrupted record at offset %d, length %d, %s", e.Offset, e.Length, e.Reason)
+}
+
+func (t *fileServiceImpl) ProtoFormat() ProtoFormat {
+	return t.protoFormat
+}
+
+func (t *fileServiceImpl) SetProtoFormat(format ProtoFormat) {
+	t.protoFormat = format
+}
+
+type protoWriteFn func(w io.Writer, message proto.Message) ([]byte, error)
+
+/**
+Writes magic header if needed and returns the function writing records in the current format.
+ */
+func (t *fileServiceImpl) protoWriter(w io.Writer) (protoWriteFn, error) {
+	if t.protoFormat == ProtoFormatFramed {
+		if _, err := w.Write(ProtoFramedMagic); err != nil {
+			return nil, err
+		}
+		return protobufFrameWrite, nil
+	}
+	framing := t.protoFraming
+	return func(w io.Writer, message proto.Message) ([]byte, error) {
+		return protobufWrite(w, message, framing)
+	}, nil
+}
+
+func protobufFrameWrite(w io.Writer, message proto.Message) ([]byte, error) {
+
+	var header [protoFrameHeaderLen]byte
+
+	blob, err := proto.Marshal(message)
+	if err != nil {
+		return nil, errors.Errorf("proto marshal error, %v", err)
+	}
+
+	binary.BigEndian.PutUint32(header[:4], uint32(len(blob)))
+	binary.BigEndian.PutUint32(header[4:], crc32.Checksum(header[:4], crc32c))
+
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.Checksum(blob, crc32c))
+
+	for _, b := range [][]byte{ header[:], blob, sum[:] } {
+		if n, err := w.Write(b); err != nil {
+			return blob, err
+		} else if n != len(b) {
+			return blob, errors.Errorf("wrong number written %d, expected %d", n, len(b))
+		}
+	}
+
+	return blob, nil
+}
+
+/**
+Detects framed format by the magic header and skips it, returns buffered reader in any case.
+ */
+func detectProtoFormat(r io.Reader) (*bufio.Reader, bool) {
+	return peekMagic(r, ProtoFramedMagic)
+}
+
+/**
+Skips magic if stream starts with it, returns buffered reader in any case.
+ */
+func peekMagic(r io.Reader, magic []byte) (*bufio.Reader, bool) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	head, _ := br.Peek(len(magic))
+	if bytes.Equal(head, magic) {
+		br.Discard(len(head))
+		return br, true
+	}
+	return br, false
+}
+
+/**
+Returns frame reader if stream starts with the magic header, offset is the position of the stream in file.
+ */
+func detectProtoFrames(r io.Reader, offset int64, maxSize int) (io.Reader, *protoFrameReader) {
+	br, framed := detectProtoFormat(r)
+	if framed {
+		return br, newProtoFrameReader(br, offset + int64(len(ProtoFramedMagic)), maxSize)
+	}
+	return br, nil
+}
+
+type protoFrameReader struct {
+	r       *bufio.Reader
+	offset  int64
+	header  [protoFrameHeaderLen]byte
+	block   blockBuffer
+	report  func(*CorruptedRecordError) // nil if recovery is disabled
+}
+
+func newProtoFrameReader(r *bufio.Reader, offset int64, maxSize int) *protoFrameReader {
+	return &protoFrameReader{ r: r, offset: offset, block: blockBuffer{ maxSize: maxSize } }
+}
+
+func (f *protoFrameReader) readTo(message proto.Message) error {
+	block, err := f.next()
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(block, message)
+}
+
+/**
+Reads body of the next valid record.
+ */
+func (f *protoFrameReader) next() ([]byte, error) {
+
+	for {
+
+		start := f.offset
+		n, err := io.ReadFull(f.r, f.header[:])
+		f.offset += int64(n)
+		if err == io.ErrUnexpectedEOF {
+			return nil, f.corrupted(start, int64(n), "truncated frame header", io.EOF)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if !f.validHeader() {
+			if f.report == nil {
+				return nil, &CorruptedRecordError{ Offset: start, Length: protoFrameHeaderLen, Reason: "invalid frame header" }
+			}
+			err = f.resync()
+			if err != nil {
+				f.report(&CorruptedRecordError{ Offset: start, Length: f.offset - start, Reason: "invalid frame header" })
+				return nil, err
+			}
+			next := f.offset - protoFrameHeaderLen
+			f.report(&CorruptedRecordError{ Offset: start, Length: next - start, Reason: "invalid frame header" })
+			start = next
+		}
+
+		blockLen := int(binary.BigEndian.Uint32(f.header[:4]))
+		if err := f.block.checkSize(int64(blockLen)); err != nil {
+			if f.report == nil {
+				return nil, err
+			}
+			// header is valid, so oversized record is skipped without reading it in to memory
+			n, skipErr := io.CopyN(ioutil.Discard, f.r, int64(blockLen) + 4)
+			f.offset += n
+			f.report(&CorruptedRecordError{ Offset: start, Length: f.offset - start, Reason: err.Error() })
+			if skipErr != nil {
+				return nil, io.EOF
+			}
+			continue
+		}
+
+		block := f.block.get(blockLen + 4)
+		n, err = io.ReadFull(f.r, block)
+		f.offset += int64(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, f.corrupted(start, f.offset - start, "truncated record", io.EOF)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		block, sum := block[:blockLen], block[blockLen:]
+		if binary.BigEndian.Uint32(sum) != crc32.Checksum(block, crc32c) {
+			if err := f.corrupted(start, f.offset - start, "checksum mismatch", nil); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		return block, nil
+	}
+}
+
+/**
+Reports corruption and returns recovery error, or returns corruption itself when recovery is disabled.
+ */
+func (f *protoFrameReader) corrupted(offset, length int64, reason string, recoveryErr error) error {
+	corruption := &CorruptedRecordError{ Offset: offset, Length: length, Reason: reason }
+	if f.report == nil {
+		return corruption
+	}
+	f.report(corruption)
+	return recoveryErr
+}
+
+func (f *protoFrameReader) validHeader() bool {
+	return binary.BigEndian.Uint32(f.header[4:]) == crc32.Checksum(f.header[:4], crc32c)
+}
+
+/**
+Slides header window by one byte until it finds valid frame header.
+ */
+func (f *protoFrameReader) resync() error {
+	for {
+		b, err := f.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		f.offset++
+		copy(f.header[:], f.header[1:])
+		f.header[protoFrameHeaderLen - 1] = b
+		if f.validHeader() {
+			return nil
+		}
+	}
+}
+
+func (t *fileServiceImpl) OpenProtoRecoveryFile(filePath string, report func(*CorruptedRecordError)) (fs.ProtoReader, error) {
+
+	r, err := t.openProtoFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.frames == nil {
+		r.Close()
+		return nil, errors.Errorf("file '%s' is not in framed format", filePath)
+	}
+	r.frames.report = report
+
+	return r, nil
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod_test
+
+import (
+	"fmt"
+	"github.com/sprintframework/fsmod"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestProtoFramed(t *testing.T) {
+
+	fs := fsmod.FileService()
+	fs.SetProtoFormat(fsmod.ProtoFormatFramed)
+	fs.SetProtoIndexInterval(2)
+
+	fd, err := ioutil.TempFile(os.TempDir(), "proto-framed-test")
+	require.NoError(t, err)
+	filePath := fd.Name()
+	fd.Close()
+	defer os.Remove(filePath)
+	defer os.Remove(filePath + fsmod.ProtoIndexExtension)
+
+	writer, err := fs.NewProtoFile(filePath)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = writer.Write(&Domain{ Domain: fmt.Sprintf("obj%d", i) })
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Close())
+
+	content, err := ioutil.ReadFile(filePath)
+	require.NoError(t, err)
+	require.Equal(t, fsmod.ProtoFramedMagic, content[:len(fsmod.ProtoFramedMagic)])
+
+	// plain reader detects format
+	require.Equal(t, []string{ "obj0", "obj1", "obj2", "obj3", "obj4" }, readDomains(t, fs, filePath))
+
+	seeker, err := fs.OpenProtoSeekFile(filePath)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), seeker.Count())
+	require.NoError(t, seeker.SeekRecord(3))
+	var msg Domain
+	require.NoError(t, seeker.ReadTo(&msg))
+	require.Equal(t, "obj3", msg.Domain)
+	require.NoError(t, seeker.Close())
+
+	// each record is 8 bytes of header, 6 bytes of body and 4 bytes of checksum
+	recordOffset := func(n int) int { return len(fsmod.ProtoFramedMagic) + n * 18 }
+
+	damaged := append([]byte(nil), content...)
+	damaged[recordOffset(1) + 10] ^= 0x01 // body of obj1
+	damaged[recordOffset(3) + 1] ^= 0x80  // length of obj3
+	require.NoError(t, ioutil.WriteFile(filePath, damaged, 0644))
+
+	reader, err := fs.OpenProtoFile(filePath)
+	require.NoError(t, err)
+	require.NoError(t, reader.ReadTo(&msg))
+	err = reader.ReadTo(&msg)
+	corrupted, ok := err.(*fsmod.CorruptedRecordError)
+	require.True(t, ok, err)
+	require.Equal(t, int64(recordOffset(1)), corrupted.Offset)
+	require.NoError(t, reader.Close())
+
+	var reports []*fsmod.CorruptedRecordError
+	reader, err = fs.OpenProtoRecoveryFile(filePath, func(e *fsmod.CorruptedRecordError) {
+		reports = append(reports, e)
+	})
+	require.NoError(t, err)
+
+	var list []string
+	for {
+		if err = reader.ReadTo(&msg); err != nil {
+			break
+		}
+		list = append(list, msg.Domain)
+	}
+	require.Equal(t, io.EOF, err)
+	require.NoError(t, reader.Close())
+
+	require.Equal(t, []string{ "obj0", "obj2", "obj4" }, list)
+	require.Equal(t, 2, len(reports))
+	require.Equal(t, int64(recordOffset(1)), reports[0].Offset)
+	require.Equal(t, int64(18), reports[0].Length)
+	require.Equal(t, int64(recordOffset(3)), reports[1].Offset)
+	require.Equal(t, int64(18), reports[1].Length)
+
+	// recovery needs framed format
+	fs.SetProtoFormat(fsmod.ProtoFormatPlain)
+	writer, err = fs.NewProtoFile(filePath)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	_, err = fs.OpenProtoRecoveryFile(filePath, nil)
+	require.Error(t, err)
+}
+
+func readDomains(t *testing.T, fs fsmod.ExtendedFileService, filePath string) []string {
+
+	reader, err := fs.OpenProtoFile(filePath)
+	require.NoError(t, err)
+	defer reader.Close()
+
+	var list []string
+	for {
+		var msg Domain
+		if err = reader.ReadTo(&msg); err != nil {
+			break
+		}
+		list = append(list, msg.Domain)
+	}
+	require.Equal(t, io.EOF, err)
+	return list
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+)
+
+/**
+Length prefix of records in plain proto format. Framing is not stored in the file, so readers must use the same framing as writers.
+ */
+type ProtoFraming int
+
+const (
+	// uint32 big-endian length, default framing of this module
+	ProtoFramingBigEndian ProtoFraming = iota
+	// uint32 little-endian length
+	ProtoFramingLittleEndian
+	// varint length, compatible with Java writeDelimitedTo and Go protodelim
+	ProtoFramingVarint
+)
+
+/**
+Extension of the file service with the selectable length prefix of records in proto readers and writers.
+ */
+type ProtoFramingFileService interface {
+
+	/*
+	Gets length prefix of records in plain proto format, default value is ProtoFramingBigEndian.
+	 */
+	ProtoFraming() ProtoFraming
+
+	/*
+	Sets length prefix of records used by all proto readers and writers including split and join.
+	 */
+	SetProtoFraming(framing ProtoFraming)
+}
+
+func (t *fileServiceImpl) ProtoFraming() ProtoFraming {
+	return t.protoFraming
+}
+
+func (t *fileServiceImpl) SetProtoFraming(framing ProtoFraming) {
+	t.protoFraming = framing
+}
+
+func (t *fileServiceImpl) newBlockBuffer() blockBuffer {
+	return blockBuffer{ maxSize: t.maxMessageSize, framing: t.protoFraming }
+}
+
+/**
+Appends length prefix to the buffer.
+ */
+func appendProtoLength(buf []byte, framing ProtoFraming, n int) []byte {
+	switch framing {
+	case ProtoFramingLittleEndian:
+		var lenBuf [4]byte
+		binary.LittleEndian.PutUint32(lenBuf[:], uint32(n))
+		return append(buf, lenBuf[:]...)
+	case ProtoFramingVarint:
+		var lenBuf [binary.MaxVarintLen64]byte
+		return append(buf, lenBuf[:binary.PutUvarint(lenBuf[:], uint64(n))]...)
+	default:
+		var lenBuf [4]byte
+		binary.BigEndian.PutUint32(lenBuf[:], uint32(n))
+		return append(buf, lenBuf[:]...)
+	}
+}
+
+/**
+Reads length prefix and returns the length and the number of bytes of the prefix.
+ */
+func readProtoLength(r io.Reader, framing ProtoFraming, lenBuf []byte) (uint64, int, error) {
+
+	if framing == ProtoFramingVarint {
+		br, ok := r.(io.ByteReader)
+		if !ok {
+			br = &singleByteReader{ r: r }
+		}
+		return readUvarint32(br)
+	}
+
+	if _, err := io.ReadFull(r, lenBuf[:4]); err != nil {
+		return 0, 0, err
+	}
+	if framing == ProtoFramingLittleEndian {
+		return uint64(binary.LittleEndian.Uint32(lenBuf)), 4, nil
+	}
+	return uint64(binary.BigEndian.Uint32(lenBuf)), 4, nil
+}
+
+/**
+Reads varint that fits in to uint32 like all lengths of records.
+ */
+func readUvarint32(br io.ByteReader) (uint64, int, error) {
+	var x uint64
+	var shift uint
+	for i := 0; i < 5; i++ {
+		b, err := br.ReadByte()
+		if err != nil {
+			if err == io.EOF && i > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, i, err
+		}
+		x |= uint64(b & 0x7f) << shift
+		if b < 0x80 {
+			if x > 0xffffffff {
+				break
+			}
+			return x, i + 1, nil
+		}
+		shift += 7
+	}
+	return 0, 0, errors.New("invalid varint length")
+}
+
+/**
+Reads bytes one by one without read ahead.
+ */
+type singleByteReader struct {
+	r    io.Reader
+	buf  [1]byte
+}
+
+func (s *singleByteReader) ReadByte() (byte, error) {
+	_, err := io.ReadFull(s.r, s.buf[:])
+	return s.buf[0], err
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod_test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/sprintframework/fsmod"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestProtoFraming(t *testing.T) {
+
+	fs := fsmod.FileService()
+	require.Equal(t, fsmod.ProtoFramingBigEndian, fs.ProtoFraming())
+
+	obj := &Domain{ Domain: strings.Repeat("a", 200) }
+	blob, err := proto.Marshal(obj)
+	require.NoError(t, err)
+
+	// same as writeDelimitedTo in Java
+	delimited := protowire.AppendBytes(nil, blob)
+
+	fs.SetProtoFraming(fsmod.ProtoFramingVarint)
+	writer, err := fs.NewProtoCodecBuf(nil)
+	require.NoError(t, err)
+	_, err = writer.Write(obj)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	require.Equal(t, delimited, writer.(interface{ Bytes() []byte }).Bytes())
+
+	reader, err := fs.ProtoCodecStream(bytes.NewReader(append(delimited, delimited...)), nil)
+	require.NoError(t, err)
+	var msg Domain
+	require.NoError(t, reader.ReadTo(&msg))
+	require.True(t, proto.Equal(obj, &msg))
+	require.NoError(t, reader.ReadTo(&msg))
+	require.Equal(t, io.EOF, reader.ReadTo(&msg))
+
+	reader, err = fs.ProtoCodecStream(bytes.NewReader(delimited[:1]), nil)
+	require.NoError(t, err)
+	require.Equal(t, io.ErrUnexpectedEOF, reader.ReadTo(&msg))
+
+	fd, err := ioutil.TempFile(os.TempDir(), "proto-framing-test")
+	require.NoError(t, err)
+	filePath := fd.Name()
+	fd.Close()
+	defer os.Remove(filePath)
+
+	for _, framing := range []fsmod.ProtoFraming{ fsmod.ProtoFramingBigEndian, fsmod.ProtoFramingLittleEndian, fsmod.ProtoFramingVarint } {
+
+		fs.SetProtoFraming(framing)
+
+		writer, err := fs.NewProtoFile(filePath)
+		require.NoError(t, err)
+		for i := 0; i < 10; i++ {
+			_, err = writer.Write(&Domain{ Domain: fmt.Sprintf("obj%d", i) })
+			require.NoError(t, err)
+		}
+		require.NoError(t, writer.Close())
+
+		parts, err := fs.SplitProtoFile(filePath, new(Domain), 3, func(i int) string {
+			return fmt.Sprintf("%s_part%d", filePath, i)
+		})
+		require.NoError(t, err)
+		require.Equal(t, 4, len(parts))
+
+		joined := filePath + "_joined"
+		err = fs.JoinProtoFiles(joined, new(Domain), parts)
+		for _, part := range parts {
+			os.Remove(part)
+		}
+		require.NoError(t, err)
+
+		list := readDomains(t, fs, joined)
+		os.Remove(joined)
+		require.Equal(t, 10, len(list))
+		require.Equal(t, "obj9", list[9])
+
+		seeker, err := fs.OpenProtoSeekFile(filePath)
+		require.NoError(t, err)
+		require.Equal(t, int64(10), seeker.Count())
+		require.NoError(t, seeker.SeekRecord(7))
+		require.NoError(t, seeker.ReadTo(&msg))
+		require.Equal(t, "obj7", msg.Domain)
+		require.NoError(t, seeker.Close())
+	}
+}
@@ -0,0 +1,391 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"github.com/sprintframework/fs"
+	"io"
+	iofs "io/fs"
+	"sort"
+)
+
+// extension of the sidecar index file appended to the protofile path
+var ProtoIndexExtension = ".idx"
+
+// checkpoint interval used to build the index in memory when sidecar file is missing
+var ProtoScanIndexInterval = 1024
+
+var protoIndexMagic = [4]byte{ 'F', 'S', 'P', 'I' }
+
+const protoIndexVersion = 2
+
+// index does not match its data file, that was rewritten or replaced after the index
+var errStaleProtoIndex = errors.New("stale index")
+
+/**
+Extension of the file service with random access to protofiles.
+NewProtoFile writes sidecar index on Close if index interval is positive, otherwise removes the stale one.
+Index keeps size of the data file and is ignored if the file has other size.
+Uncompressed files are indexed by byte offset of the record, compressed files start new codec stream on each checkpoint.
+ */
+type ProtoIndexFileService interface {
+
+	/*
+	Gets number of records between checkpoints of the index, default value is 0 that disables index.
+	 */
+	ProtoIndexInterval() int
+
+	/*
+	Sets number of records between checkpoints of the index written by NewProtoFile.
+	 */
+	SetProtoIndexInterval(interval int)
+
+	/*
+	Opens protofile with random access by record number. If sidecar index is missing it is built by scanning the file.
+	 */
+	OpenProtoSeekFile(filePath string) (ProtoSeekReader, error)
+}
+
+/**
+Protofile reader with random access by record number.
+ */
+type ProtoSeekReader interface {
+	fs.ProtoReader
+
+	/*
+	Gets number of records in file.
+	 */
+	Count() int64
+
+	/*
+	Positions reader on the record with number n, starting from 0. Position equal to Count means EOF.
+	 */
+	SeekRecord(n int64) error
+}
+
+type protoCheckpoint struct {
+	record int64
+	offset int64
+}
+
+type protoIndex struct {
+	interval    int
+	count       int64
+	size        int64 // size of the data file
+	compressed  bool
+	checkpoints []protoCheckpoint
+	counter     *countingWriter // only on write
+}
+
+type countingWriter struct {
+	w  io.Writer
+	n  int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (t *fileServiceImpl) ProtoIndexInterval() int {
+	return t.protoIndexInterval
+}
+
+func (t *fileServiceImpl) SetProtoIndexInterval(interval int) {
+	t.protoIndexInterval = interval
+}
+
+/**
+Adds checkpoint before writing next record, for compressed files finishes the current codec stream.
+ */
+func (w *protoFileWriter) checkpoint() error {
+
+	idx := w.index
+	if idx.count % int64(idx.interval) == 0 {
+
+		// some codecs write stream header on creation, so offset of the stream is taken before it
+		var offset int64
+		if w.cw == nil {
+			offset = idx.counter.n
+		} else if idx.count > 0 {
+			if err := w.bw.Flush(); err != nil {
+				return err
+			}
+			if err := w.cw.Close(); err != nil {
+				return err
+			}
+			offset = idx.counter.n
+			cw, err := w.codec.NewWriter(idx.counter)
+			if err != nil {
+				return err
+			}
+			w.cw = cw
+			w.bw.Reset(cw)
+		}
+
+		idx.checkpoints = append(idx.checkpoints, protoCheckpoint{ record: idx.count, offset: offset })
+	}
+
+	idx.count++
+	return nil
+}
+
+func writeProtoIndex(fsys FileSystem, filePath string, idx *protoIndex) error {
+
+	indexPath := filePath + ProtoIndexExtension
+	fd, err := createAtomicFile(fsys, indexPath)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(fd)
+	var compressed byte
+	if idx.compressed {
+		compressed = 1
+	}
+	w.Write(protoIndexMagic[:])
+	w.WriteByte(protoIndexVersion)
+	w.WriteByte(compressed)
+	binary.Write(w, binary.BigEndian, uint32(idx.interval))
+	binary.Write(w, binary.BigEndian, uint64(idx.count))
+	binary.Write(w, binary.BigEndian, uint64(idx.counter.n))
+	binary.Write(w, binary.BigEndian, uint64(len(idx.checkpoints)))
+	for _, cp := range idx.checkpoints {
+		binary.Write(w, binary.BigEndian, uint64(cp.record))
+		binary.Write(w, binary.BigEndian, uint64(cp.offset))
+	}
+
+	return closeFile(fsys, fd, indexPath, w.Flush())
+}
+
+/**
+Reads sidecar index of the data file with the size, index of the other size or of the old version is stale.
+ */
+func readProtoIndex(fsys FileSystem, indexPath string, size int64) (*protoIndex, error) {
+
+	content, err := iofs.ReadFile(fsys, indexPath)
+	if err != nil {
+		return nil, err
+	}
+
+	const headerLen = 4 + 1 + 1 + 4 + 8 + 8 + 8
+	if len(content) < 5 || string(content[:4]) != string(protoIndexMagic[:]) {
+		return nil, errors.Errorf("invalid index file '%s'", indexPath)
+	}
+	if content[4] < protoIndexVersion {
+		// index without size of the data file could not be checked
+		return nil, errStaleProtoIndex
+	}
+	if content[4] != protoIndexVersion {
+		return nil, errors.Errorf("unsupported index version %d in file '%s'", content[4], indexPath)
+	}
+	if len(content) < headerLen {
+		return nil, errors.Errorf("invalid index file '%s'", indexPath)
+	}
+
+	idx := &protoIndex{
+		compressed: content[5] == 1,
+		interval:   int(binary.BigEndian.Uint32(content[6:])),
+		count:      int64(binary.BigEndian.Uint64(content[10:])),
+		size:       int64(binary.BigEndian.Uint64(content[18:])),
+	}
+	if idx.size != size {
+		return nil, errStaleProtoIndex
+	}
+	n := binary.BigEndian.Uint64(content[26:])
+	if uint64(len(content) - headerLen) != n * 16 {
+		return nil, errors.Errorf("corrupted index file '%s'", indexPath)
+	}
+
+	idx.checkpoints = make([]protoCheckpoint, n)
+	for i := range idx.checkpoints {
+		pos := headerLen + i * 16
+		idx.checkpoints[i] = protoCheckpoint{
+			record: int64(binary.BigEndian.Uint64(content[pos:])),
+			offset: int64(binary.BigEndian.Uint64(content[pos + 8:])),
+		}
+	}
+
+	return idx, nil
+}
+
+/**
+Builds index by reading all records, compressed files have only the first checkpoint.
+ */
+func scanProtoIndex(skip func() (int64, error), compressed bool, offset int64) (*protoIndex, error) {
+
+	idx := &protoIndex{
+		interval:   ProtoScanIndexInterval,
+		compressed: compressed,
+	}
+
+	for {
+		if idx.count % int64(idx.interval) == 0 && (!compressed || idx.count == 0) {
+			idx.checkpoints = append(idx.checkpoints, protoCheckpoint{ record: idx.count, offset: offset })
+		}
+		n, err := skip()
+		if err == io.EOF {
+			return idx, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		offset += n
+		idx.count++
+	}
+}
+
+type protoSeekReader struct {
+	protoFileReader
+	seeker io.Seeker
+	codec  Codec
+	index  *protoIndex
+	framed bool
+	headerLen int64 // length of the descriptor header
+	filePath string
+}
+
+func (t *fileServiceImpl) OpenProtoSeekFile(filePath string) (ProtoSeekReader, error) {
+
+	fd, err := t.fsys.Open(filePath)
+	if err != nil {
+		return nil, errors.Errorf("file open error '%s', %v", filePath, err)
+	}
+
+	seeker, ok := fd.(io.Seeker)
+	if !ok {
+		fd.Close()
+		return nil, errors.Errorf("file '%s' does not support seek", filePath)
+	}
+
+	r := &protoSeekReader{
+		protoFileReader: protoFileReader{
+			fd: fd,
+			block: t.newBlockBuffer(),
+		},
+		seeker: seeker,
+		filePath: filePath,
+	}
+
+	r.fr = bufio.NewReaderSize(r.fd, t.bufferSize)
+	r.codec = t.detectCodec(filePath, r.fr)
+
+	// detects format on the start of the file
+	if err = r.seek(protoCheckpoint{}); err == nil {
+		var info iofs.FileInfo
+		if info, err = iofs.Stat(t.fsys, filePath); err == nil {
+			r.index, err = readProtoIndex(t.fsys, filePath + ProtoIndexExtension, info.Size())
+		}
+		if errors.Is(err, iofs.ErrNotExist) || err == errStaleProtoIndex {
+			offset := r.headerLen
+			if r.framed {
+				offset += int64(len(ProtoFramedMagic))
+			}
+			r.index, err = scanProtoIndex(r.skipRecord, r.codec != nil, offset)
+		}
+	}
+	if err != nil {
+		r.Close()
+		return nil, errors.Errorf("index error in '%s', %v", filePath, err)
+	}
+
+	if err := r.SeekRecord(0); err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *protoSeekReader) Count() int64 {
+	return r.index.count
+}
+
+func (r *protoSeekReader) SeekRecord(n int64) error {
+
+	if n < 0 || n > r.index.count {
+		return errors.Errorf("record %d is out of range [0, %d]", n, r.index.count)
+	}
+
+	var cp protoCheckpoint
+	cps := r.index.checkpoints
+	if i := sort.Search(len(cps), func(i int) bool { return cps[i].record > n }); i > 0 {
+		cp = cps[i - 1]
+	}
+
+	if err := r.seek(cp); err != nil {
+		return err
+	}
+
+	for i := cp.record; i < n; i++ {
+		if _, err := r.skipRecord(); err != nil {
+			return errors.Errorf("skip record %d error, %v", i, err)
+		}
+	}
+
+	return nil
+}
+
+func (r *protoSeekReader) seek(cp protoCheckpoint) (err error) {
+
+	if r.cr != nil {
+		r.cr.Close()
+		r.cr = nil
+	}
+
+	if _, err = r.seeker.Seek(cp.offset, io.SeekStart); err != nil {
+		return err
+	}
+	r.fr.Reset(r.fd)
+
+	if r.codec != nil {
+		r.cr, err = r.codec.NewReader(r.fr)
+		if err != nil {
+			return errors.Errorf("codec '%s' read error in '%s', %v", r.codec.Extension(), r.filePath, err)
+		}
+		r.r = r.cr
+	} else {
+		r.r = r.fr
+	}
+
+	// descriptor header is present only at the start of the file
+	offset := cp.offset
+	if cp.offset == 0 {
+		var br *bufio.Reader
+		br, r.messageType, r.headerLen, err = readProtoDescriptor(r.r, r.block.maxSize)
+		if err != nil {
+			return err
+		}
+		r.r = br
+		offset += r.headerLen
+	}
+
+	// magic header is present only at the start of the file
+	br, framed := detectProtoFormat(r.r)
+	r.r = br
+	r.framed = r.framed || framed
+	if r.framed {
+		if framed {
+			offset += int64(len(ProtoFramedMagic))
+		}
+		r.frames = newProtoFrameReader(br, offset, r.block.maxSize)
+	}
+
+	return nil
+}
+
+func (r *protoSeekReader) skipRecord() (int64, error) {
+	if r.frames != nil {
+		start := r.frames.offset
+		_, err := r.frames.next()
+		return r.frames.offset - start, err
+	}
+	return r.block.skipBlock(r.r)
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod_test
+
+import (
+	"fmt"
+	"github.com/sprintframework/fsmod"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestProtoIndex(t *testing.T) {
+
+	fs := fsmod.FileService()
+	fs.SetProtoIndexInterval(10)
+
+	for _, ext := range []string{ ".pb", ".pb.gz", ".pb.zst", ".pb.lz4", ".pb.sz", ".pb.bz2", ".pb.xz" } {
+
+		fd, err := ioutil.TempFile(os.TempDir(), "proto-index-test")
+		require.NoError(t, err)
+		filePath := fd.Name() + ext
+		fd.Close()
+		os.Remove(fd.Name())
+		defer os.Remove(filePath)
+		defer os.Remove(filePath + fsmod.ProtoIndexExtension)
+
+		writer, err := fs.NewProtoFile(filePath)
+		require.NoError(t, err)
+		for i := 0; i < 95; i++ {
+			_, err = writer.Write(&Domain{ Domain: fmt.Sprintf("obj%d", i) })
+			require.NoError(t, err)
+		}
+		require.NoError(t, writer.Close())
+
+		_, err = os.Stat(filePath + fsmod.ProtoIndexExtension)
+		require.NoError(t, err, ext)
+
+		// sequential read is not affected by checkpoints
+		pr, err := fs.OpenProtoFile(filePath)
+		require.NoError(t, err)
+		count := 0
+		for {
+			var msg Domain
+			if err = pr.ReadTo(&msg); err != nil {
+				break
+			}
+			require.Equal(t, fmt.Sprintf("obj%d", count), msg.Domain, ext)
+			count++
+		}
+		require.Equal(t, io.EOF, err)
+		require.Equal(t, 95, count, ext)
+		require.NoError(t, pr.Close())
+
+		reader, err := fs.OpenProtoSeekFile(filePath)
+		require.NoError(t, err)
+		require.Equal(t, int64(95), reader.Count())
+
+		for _, n := range []int64{ 57, 0, 10, 94, 9 } {
+			require.NoError(t, reader.SeekRecord(n))
+			var msg Domain
+			require.NoError(t, reader.ReadTo(&msg))
+			require.Equal(t, fmt.Sprintf("obj%d", n), msg.Domain, ext)
+		}
+
+		require.NoError(t, reader.SeekRecord(95))
+		var msg Domain
+		require.Equal(t, io.EOF, reader.ReadTo(&msg))
+		require.Error(t, reader.SeekRecord(96))
+		require.NoError(t, reader.Close())
+
+		// without sidecar index file is scanned
+		os.Remove(filePath + fsmod.ProtoIndexExtension)
+		reader, err = fs.OpenProtoSeekFile(filePath)
+		require.NoError(t, err)
+		require.Equal(t, int64(95), reader.Count())
+		require.NoError(t, reader.SeekRecord(42))
+		require.NoError(t, reader.ReadTo(&msg))
+		require.Equal(t, "obj42", msg.Domain)
+		require.NoError(t, reader.Close())
+	}
+}
+
+func TestProtoIndexStale(t *testing.T) {
+
+	mem := fsmod.MemFileSystem()
+	fs := fsmod.FileSystemService(mem)
+
+	write := func(interval int, prefix string, n int) {
+		fs.SetProtoIndexInterval(interval)
+		writer, err := fs.NewProtoFile("domains.pb")
+		require.NoError(t, err)
+		for i := 0; i < n; i++ {
+			_, err = writer.Write(&Domain{ Domain: fmt.Sprintf("%s%d", prefix, i) })
+			require.NoError(t, err)
+		}
+		require.NoError(t, writer.Close())
+	}
+
+	write(10, "obj", 50)
+	index := readContent(t, mem, "domains.pb" + fsmod.ProtoIndexExtension)
+
+	// file rewritten without index drops the sidecar
+	write(0, "object", 50)
+	_, err := mem.Open("domains.pb" + fsmod.ProtoIndexExtension)
+	require.Error(t, err)
+
+	// index left from the other content is ignored and the file is scanned
+	writePart(t, mem, "domains.pb" + fsmod.ProtoIndexExtension, string(index))
+	reader, err := fs.OpenProtoSeekFile("domains.pb")
+	require.NoError(t, err)
+	defer reader.Close()
+	require.NoError(t, reader.SeekRecord(37))
+	var msg Domain
+	require.NoError(t, reader.ReadTo(&msg))
+	require.Equal(t, "object37", msg.Domain)
+}
+
+func TestProtoIndexDescribedFramed(t *testing.T) {
+
+	mem := fsmod.MemFileSystem()
+	fs := fsmod.FileSystemService(mem)
+	fs.SetProtoFormat(fsmod.ProtoFormatFramed)
+	fs.SetProtoIndexInterval(0)
+
+	writer, err := fs.NewDescribedProtoFile("domains.pb", (&Domain{}).ProtoReflect().Descriptor())
+	require.NoError(t, err)
+	for i := 0; i < 30; i++ {
+		_, err = writer.Write(&Domain{ Domain: fmt.Sprintf("obj%d", i) })
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Close())
+
+	// scan starts after both descriptor header and framed magic
+	reader, err := fs.OpenProtoSeekFile("domains.pb")
+	require.NoError(t, err)
+	defer reader.Close()
+	require.Equal(t, int64(30), reader.Count())
+	for _, n := range []int64{ 17, 0, 29 } {
+		require.NoError(t, reader.SeekRecord(n))
+		var msg Domain
+		require.NoError(t, reader.ReadTo(&msg))
+		require.Equal(t, fmt.Sprintf("obj%d", n), msg.Domain)
+	}
+}
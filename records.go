@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod
+
+import (
+	"github.com/sprintframework/fs"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"iter"
+)
+
+/**
+Iterates over messages of the proto reader, stops on EOF and yields the first other error.
+If reuse is true the same message is passed on each step, otherwise new instance of T is created for each record.
+T must be a generated message pointer, for dynamic messages use DescribedRecords.
+ */
+func ProtoRecords[T proto.Message](reader fs.ProtoReader, reuse bool) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		var zero T
+		messageType := zero.ProtoReflect().Type()
+		message := messageType.New().Interface().(T)
+		for {
+			if err := reader.ReadTo(message); err != nil {
+				if err != io.EOF {
+					yield(zero, err)
+				}
+				return
+			}
+			if !yield(message, nil) {
+				return
+			}
+			if !reuse {
+				message = messageType.New().Interface().(T)
+			}
+		}
+	}
+}
+
+/**
+Iterates over messages of the described protofile, each message is the new instance of the type stored in the header.
+ */
+func DescribedRecords(reader DescribedProtoReader) iter.Seq2[proto.Message, error] {
+	return func(yield func(proto.Message, error) bool) {
+		for {
+			message, err := reader.Read()
+			if err != nil {
+				if err != io.EOF {
+					yield(nil, err)
+				}
+				return
+			}
+			if !yield(message, nil) {
+				return
+			}
+		}
+	}
+}
+
+/**
+Iterates over objects of the JSON reader decoded in to *T, stops on EOF and yields the first other error.
+If reuse is true the same object is reset to zero value and passed on each step.
+ */
+func JsonRecords[T any](reader fs.JsonReader, reuse bool) iter.Seq2[*T, error] {
+	return func(yield func(*T, error) bool) {
+		holder := new(T)
+		for {
+			if reuse {
+				var zero T
+				*holder = zero
+			}
+			if err := reader.Read(holder); err != nil {
+				if err != io.EOF {
+					yield(nil, err)
+				}
+				return
+			}
+			if !yield(holder, nil) {
+				return
+			}
+			if !reuse {
+				holder = new(T)
+			}
+		}
+	}
+}
+
+/**
+Iterates over rows of the CSV reader, stops on EOF and yields the first other error.
+ */
+func CsvRows(reader fs.CsvStream) iter.Seq2[[]string, error] {
+	return func(yield func([]string, error) bool) {
+		for {
+			row, err := reader.Read()
+			if err != nil {
+				if err != io.EOF {
+					yield(nil, err)
+				}
+				return
+			}
+			if !yield(row, nil) {
+				return
+			}
+		}
+	}
+}
+
+/**
+Iterates over records of the CSV file decoded in to struct *T by DecodeCsvRecord.
+If reuse is true the same struct is reset to zero value and passed on each step.
+ */
+func CsvRecords[T any](file fs.CsvFile, reuse bool) iter.Seq2[*T, error] {
+	return func(yield func(*T, error) bool) {
+		holder := new(T)
+		for {
+			record, err := file.Next()
+			if err != nil {
+				if err != io.EOF {
+					yield(nil, err)
+				}
+				return
+			}
+			if reuse {
+				var zero T
+				*holder = zero
+			}
+			if err := DecodeCsvRecord(record, holder); err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(holder, nil) {
+				return
+			}
+			if !reuse {
+				holder = new(T)
+			}
+		}
+	}
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod_test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/sprintframework/fsmod"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestProtoRecords(t *testing.T) {
+
+	fs := fsmod.FileService()
+
+	w, err := fs.NewProtoBuf(false)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = w.Write(&Domain{ Domain: fmt.Sprintf("obj%d", i) })
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	content := w.(interface{ Bytes() []byte }).Bytes()
+
+	for _, reuse := range []bool{ false, true } {
+
+		reader, err := fs.ProtoStream(bytes.NewReader(content), false)
+		require.NoError(t, err)
+
+		var list []*Domain
+		var names []string
+		for msg, err := range fsmod.ProtoRecords[*Domain](reader, reuse) {
+			require.NoError(t, err)
+			list = append(list, msg)
+			names = append(names, msg.Domain)
+		}
+		require.NoError(t, reader.Close())
+
+		require.Equal(t, []string{ "obj0", "obj1", "obj2" }, names)
+		require.Equal(t, reuse, list[0] == list[2])
+	}
+
+	// early break stops reading
+	reader, err := fs.ProtoStream(bytes.NewReader(content), false)
+	require.NoError(t, err)
+	for msg := range fsmod.ProtoRecords[*Domain](reader, false) {
+		require.Equal(t, "obj0", msg.Domain)
+		break
+	}
+	var next Domain
+	require.NoError(t, reader.ReadTo(&next))
+	require.Equal(t, "obj1", next.Domain)
+
+	// error is yielded once
+	reader, err = fs.ProtoStream(bytes.NewReader(content[:len(content) - 1]), false)
+	require.NoError(t, err)
+	var errs []error
+	for _, err := range fsmod.ProtoRecords[*Domain](reader, false) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	require.Equal(t, 1, len(errs))
+}
+
+type jsonItem struct {
+	Name  string `json:"name"`
+	Count int    `json:"count,omitempty"`
+}
+
+func TestJsonRecords(t *testing.T) {
+
+	fs := fsmod.FileService()
+
+	content := []byte("{\"name\":\"first\",\"count\":2}\n{\"name\":\"second\"}\n")
+	reader, err := fs.JsonStream(bytes.NewReader(content), false)
+	require.NoError(t, err)
+
+	var items []jsonItem
+	for item, err := range fsmod.JsonRecords[jsonItem](reader, true) {
+		require.NoError(t, err)
+		items = append(items, *item)
+	}
+	require.NoError(t, reader.Close())
+
+	// reused holder is reset between records
+	require.Equal(t, []jsonItem{ { Name: "first", Count: 2 }, { Name: "second" } }, items)
+}
+
+type csvCounter struct {
+	Name  string `csv:"name"`
+	Count int    `csv:"count"`
+}
+
+func TestCsvRecords(t *testing.T) {
+
+	fs := fsmod.FileService()
+
+	content := []byte("name,count\nfirst,1\nsecond,2\n")
+
+	stream, err := fs.OpenCsvStream(bytes.NewReader(content), false)
+	require.NoError(t, err)
+	var rows [][]string
+	for row, err := range fsmod.CsvRows(stream) {
+		require.NoError(t, err)
+		rows = append(rows, row)
+	}
+	require.NoError(t, stream.Close())
+	require.Equal(t, [][]string{ { "name", "count" }, { "first", "1" }, { "second", "2" } }, rows)
+
+	fd, err := ioutil.TempFile(os.TempDir(), "records-test")
+	require.NoError(t, err)
+	filePath := fd.Name() + ".csv"
+	fd.Close()
+	os.Remove(fd.Name())
+	defer os.Remove(filePath)
+
+	require.NoError(t, ioutil.WriteFile(filePath, content, 0644))
+	reader, err := fs.OpenCsvFile(filePath)
+	require.NoError(t, err)
+	file, err := reader.ReadHeader()
+	require.NoError(t, err)
+
+	var items []*csvCounter
+	for item, err := range fsmod.CsvRecords[csvCounter](file, false) {
+		require.NoError(t, err)
+		items = append(items, item)
+	}
+	require.NoError(t, reader.Close())
+	require.Equal(t, []*csvCounter{ { Name: "first", Count: 1 }, { Name: "second", Count: 2 } }, items)
+
+	// decode error is yielded and stops iteration
+	require.NoError(t, ioutil.WriteFile(filePath, []byte("name,count\nfirst,x\nsecond,2\n"), 0644))
+	reader, err = fs.OpenCsvFile(filePath)
+	require.NoError(t, err)
+	defer reader.Close()
+	file, err = reader.ReadHeader()
+	require.NoError(t, err)
+	var errs []error
+	for _, err := range fsmod.CsvRecords[csvCounter](file, false) {
+		errs = append(errs, err)
+	}
+	require.Equal(t, 1, len(errs))
+	require.Error(t, errs[0])
+}
@@ -0,0 +1,695 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	iofs "io/fs"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scheme of object storage names in form s3://bucket/key
+var S3Scheme = "s3"
+
+// default size of the multipart upload part, S3 requires at least 5mb for all parts except the last one
+var DefaultS3PartSize = 8 * 1024 * 1024
+
+// largest object copied by the single request, S3 limit is 5gb, larger objects are copied by parts of this size
+var S3MaxCopySize int64 = 5 * 1024 * 1024 * 1024
+
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+/**
+Connection settings of the S3-compatible object storage. Objects are addressed in path style as endpoint/bucket/key.
+ */
+type S3Config struct {
+	Endpoint     string // for example https://s3.us-east-1.amazonaws.com or http://localhost:9000
+	Region       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string // optional token of temporary credentials
+	PartSize     int    // multipart upload part size, DefaultS3PartSize if zero
+	Client       *http.Client // http.DefaultClient if nil
+}
+
+type s3FileSystem struct {
+	config S3Config
+	client *http.Client
+}
+
+/**
+Returns file system over S3-compatible object storage, names are URLs in form s3://bucket/key.
+Reads are streamed by ranged GET requests, writes are buffered by parts and uploaded by multipart upload on Close.
+Created object appears only on Close, so atomic files are uploaded directly without temp object.
+Rename is implemented by server side copy and delete.
+ */
+func S3FileSystem(config S3Config) FileSystem {
+	if config.PartSize <= 0 {
+		config.PartSize = DefaultS3PartSize
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+	client := config.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &s3FileSystem{ config: config, client: client }
+}
+
+/**
+Splits name in to bucket and key.
+ */
+func parseS3Name(op, name string) (string, string, error) {
+	prefix := S3Scheme + "://"
+	if !strings.HasPrefix(name, prefix) {
+		return "", "", &iofs.PathError{ Op: op, Path: name, Err: iofs.ErrInvalid }
+	}
+	rest := name[len(prefix):]
+	bucket, key := rest, ""
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		bucket, key = rest[:i], rest[i+1:]
+	}
+	if bucket == "" {
+		return "", "", &iofs.PathError{ Op: op, Path: name, Err: iofs.ErrInvalid }
+	}
+	return bucket, key, nil
+}
+
+func (s *s3FileSystem) Open(name string) (iofs.File, error) {
+	bucket, key, err := parseS3Name("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f := &s3ReadFile{ fs: s, name: name, bucket: bucket, key: key }
+	if err := f.request(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *s3FileSystem) Stat(name string) (iofs.FileInfo, error) {
+	bucket, key, err := parseS3Name("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do("HEAD", bucket, key, nil, nil, nil)
+	if err != nil {
+		return nil, &iofs.PathError{ Op: "stat", Path: name, Err: err }
+	}
+	resp.Body.Close()
+	return s3ObjectInfo(key, resp), nil
+}
+
+type s3ListResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+}
+
+/**
+Lists objects and common prefixes of the directory, prefixes are returned as directories.
+ */
+func (s *s3FileSystem) ReadDir(name string) ([]iofs.DirEntry, error) {
+	bucket, key, err := parseS3Name("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	prefix := key
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	var list []iofs.DirEntry
+	query := map[string]string{ "list-type": "2", "delimiter": "/", "prefix": prefix }
+	for {
+		resp, err := s.do("GET", bucket, "", query, nil, nil)
+		if err != nil {
+			return nil, &iofs.PathError{ Op: "readdir", Path: name, Err: err }
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, &iofs.PathError{ Op: "readdir", Path: name, Err: err }
+		}
+		for _, p := range result.CommonPrefixes {
+			dirName := strings.TrimSuffix(p.Prefix[len(prefix):], "/")
+			list = append(list, iofs.FileInfoToDirEntry(&memFileInfo{ name: dirName, dir: true }))
+		}
+		for _, c := range result.Contents {
+			if c.Key == prefix {
+				continue
+			}
+			list = append(list, iofs.FileInfoToDirEntry(&memFileInfo{ name: c.Key[len(prefix):], size: c.Size, modTime: c.LastModified }))
+		}
+		if !result.IsTruncated {
+			break
+		}
+		query["continuation-token"] = result.NextContinuationToken
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list, nil
+}
+
+func (s *s3FileSystem) Create(name string) (WritableFile, error) {
+	bucket, key, err := parseS3Name("create", name)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" || strings.HasSuffix(key, "/") {
+		return nil, &iofs.PathError{ Op: "create", Path: name, Err: iofs.ErrInvalid }
+	}
+	return &s3WriteFile{ fs: s, name: name, bucket: bucket, key: key }, nil
+}
+
+func (s *s3FileSystem) CreateTemp(dir, pattern string) (WritableFile, error) {
+	var random [8]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return nil, err
+	}
+	suffix := hex.EncodeToString(random[:])
+	name := pattern + suffix
+	if i := strings.LastIndexByte(pattern, '*'); i >= 0 {
+		name = pattern[:i] + suffix + pattern[i+1:]
+	}
+	return s.Create(strings.TrimSuffix(dir, "/") + "/" + name)
+}
+
+func (s *s3FileSystem) Rename(oldName, newName string) error {
+	oldBucket, oldKey, err := parseS3Name("rename", oldName)
+	if err != nil {
+		return err
+	}
+	newBucket, newKey, err := parseS3Name("rename", newName)
+	if err != nil {
+		return err
+	}
+	info, err := s.Stat(oldName)
+	if err != nil {
+		return &iofs.PathError{ Op: "rename", Path: oldName, Err: err }
+	}
+	if info.Size() > S3MaxCopySize {
+		f := &s3WriteFile{ fs: s, name: newName, bucket: newBucket, key: newKey }
+		if err := f.copyParts(oldBucket, oldKey, info.Size()); err != nil {
+			return err
+		}
+		return s.Remove(oldName)
+	}
+	header := map[string]string{ "x-amz-copy-source": s3EscapePath("/" + oldBucket + "/" + oldKey) }
+	resp, err := s.do("PUT", newBucket, newKey, nil, header, nil)
+	if err != nil {
+		return &iofs.PathError{ Op: "rename", Path: oldName, Err: err }
+	}
+	// copy could fail after the response status is sent
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return &iofs.PathError{ Op: "rename", Path: oldName, Err: err }
+	}
+	if bytes.Contains(body, []byte("<Error>")) {
+		return &iofs.PathError{ Op: "rename", Path: oldName, Err: errors.Errorf("copy error, %s", body) }
+	}
+	return s.Remove(oldName)
+}
+
+func (s *s3FileSystem) Remove(name string) error {
+	bucket, key, err := parseS3Name("remove", name)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do("DELETE", bucket, key, nil, nil, nil)
+	if err != nil {
+		return &iofs.PathError{ Op: "remove", Path: name, Err: err }
+	}
+	resp.Body.Close()
+	return nil
+}
+
+/**
+Object storage has no directories, keys with the prefix are enough.
+ */
+func (s *s3FileSystem) AtomicCreate(name string) bool {
+	return true
+}
+
+func (s *s3FileSystem) MkdirAll(name string) error {
+	_, _, err := parseS3Name("mkdir", name)
+	return err
+}
+
+/**
+Sends signed request, returns error for non 2xx responses. Not found status is returned as fs.ErrNotExist.
+ */
+func (s *s3FileSystem) do(method, bucket, key string, query map[string]string, header map[string]string, body []byte) (*http.Response, error) {
+
+	url := s.config.Endpoint + s3EscapePath("/" + bucket + "/" + key)
+	if key == "" {
+		url = s.config.Endpoint + s3EscapePath("/" + bucket)
+	}
+	if rawQuery := s3CanonicalQuery(query); rawQuery != "" {
+		url += "?" + rawQuery
+	}
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	if body != nil {
+		sum := sha256.Sum256(body)
+		req.Header.Set("x-amz-content-sha256", hex.EncodeToString(sum[:]))
+	}
+	s.sign(req, query, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, iofs.ErrNotExist
+	}
+	return nil, errors.Errorf("%s %s status %d, %s", method, url, resp.StatusCode, msg)
+}
+
+/**
+Signs request by AWS Signature Version 4, signs host and all x-amz-* headers.
+ */
+func (s *s3FileSystem) sign(req *http.Request, query map[string]string, now time.Time) {
+
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("x-amz-date", amzDate)
+	if req.Header.Get("x-amz-content-sha256") == "" {
+		req.Header.Set("x-amz-content-sha256", s3UnsignedPayload)
+	}
+	if s.config.SessionToken != "" {
+		req.Header.Set("x-amz-security-token", s.config.SessionToken)
+	}
+
+	headers := map[string]string{ "host": req.URL.Host }
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(query),
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("x-amz-content-sha256"),
+	}, "\n")
+
+	scope := date + "/" + s.config.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSha256([]byte("AWS4" + s.config.SecretKey), date)
+	key = hmacSha256(key, s.config.Region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+/**
+Escapes string by S3 rules, all bytes except unreserved characters are percent-encoded.
+ */
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (keepSlash && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3EscapePath(p string) string {
+	return s3Escape(p, true)
+}
+
+func s3CanonicalQuery(query map[string]string) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	list := make([]string, len(keys))
+	for i, k := range keys {
+		list[i] = s3Escape(k, false) + "=" + s3Escape(query[k], false)
+	}
+	return strings.Join(list, "&")
+}
+
+func s3ObjectInfo(key string, resp *http.Response) *memFileInfo {
+	info := &memFileInfo{ name: path.Base(key), size: resp.ContentLength }
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.modTime = t
+	}
+	return info
+}
+
+/**
+Object opened for reading, seek closes the current response and next read requests the range from the new offset.
+ */
+type s3ReadFile struct {
+	fs     *s3FileSystem
+	name   string
+	bucket string
+	key    string
+	info   *memFileInfo
+	body   io.ReadCloser
+	offset int64
+}
+
+func (f *s3ReadFile) request() error {
+	var header map[string]string
+	if f.offset > 0 {
+		header = map[string]string{ "Range": "bytes=" + strconv.FormatInt(f.offset, 10) + "-" }
+	}
+	resp, err := f.fs.do("GET", f.bucket, f.key, nil, header, nil)
+	if err != nil {
+		return &iofs.PathError{ Op: "open", Path: f.name, Err: err }
+	}
+	if f.info == nil {
+		f.info = s3ObjectInfo(f.key, resp)
+	}
+	f.body = resp.Body
+	return nil
+}
+
+func (f *s3ReadFile) Stat() (iofs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *s3ReadFile) Read(p []byte) (int, error) {
+	if f.info.size >= 0 && f.offset >= f.info.size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		if err := f.request(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *s3ReadFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, &iofs.PathError{ Op: "seek", Path: f.name, Err: iofs.ErrInvalid }
+	}
+	if offset != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *s3ReadFile) Close() error {
+	if f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	return nil
+}
+
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+type s3CompleteUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+/**
+Object opened for writing. Content is sent by single PUT if it fits in one part, otherwise by multipart upload.
+Object becomes visible on Close, Abort cancels the upload.
+ */
+type s3WriteFile struct {
+	fs       *s3FileSystem
+	name     string
+	bucket   string
+	key      string
+	buf      bytes.Buffer
+	uploadID string
+	parts    []s3CompletedPart
+	closed   bool
+}
+
+func (f *s3WriteFile) Name() string {
+	return f.name
+}
+
+func (f *s3WriteFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, iofs.ErrClosed
+	}
+	f.buf.Write(p)
+	for f.buf.Len() >= f.fs.config.PartSize {
+		if err := f.uploadPart(f.buf.Next(f.fs.config.PartSize)); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+/**
+Object storage has no partial content to sync, content is committed on Close.
+ */
+func (f *s3WriteFile) Sync() error {
+	return nil
+}
+
+func (f *s3WriteFile) startUpload() error {
+	if f.uploadID != "" {
+		return nil
+	}
+	resp, err := f.fs.do("POST", f.bucket, f.key, map[string]string{ "uploads": "" }, nil, nil)
+	if err != nil {
+		return &iofs.PathError{ Op: "write", Path: f.name, Err: err }
+	}
+	var result struct {
+		UploadId string
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if err != nil {
+		return &iofs.PathError{ Op: "write", Path: f.name, Err: err }
+	}
+	f.uploadID = result.UploadId
+	return nil
+}
+
+func (f *s3WriteFile) uploadPart(part []byte) error {
+
+	if err := f.startUpload(); err != nil {
+		return err
+	}
+
+	partNumber := len(f.parts) + 1
+	query := map[string]string{ "partNumber": strconv.Itoa(partNumber), "uploadId": f.uploadID }
+	resp, err := f.fs.do("PUT", f.bucket, f.key, query, nil, part)
+	if err != nil {
+		return &iofs.PathError{ Op: "write", Path: f.name, Err: err }
+	}
+	resp.Body.Close()
+
+	f.parts = append(f.parts, s3CompletedPart{ PartNumber: partNumber, ETag: resp.Header.Get("ETag") })
+	return nil
+}
+
+/**
+Copies the object by UploadPartCopy requests of S3MaxCopySize ranges and completes the upload.
+ */
+func (f *s3WriteFile) copyParts(bucket, key string, size int64) error {
+
+	if err := f.startUpload(); err != nil {
+		return err
+	}
+
+	source := s3EscapePath("/" + bucket + "/" + key)
+	for from := int64(0); from < size; from += S3MaxCopySize {
+		to := from + S3MaxCopySize - 1
+		if to >= size {
+			to = size - 1
+		}
+		partNumber := len(f.parts) + 1
+		query := map[string]string{ "partNumber": strconv.Itoa(partNumber), "uploadId": f.uploadID }
+		header := map[string]string{
+			"x-amz-copy-source":       source,
+			"x-amz-copy-source-range": fmt.Sprintf("bytes=%d-%d", from, to),
+		}
+		resp, err := f.fs.do("PUT", f.bucket, f.key, query, header, nil)
+		if err != nil {
+			f.abortUpload()
+			return &iofs.PathError{ Op: "rename", Path: f.name, Err: err }
+		}
+		// copy could fail after the response status is sent
+		var result struct {
+			ETag string
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil && bytes.Contains(body, []byte("<Error>")) {
+			err = errors.Errorf("copy part error, %s", body)
+		}
+		if err == nil {
+			err = xml.Unmarshal(body, &result)
+		}
+		if err != nil {
+			f.abortUpload()
+			return &iofs.PathError{ Op: "rename", Path: f.name, Err: err }
+		}
+		f.parts = append(f.parts, s3CompletedPart{ PartNumber: partNumber, ETag: result.ETag })
+	}
+
+	return f.Close()
+}
+
+func (f *s3WriteFile) Close() error {
+
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+
+	if f.uploadID == "" {
+		resp, err := f.fs.do("PUT", f.bucket, f.key, nil, nil, f.buf.Bytes())
+		if err != nil {
+			return &iofs.PathError{ Op: "close", Path: f.name, Err: err }
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	if f.buf.Len() > 0 {
+		if err := f.uploadPart(f.buf.Bytes()); err != nil {
+			f.abortUpload()
+			return err
+		}
+	}
+
+	body, err := xml.Marshal(&s3CompleteUpload{ Parts: f.parts })
+	if err != nil {
+		f.abortUpload()
+		return err
+	}
+	resp, err := f.fs.do("POST", f.bucket, f.key, map[string]string{ "uploadId": f.uploadID }, nil, body)
+	if err != nil {
+		f.abortUpload()
+		return &iofs.PathError{ Op: "close", Path: f.name, Err: err }
+	}
+	// completion could fail after the response status is sent
+	result, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err == nil && bytes.Contains(result, []byte("<Error>")) {
+		err = errors.Errorf("complete upload error, %s", result)
+	}
+	if err != nil {
+		f.abortUpload()
+		return &iofs.PathError{ Op: "close", Path: f.name, Err: err }
+	}
+	return nil
+}
+
+/**
+Discards written content without creating the object.
+ */
+func (f *s3WriteFile) Abort() error {
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	f.buf.Reset()
+	if f.uploadID != "" {
+		return f.abortUpload()
+	}
+	return nil
+}
+
+func (f *s3WriteFile) abortUpload() error {
+	resp, err := f.fs.do("DELETE", f.bucket, f.key, map[string]string{ "uploadId": f.uploadID }, nil, nil)
+	if err != nil {
+		return &iofs.PathError{ Op: "abort", Path: f.name, Err: err }
+	}
+	resp.Body.Close()
+	return nil
+}
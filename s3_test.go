@@ -0,0 +1,298 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod_test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"github.com/sprintframework/fsmod"
+	"github.com/stretchr/testify/require"
+	iofs "io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+/**
+Minimal in-memory stand-in of S3 API with path style addressing.
+ */
+type fakeS3 struct {
+	sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	counter int
+	multipartUploads int
+	copies  int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{ objects: make(map[string][]byte), uploads: make(map[string]map[int][]byte) }
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") || r.Header.Get("x-amz-date") == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	query := r.URL.Query()
+
+	switch {
+	case r.Method == "GET" && query.Get("list-type") == "2":
+		s.list(w, path, query.Get("prefix"), query.Get("delimiter"))
+
+	case r.Method == "GET" || r.Method == "HEAD":
+		content, ok := s.objects[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		status := http.StatusOK
+		if rng := r.Header.Get("Range"); rng != "" {
+			from, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+			content = content[from:]
+			status = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.WriteHeader(status)
+		if r.Method == "GET" {
+			w.Write(content)
+		}
+
+	case r.Method == "POST" && query.Has("uploads"):
+		s.counter++
+		s.multipartUploads++
+		id := fmt.Sprintf("upload%d", s.counter)
+		s.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+
+	case r.Method == "PUT" && query.Has("uploadId"):
+		parts, ok := s.uploads[query.Get("uploadId")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		n, _ := strconv.Atoi(query.Get("partNumber"))
+		if r.Header.Get("x-amz-copy-source") != "" {
+			s.copies++
+			source, _ := url.PathUnescape(r.Header.Get("x-amz-copy-source"))
+			var from, to int
+			fmt.Sscanf(r.Header.Get("x-amz-copy-source-range"), "bytes=%d-%d", &from, &to)
+			parts[n] = s.objects[strings.TrimPrefix(source, "/")][from:to + 1]
+			fmt.Fprintf(w, "<CopyPartResult><ETag>\"etag%d\"</ETag></CopyPartResult>", n)
+			return
+		}
+		parts[n], _ = ioutil.ReadAll(r.Body)
+		w.Header().Set("ETag", fmt.Sprintf("\"etag%d\"", n))
+
+	case r.Method == "POST" && query.Has("uploadId"):
+		parts, ok := s.uploads[query.Get("uploadId")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var complete struct {
+			Part []struct {
+				PartNumber int
+			}
+		}
+		xml.NewDecoder(r.Body).Decode(&complete)
+		var content []byte
+		for _, p := range complete.Part {
+			content = append(content, parts[p.PartNumber]...)
+		}
+		s.objects[path] = content
+		delete(s.uploads, query.Get("uploadId"))
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+
+	case r.Method == "DELETE" && query.Has("uploadId"):
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == "PUT" && r.Header.Get("x-amz-copy-source") != "":
+		s.copies++
+		source, _ := url.PathUnescape(r.Header.Get("x-amz-copy-source"))
+		content, ok := s.objects[strings.TrimPrefix(source, "/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		s.objects[path] = content
+		fmt.Fprint(w, "<CopyObjectResult></CopyObjectResult>")
+
+	case r.Method == "PUT":
+		s.objects[path], _ = ioutil.ReadAll(r.Body)
+
+	case r.Method == "DELETE":
+		delete(s.objects, path)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *fakeS3) list(w http.ResponseWriter, bucket, prefix, delimiter string) {
+	var keys []string
+	prefixes := make(map[string]bool)
+	for name := range s.objects {
+		if !strings.HasPrefix(name, bucket + "/" + prefix) {
+			continue
+		}
+		key := strings.TrimPrefix(name, bucket + "/")
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			prefixes[key[:len(prefix) + i + 1]] = true
+		} else {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	buf.WriteString("<ListBucketResult><IsTruncated>false</IsTruncated>")
+	for _, key := range keys {
+		fmt.Fprintf(&buf, "<Contents><Key>%s</Key><Size>%d</Size></Contents>", key, len(s.objects[bucket + "/" + key]))
+	}
+	for p := range prefixes {
+		fmt.Fprintf(&buf, "<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>", p)
+	}
+	buf.WriteString("</ListBucketResult>")
+	w.Write(buf.Bytes())
+}
+
+func TestS3FileSystem(t *testing.T) {
+
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	s3 := fsmod.S3FileSystem(fsmod.S3Config{
+		Endpoint:  server.URL,
+		AccessKey: "access",
+		SecretKey: "secret",
+		PartSize:  64,
+	})
+
+	fs := fsmod.FileSystemService(fsmod.SchemeFileSystem(fsmod.OSFileSystem(), map[string]fsmod.FileSystem{
+		fsmod.S3Scheme: s3,
+	}))
+	fs.SetProtoIndexInterval(10)
+
+	writer, err := fs.NewAtomicProtoFile("s3://source/data/domains.pb")
+	require.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		_, err = writer.Write(&Domain{ Domain: fmt.Sprintf("obj%d", i) })
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Close())
+
+	// file and its index are larger than part size, so both were uploaded in parts directly to the target keys
+	require.Equal(t, 2, fake.multipartUploads)
+	require.Equal(t, 2, len(fake.objects))
+	require.Equal(t, 0, fake.copies)
+
+	domains := readDomains(t, fs, "s3://source/data/domains.pb")
+	require.Equal(t, 50, len(domains))
+	require.Equal(t, "obj49", domains[49])
+
+	seeker, err := fs.OpenProtoSeekFile("s3://source/data/domains.pb")
+	require.NoError(t, err)
+	require.Equal(t, int64(50), seeker.Count())
+	require.NoError(t, seeker.SeekRecord(37))
+	var msg Domain
+	require.NoError(t, seeker.ReadTo(&msg))
+	require.Equal(t, "obj37", msg.Domain)
+	require.NoError(t, seeker.Close())
+
+	// split in to another bucket and join back to the local disk
+	parts, err := fs.SplitProtoFile("s3://source/data/domains.pb", &msg, 20, func(i int) string {
+		return fmt.Sprintf("s3://parts/domains/part%d.pb", i)
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, len(parts))
+
+	entries, err := iofs.ReadDir(s3, "s3://parts/domains")
+	require.NoError(t, err)
+	require.Equal(t, 6, len(entries))
+
+	fd, err := ioutil.TempFile(os.TempDir(), "s3-test")
+	require.NoError(t, err)
+	localPath := fd.Name() + ".pb"
+	fd.Close()
+	os.Remove(fd.Name())
+	defer os.Remove(localPath)
+
+	require.NoError(t, fs.JoinProtoFiles(localPath, &msg, parts))
+	require.Equal(t, domains, readDomains(t, fs, localPath))
+
+	// aborted writer does not create the object
+	csv, err := fs.NewAtomicCsvFile("s3://source/table.csv")
+	require.NoError(t, err)
+	require.NoError(t, csv.Write("name"))
+	require.NoError(t, csv.Abort())
+	_, err = fs.OpenCsvFile("s3://source/table.csv")
+	require.Error(t, err)
+	require.Equal(t, 0, len(fake.uploads))
+
+	_, err = fs.OpenCsvFile("gs://bucket/table.csv")
+	require.Error(t, err)
+}
+
+func TestS3AtomicWrite(t *testing.T) {
+
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	s3 := fsmod.S3FileSystem(fsmod.S3Config{
+		Endpoint:  server.URL,
+		AccessKey: "access",
+		SecretKey: "secret",
+		PartSize:  64,
+	})
+	fs := fsmod.FileSystemService(s3)
+
+	// atomic outputs are uploaded once without temp object and copy
+	writeCsvRows(t, fs, "s3://bucket/data/table.csv", [][]string{ { "id" }, { "1" }, { "2" }, { "3" } })
+	parts, err := fs.SplitCsvFile("s3://bucket/data/table.csv", 2, func(i int) string {
+		return fmt.Sprintf("s3://bucket/data/parts/part%d.csv", i)
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(parts))
+	require.Equal(t, 0, fake.copies)
+	require.Equal(t, 3, len(fake.objects))
+	require.Equal(t, [][]string{ { "id" }, { "3" } }, readCsvRows(t, fs, "s3://bucket/data/parts/part2.csv"))
+
+	// failed write keeps the previous object
+	writer, err := fs.NewAtomicCsvFile("s3://bucket/data/table.csv")
+	require.NoError(t, err)
+	require.NoError(t, writer.Write("broken"))
+	require.NoError(t, writer.Abort())
+	require.Equal(t, [][]string{ { "id" }, { "1" }, { "2" }, { "3" } }, readCsvRows(t, fs, "s3://bucket/data/table.csv"))
+
+	// object larger than the single copy limit is renamed by part copies
+	maxCopySize := fsmod.S3MaxCopySize
+	fsmod.S3MaxCopySize = 5
+	defer func() { fsmod.S3MaxCopySize = maxCopySize }()
+
+	require.NoError(t, s3.Rename("s3://bucket/data/table.csv", "s3://bucket/data/moved.csv"))
+	require.Equal(t, 2, fake.copies)
+	require.Equal(t, "id\n1\n2\n3\n", string(fake.objects["bucket/data/moved.csv"]))
+	_, ok := fake.objects["bucket/data/table.csv"]
+	require.False(t, ok)
+}
@@ -0,0 +1,741 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// memory used by sort for records before they are spilled to the temp run
+var DefaultSortMemory int64 = 64 * 1024 * 1024
+
+// maximum number of runs merged at once, more runs are merged in several passes
+var SortMergeFanIn = 64
+
+// dialect of temp runs of CSV sort that keeps values as is
+var sortCsvDialect = CsvDialect{ Comma: ',', FieldsPerRecord: -1 }
+
+/**
+Compares two values, returns negative number if a is less than b, zero if they are equal and positive number otherwise.
+ */
+type SortComparator func(a, b string) int
+
+/**
+Sort key of CSV or JSON record.
+ */
+type SortKey struct {
+	Name       string         // CSV column name or JSON path separated by dots
+	Compare    SortComparator // CompareStrings if nil
+	Descending bool
+}
+
+/**
+Extension of the file service that sorts files larger than memory by external merge sort.
+
+Records are collected in memory up to the memory budget, sorted and spilled to temp runs written by the file writers,
+then runs are merged in to the output file. Sort is stable, output file is written atomically.
+Memory of the record is estimated by its encoded size, so the actual heap usage could be several times more.
+ */
+type SortFileService interface {
+
+	/*
+	Gets memory budget of sort in bytes.
+	 */
+	SortMemory() int64
+
+	/*
+	Sets memory budget of sort in bytes.
+	 */
+	SetSortMemory(bytes int64)
+
+	/*
+	Gets directory of temp runs, empty value means directory of the output file.
+	 */
+	SortTempDir() string
+
+	/*
+	Sets directory of temp runs.
+	 */
+	SetSortTempDir(dir string)
+
+	/*
+	Sorts CSV file by columns, header stays the first row.
+	 */
+	SortCsvFile(ctx context.Context, inputFilePath, outputFilePath string, keys ...SortKey) error
+
+	/*
+	Sorts JSON file by values of JSON paths, missing values are empty.
+	 */
+	SortJsonFile(ctx context.Context, inputFilePath, outputFilePath string, keys ...SortKey) error
+
+	/*
+	Sorts protofile by comparator, holder could be nil for files with descriptor header.
+	 */
+	SortProtoFile(ctx context.Context, inputFilePath, outputFilePath string, holder proto.Message, compare func(a, b proto.Message) int) error
+}
+
+/**
+Compares strings byte by byte.
+ */
+func CompareStrings(a, b string) int {
+	return strings.Compare(a, b)
+}
+
+/**
+Compares decimal numbers, values that are not numbers go after numbers and are compared as strings.
+ */
+func CompareNumbers(a, b string) int {
+	x, errA := strconv.ParseFloat(strings.TrimSpace(a), 64)
+	y, errB := strconv.ParseFloat(strings.TrimSpace(b), 64)
+	return compareParsed(errA == nil, errB == nil, x < y, x > y, a, b)
+}
+
+/**
+Returns comparator of times in the layout, values that are not times go after times and are compared as strings.
+ */
+func CompareTimes(layout string) SortComparator {
+	return func(a, b string) int {
+		x, errA := time.Parse(layout, a)
+		y, errB := time.Parse(layout, b)
+		return compareParsed(errA == nil, errB == nil, x.Before(y), x.After(y), a, b)
+	}
+}
+
+func compareParsed(okA, okB, less, greater bool, a, b string) int {
+	switch {
+	case okA && okB:
+		switch {
+		case less:
+			return -1
+		case greater:
+			return 1
+		}
+		return 0
+	case okA:
+		return -1
+	case okB:
+		return 1
+	default:
+		return strings.Compare(a, b)
+	}
+}
+
+/**
+Compares lists of key values by sort keys.
+ */
+func compareKeys(keys []SortKey, a, b []string) int {
+	for i, key := range keys {
+		compare := key.Compare
+		if compare == nil {
+			compare = CompareStrings
+		}
+		var x, y string
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if c := compare(x, y); c != 0 {
+			if key.Descending {
+				return -c
+			}
+			return c
+		}
+	}
+	return 0
+}
+
+func (t *fileServiceImpl) SortMemory() int64 {
+	return t.sortMemory
+}
+
+func (t *fileServiceImpl) SetSortMemory(bytes int64) {
+	t.sortMemory = bytes
+}
+
+func (t *fileServiceImpl) SortTempDir() string {
+	return t.sortTempDir
+}
+
+func (t *fileServiceImpl) SetSortTempDir(dir string) {
+	t.sortTempDir = dir
+}
+
+/**
+Temp runs of the sort and the comparator of records.
+ */
+type sortRuns[R any] struct {
+	t       *fileServiceImpl
+	outputFilePath string
+	ext     string // extension of temp runs
+	compare func(a, b R) int
+	size    func(record R) int64
+	create  func(runPath string) (write func(R) error, close func() error, err error)
+	open    func(runPath string) (read func() (R, error), close func() error, err error)
+	paths   []string // all created runs
+}
+
+/**
+Reserves unique name of the temp run, the run itself is created by the writer of the format.
+ */
+func (s *sortRuns[R]) newRunPath() (string, error) {
+	dir := s.t.sortTempDir
+	if dir == "" {
+		dir, _ = splitFilePath(s.outputFilePath)
+	}
+	fd, err := s.t.fsys.CreateTemp(dir, ".sort-*" + s.ext)
+	if err != nil {
+		return "", errors.Errorf("sort temp file create error in '%s', %v", dir, err)
+	}
+	fd.Close()
+	s.paths = append(s.paths, fd.Name())
+	return fd.Name(), nil
+}
+
+func (s *sortRuns[R]) removeAll() {
+	for _, runPath := range s.paths {
+		s.t.fsys.Remove(runPath)
+	}
+}
+
+func (s *sortRuns[R]) writeRun(records []R) (string, error) {
+	runPath, err := s.newRunPath()
+	if err != nil {
+		return "", err
+	}
+	write, closeFn, err := s.create(runPath)
+	if err != nil {
+		return "", err
+	}
+	for _, record := range records {
+		if err = write(record); err != nil {
+			closeFn()
+			return "", errors.Errorf("sort write run '%s', %v", runPath, err)
+		}
+	}
+	if err = closeFn(); err != nil {
+		return "", errors.Errorf("sort close run '%s', %v", runPath, err)
+	}
+	return runPath, nil
+}
+
+/**
+Sorts records of the input and writes them to output. Records from read must be detached from the reader.
+ */
+func externalSort[R any](ctx context.Context, s *sortRuns[R], read func() (R, error), write func(R) error) error {
+
+	defer s.removeAll()
+
+	var buffer []R
+	var memory int64
+	var runs []string
+
+	sortBuffer := func() {
+		sort.SliceStable(buffer, func(i, j int) bool { return s.compare(buffer[i], buffer[j]) < 0 })
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		record, err := read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		buffer = append(buffer, record)
+		memory += s.size(record)
+
+		if memory >= s.t.sortMemory {
+			sortBuffer()
+			runPath, err := s.writeRun(buffer)
+			if err != nil {
+				return err
+			}
+			runs = append(runs, runPath)
+			buffer, memory = nil, 0
+		}
+	}
+
+	sortBuffer()
+
+	if len(runs) == 0 {
+		for _, record := range buffer {
+			if err := write(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if len(buffer) > 0 {
+		runPath, err := s.writeRun(buffer)
+		if err != nil {
+			return err
+		}
+		runs = append(runs, runPath)
+		buffer = nil
+	}
+
+	return s.mergeAll(ctx, runs, write)
+}
+
+/**
+Merges runs in several passes if there are more runs than the fan-in.
+ */
+func (s *sortRuns[R]) mergeAll(ctx context.Context, runs []string, write func(R) error) error {
+
+	// groups of runs are merged in order, so ties keep order of the input
+	for len(runs) > SortMergeFanIn {
+		var next []string
+		for i := 0; i < len(runs); i += SortMergeFanIn {
+			group := runs[i:min(i + SortMergeFanIn, len(runs))]
+			if len(group) == 1 {
+				next = append(next, group[0])
+				continue
+			}
+			runPath, err := s.mergeRuns(ctx, group)
+			if err != nil {
+				return err
+			}
+			next = append(next, runPath)
+		}
+		runs = next
+	}
+
+	return s.merge(ctx, runs, write)
+}
+
+func (s *sortRuns[R]) mergeRuns(ctx context.Context, runs []string) (string, error) {
+	runPath, err := s.newRunPath()
+	if err != nil {
+		return "", err
+	}
+	write, closeFn, err := s.create(runPath)
+	if err != nil {
+		return "", err
+	}
+	if err = s.merge(ctx, runs, write); err != nil {
+		closeFn()
+		return "", err
+	}
+	if err = closeFn(); err != nil {
+		return "", errors.Errorf("sort close run '%s', %v", runPath, err)
+	}
+	for _, run := range runs {
+		s.t.fsys.Remove(run)
+	}
+	return runPath, nil
+}
+
+func (s *sortRuns[R]) merge(ctx context.Context, runs []string, write func(R) error) error {
+	inputs := make([]*mergeInput[R], 0, len(runs))
+	defer func() {
+		for _, in := range inputs {
+			in.close()
+		}
+	}()
+	for _, runPath := range runs {
+		read, closeFn, err := s.open(runPath)
+		if err != nil {
+			return errors.Errorf("sort open run '%s', %v", runPath, err)
+		}
+		inputs = append(inputs, &mergeInput[R]{ name: runPath, read: read, close: closeFn })
+	}
+	return mergeInputs(ctx, inputs, s.compare, write)
+}
+
+/**
+Sorted input of the k-way merge.
+ */
+type mergeInput[R any] struct {
+	name  string
+	read  func() (R, error)
+	close func() error
+	head  R
+	index int // position of the input, ties are taken from the first input
+}
+
+type mergeHeap[R any] struct {
+	inputs  []*mergeInput[R]
+	compare func(a, b R) int
+}
+
+func (h *mergeHeap[R]) Len() int {
+	return len(h.inputs)
+}
+
+func (h *mergeHeap[R]) Less(i, j int) bool {
+	if c := h.compare(h.inputs[i].head, h.inputs[j].head); c != 0 {
+		return c < 0
+	}
+	return h.inputs[i].index < h.inputs[j].index
+}
+
+func (h *mergeHeap[R]) Swap(i, j int) {
+	h.inputs[i], h.inputs[j] = h.inputs[j], h.inputs[i]
+}
+
+func (h *mergeHeap[R]) Push(x any) {
+	h.inputs = append(h.inputs, x.(*mergeInput[R]))
+}
+
+func (h *mergeHeap[R]) Pop() any {
+	n := len(h.inputs)
+	x := h.inputs[n-1]
+	h.inputs = h.inputs[:n-1]
+	return x
+}
+
+/**
+Merges sorted inputs in to one sorted sequence, inputs are not closed.
+ */
+func mergeInputs[R any](ctx context.Context, inputs []*mergeInput[R], compare func(a, b R) int, write func(R) error) error {
+
+	h := &mergeHeap[R]{ compare: compare }
+	for i, in := range inputs {
+		in.index = i
+		head, err := in.read()
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			return errors.Errorf("merge read file '%s', %v", in.name, err)
+		}
+		in.head = head
+		h.inputs = append(h.inputs, in)
+	}
+	heap.Init(h)
+
+	for h.Len() > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		in := h.inputs[0]
+		if err := write(in.head); err != nil {
+			return err
+		}
+		head, err := in.read()
+		switch {
+		case err == io.EOF:
+			heap.Pop(h)
+		case err != nil:
+			return errors.Errorf("merge read file '%s', %v", in.name, err)
+		default:
+			in.head = head
+			heap.Fix(h, 0)
+		}
+	}
+
+	return nil
+}
+
+func (t *fileServiceImpl) SortCsvFile(ctx context.Context, inputFilePath, outputFilePath string, keys ...SortKey) error {
+
+	reader, err := t.OpenCsvFile(inputFilePath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	header, err := reader.Read()
+	if err != nil {
+		return errors.Errorf("can not read header in file '%s', %v", inputFilePath, err)
+	}
+	// record could be reused by reader
+	header = append([]string(nil), header...)
+
+	columns, err := csvSortColumns(header, keys)
+	if err != nil {
+		return errors.Errorf("sort file '%s', %v", inputFilePath, err)
+	}
+
+	writer, err := t.newCsvFile(outputFilePath, true, t.FileDialect(outputFilePath), nil)
+	if err != nil {
+		return err
+	}
+	if err = writer.Write(header...); err != nil {
+		writer.Abort()
+		return err
+	}
+
+	runs := t.csvSortRuns(outputFilePath, keys, columns)
+	err = externalSort(ctx, runs, func() (*csvSortRecord, error) {
+		row, err := reader.Read()
+		if err != nil {
+			return nil, err
+		}
+		// record could be reused by reader
+		return csvSortKeys(append([]string(nil), row...), columns), nil
+	}, func(record *csvSortRecord) error {
+		return writer.Write(record.row...)
+	})
+
+	if err != nil {
+		writer.Abort()
+		return err
+	}
+	return writer.Close()
+}
+
+func csvSortColumns(header []string, keys []SortKey) ([]int, error) {
+	columns := make([]int, len(keys))
+	for i, key := range keys {
+		columns[i] = -1
+		for j, name := range header {
+			if name == key.Name {
+				columns[i] = j
+				break
+			}
+		}
+		if columns[i] < 0 {
+			return nil, errors.Errorf("column '%s' not found in header %v", key.Name, header)
+		}
+	}
+	return columns, nil
+}
+
+func csvRowKeys(row []string, columns []int) []string {
+	values := make([]string, len(columns))
+	for i, j := range columns {
+		if j < len(row) {
+			values[i] = row[j]
+		}
+	}
+	return values
+}
+
+/**
+CSV row with values of sort keys, keys share strings of the row.
+ */
+type csvSortRecord struct {
+	row  []string
+	keys []string
+}
+
+func csvSortKeys(row []string, columns []int) *csvSortRecord {
+	return &csvSortRecord{ row: row, keys: csvRowKeys(row, columns) }
+}
+
+func (t *fileServiceImpl) csvSortRuns(outputFilePath string, keys []SortKey, columns []int) *sortRuns[*csvSortRecord] {
+	return &sortRuns[*csvSortRecord]{
+		t:              t,
+		outputFilePath: outputFilePath,
+		ext:            ".csv",
+		compare: func(a, b *csvSortRecord) int {
+			return compareKeys(keys, a.keys, b.keys)
+		},
+		size: func(record *csvSortRecord) int64 {
+			size := int64(48) + int64(len(record.keys)) * 16
+			for _, value := range record.row {
+				size += int64(len(value)) + 16
+			}
+			return size
+		},
+		create: func(runPath string) (func(*csvSortRecord) error, func() error, error) {
+			w, err := t.newCsvFile(runPath, false, sortCsvDialect, nil)
+			if err != nil {
+				return nil, nil, err
+			}
+			return func(record *csvSortRecord) error { return w.Write(record.row...) }, w.Close, nil
+		},
+		open: func(runPath string) (func() (*csvSortRecord, error), func() error, error) {
+			r, err := t.OpenCsvDialectFile(runPath, sortCsvDialect)
+			if err != nil {
+				return nil, nil, err
+			}
+			return func() (*csvSortRecord, error) {
+				row, err := r.Read()
+				if err != nil {
+					return nil, err
+				}
+				return csvSortKeys(row, columns), nil
+			}, r.Close, nil
+		},
+	}
+}
+
+/**
+JSON record with values of sort keys.
+ */
+type jsonSortRecord struct {
+	raw  json.RawMessage
+	keys []string
+}
+
+func jsonSortKeys(raw json.RawMessage, paths [][]string) (*jsonSortRecord, error) {
+	record := &jsonSortRecord{ raw: raw, keys: make([]string, len(paths)) }
+	for i, path := range paths {
+		value, err := jsonPathValue(raw, path)
+		if err != nil {
+			return nil, err
+		}
+		record.keys[i] = value
+	}
+	return record, nil
+}
+
+func jsonSortPaths(keys []SortKey) [][]string {
+	paths := make([][]string, len(keys))
+	for i, key := range keys {
+		paths[i] = strings.Split(strings.TrimPrefix(key.Name, "$."), ".")
+	}
+	return paths
+}
+
+func (t *fileServiceImpl) SortJsonFile(ctx context.Context, inputFilePath, outputFilePath string, keys ...SortKey) error {
+
+	reader, err := t.OpenJsonFile(inputFilePath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	writer, err := t.newJsonFile(outputFilePath, true)
+	if err != nil {
+		return err
+	}
+
+	paths := jsonSortPaths(keys)
+	runs := t.jsonSortRuns(outputFilePath, keys, paths)
+	err = externalSort(ctx, runs, func() (*jsonSortRecord, error) {
+		raw, err := reader.ReadRaw()
+		if err != nil {
+			return nil, err
+		}
+		return jsonSortKeys(append(json.RawMessage(nil), raw...), paths)
+	}, func(record *jsonSortRecord) error {
+		return writer.WriteRaw(record.raw)
+	})
+
+	if err != nil {
+		writer.Abort()
+		return err
+	}
+	return writer.Close()
+}
+
+func (t *fileServiceImpl) jsonSortRuns(outputFilePath string, keys []SortKey, paths [][]string) *sortRuns[*jsonSortRecord] {
+	return &sortRuns[*jsonSortRecord]{
+		t:              t,
+		outputFilePath: outputFilePath,
+		ext:            ".json",
+		compare: func(a, b *jsonSortRecord) int {
+			return compareKeys(keys, a.keys, b.keys)
+		},
+		size: func(record *jsonSortRecord) int64 {
+			size := int64(len(record.raw)) + 48
+			for _, value := range record.keys {
+				size += int64(len(value)) + 16
+			}
+			return size
+		},
+		create: func(runPath string) (func(*jsonSortRecord) error, func() error, error) {
+			w, err := t.newJsonFile(runPath, false)
+			if err != nil {
+				return nil, nil, err
+			}
+			return func(record *jsonSortRecord) error { return w.WriteRaw(record.raw) }, w.Close, nil
+		},
+		open: func(runPath string) (func() (*jsonSortRecord, error), func() error, error) {
+			r, err := t.OpenJsonFile(runPath)
+			if err != nil {
+				return nil, nil, err
+			}
+			return func() (*jsonSortRecord, error) {
+				raw, err := r.ReadRaw()
+				if err != nil {
+					return nil, err
+				}
+				return jsonSortKeys(raw, paths)
+			}, r.Close, nil
+		},
+	}
+}
+
+func (t *fileServiceImpl) SortProtoFile(ctx context.Context, inputFilePath, outputFilePath string, holder proto.Message, compare func(a, b proto.Message) int) error {
+
+	reader, err := t.openProtoFile(inputFilePath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	messageType := reader.messageType
+	if holder == nil {
+		if messageType == nil {
+			return errors.Errorf("holder is required for file '%s' without descriptor header", inputFilePath)
+		}
+		holder = messageType.New().Interface()
+	}
+
+	writer, err := t.newProtoFile(outputFilePath, true, describe(messageType))
+	if err != nil {
+		return err
+	}
+
+	runs := t.protoSortRuns(outputFilePath, holder, compare)
+	err = externalSort(ctx, runs, func() (proto.Message, error) {
+		message := holder.ProtoReflect().New().Interface()
+		return message, reader.ReadTo(message)
+	}, func(message proto.Message) error {
+		_, err := writer.Write(message)
+		return err
+	})
+
+	if err != nil {
+		writer.Abort()
+		return err
+	}
+	return writer.Close()
+}
+
+func (t *fileServiceImpl) protoSortRuns(outputFilePath string, holder proto.Message, compare func(a, b proto.Message) int) *sortRuns[proto.Message] {
+	// temp runs do not need index and descriptor header
+	v := *t
+	v.protoIndexInterval = 0
+	return &sortRuns[proto.Message]{
+		t:              t,
+		outputFilePath: outputFilePath,
+		ext:            ".pb",
+		compare:        compare,
+		size: func(message proto.Message) int64 {
+			return int64(proto.Size(message)) + 64
+		},
+		create: func(runPath string) (func(proto.Message) error, func() error, error) {
+			w, err := v.newProtoFile(runPath, false, nil)
+			if err != nil {
+				return nil, nil, err
+			}
+			return func(message proto.Message) error {
+				_, err := w.Write(message)
+				return err
+			}, w.Close, nil
+		},
+		open: func(runPath string) (func() (proto.Message, error), func() error, error) {
+			r, err := v.OpenProtoFile(runPath)
+			if err != nil {
+				return nil, nil, err
+			}
+			return func() (proto.Message, error) {
+				message := holder.ProtoReflect().New().Interface()
+				return message, r.ReadTo(message)
+			}, r.Close, nil
+		},
+	}
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package fsmod_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/sprintframework/fsmod"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"io"
+	iofs "io/fs"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSortCsvFile(t *testing.T) {
+
+	mem := fsmod.MemFileSystem()
+	fs := fsmod.FileSystemService(mem)
+	fs.SetSortMemory(200)
+	fs.SetSortTempDir("tmp")
+
+	csv, err := fs.NewCsvFile("table.csv")
+	require.NoError(t, err)
+	require.NoError(t, csv.Write("id", "group", "amount"))
+	for i := 0; i < 100; i++ {
+		require.NoError(t, csv.Write(strconv.Itoa(i), fmt.Sprintf("group%d", i % 3), strconv.Itoa((i * 37) % 100)))
+	}
+	require.NoError(t, csv.Close())
+
+	// runs are spilled to temp directory and merged in several passes
+	fanIn := fsmod.SortMergeFanIn
+	fsmod.SortMergeFanIn = 3
+	defer func() { fsmod.SortMergeFanIn = fanIn }()
+
+	require.NoError(t, fs.SortCsvFile(context.Background(), "table.csv", "sorted.csv",
+		fsmod.SortKey{ Name: "group" },
+		fsmod.SortKey{ Name: "amount", Compare: fsmod.CompareNumbers, Descending: true }))
+
+	rows := readCsvRows(t, fs, "sorted.csv")
+	require.Equal(t, []string{ "id", "group", "amount" }, rows[0])
+	require.Equal(t, 101, len(rows))
+	for i := 2; i < len(rows); i++ {
+		prev, row := rows[i-1], rows[i]
+		require.True(t, prev[1] <= row[1])
+		if prev[1] == row[1] {
+			a, _ := strconv.Atoi(prev[2])
+			b, _ := strconv.Atoi(row[2])
+			require.True(t, a >= b)
+		}
+	}
+
+	// temp runs are removed
+	entries, err := iofs.ReadDir(mem, "tmp")
+	if err == nil {
+		require.Equal(t, 0, len(entries))
+	}
+
+	require.Error(t, fs.SortCsvFile(context.Background(), "table.csv", "sorted.csv", fsmod.SortKey{ Name: "missing" }))
+}
+
+func TestSortIsStable(t *testing.T) {
+
+	fs := fsmod.FileSystemService(fsmod.MemFileSystem())
+	fs.SetSortMemory(100)
+
+	csv, err := fs.NewCsvFile("table.csv")
+	require.NoError(t, err)
+	require.NoError(t, csv.Write("id", "key"))
+	for i := 0; i < 60; i++ {
+		require.NoError(t, csv.Write(strconv.Itoa(i), strconv.Itoa(i % 2)))
+	}
+	require.NoError(t, csv.Close())
+
+	require.NoError(t, fs.SortCsvFile(context.Background(), "table.csv", "sorted.csv", fsmod.SortKey{ Name: "key" }))
+
+	rows := readCsvRows(t, fs, "sorted.csv")
+	for i := 0; i < 30; i++ {
+		require.Equal(t, []string{ strconv.Itoa(i * 2), "0" }, rows[i + 1])
+		require.Equal(t, []string{ strconv.Itoa(i * 2 + 1), "1" }, rows[i + 31])
+	}
+}
+
+func TestCompareTimes(t *testing.T) {
+	compare := fsmod.CompareTimes(time.RFC3339)
+	require.True(t, compare("2023-01-02T00:00:00Z", "2023-01-01T23:00:00+02:00") > 0)
+	require.True(t, compare("2023-01-02T00:00:00Z", "never") < 0)
+	require.True(t, fsmod.CompareNumbers("9", "10") < 0)
+	require.True(t, fsmod.CompareNumbers("1e3", "999") > 0)
+}
+
+func TestSortJsonFile(t *testing.T) {
+
+	fs := fsmod.FileSystemService(fsmod.MemFileSystem())
+	fs.SetSortMemory(300)
+
+	writer, err := fs.NewJsonFile("users.json.gz")
+	require.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		require.NoError(t, writer.Write(map[string]interface{}{ "user": map[string]interface{}{ "id": i, "name": fmt.Sprintf("user%02d", (i * 7) % 50) } }))
+	}
+	require.NoError(t, writer.Close())
+
+	require.NoError(t, fs.SortJsonFile(context.Background(), "users.json.gz", "sorted.json", fsmod.SortKey{ Name: "$.user.name" }))
+
+	reader, err := fs.OpenJsonFile("sorted.json")
+	require.NoError(t, err)
+	defer reader.Close()
+	for i := 0; i < 50; i++ {
+		var holder struct {
+			User struct {
+				Name string `json:"name"`
+			} `json:"user"`
+		}
+		require.NoError(t, reader.Read(&holder))
+		require.Equal(t, fmt.Sprintf("user%02d", i), holder.User.Name)
+	}
+	_, err = reader.ReadRaw()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestSortProtoFile(t *testing.T) {
+
+	fs := fsmod.FileSystemService(fsmod.MemFileSystem())
+	fs.SetSortMemory(500)
+
+	writer, err := fs.NewProtoFile("domains.pb")
+	require.NoError(t, err)
+	for i := 0; i < 80; i++ {
+		_, err = writer.Write(&Domain{ Domain: fmt.Sprintf("obj%02d", (i * 13) % 80) })
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Close())
+
+	require.NoError(t, fs.SortProtoFile(context.Background(), "domains.pb", "sorted.pb", &Domain{}, func(a, b proto.Message) int {
+		return strings.Compare(a.(*Domain).Domain, b.(*Domain).Domain)
+	}))
+
+	domains := readDomains(t, fs, "sorted.pb")
+	require.Equal(t, 80, len(domains))
+	for i, domain := range domains {
+		require.Equal(t, fmt.Sprintf("obj%02d", i), domain)
+	}
+}
+
+func readCsvRows(t *testing.T, fs fsmod.ExtendedFileService, filePath string) [][]string {
+	reader, err := fs.OpenCsvFile(filePath)
+	require.NoError(t, err)
+	defer reader.Close()
+	var rows [][]string
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return rows
+		}
+		require.NoError(t, err)
+		rows = append(rows, append([]string(nil), row...))
+	}
+}